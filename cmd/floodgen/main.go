@@ -0,0 +1,140 @@
+// Command floodgen sends UDP packets as fast as it can, or at a fixed rate,
+// to load broadcast-relay and measure how much it forwards.
+//
+// Usage:
+//
+//	floodgen -target 255.255.255.255:9999 -size 512 -rate 50000 -duration 10s
+//
+// Every packet starts with its 8-byte big-endian sequence number, so that no
+// two are equal and -dedup-window does not drop them. Run the relay with
+// -stats-interval, or relay-latency behind it with -timestamp, to see what
+// made it through.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// counters is what has been sent so far.
+type counters struct {
+	packets uint64
+	bytes   uint64
+	errors  uint64
+}
+
+func (c counters) report(prev counters, elapsed time.Duration) string {
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	return fmt.Sprintf("sent=%d errors=%d rate=%.0f pps %.1f Mbit/s",
+		c.packets, c.errors,
+		float64(c.packets-prev.packets)/secs,
+		float64(c.bytes-prev.bytes)*8/secs/1e6)
+}
+
+func main() {
+	target := flag.String("target", "255.255.255.255:9999", "UDP address to send to; a broadcast address is allowed")
+	size := flag.Int("size", 512, "Payload size in bytes (8-65507)")
+	rate := flag.Int("rate", 0, "Packets per second (0 for as fast as possible)")
+	count := flag.Uint64("count", 0, "Stop after this many packets (0 for no limit)")
+	duration := flag.Duration("duration", 0, "Stop after this long (0 for no limit)")
+	interval := flag.Duration("interval", time.Second, "How often to report (0 to report only on exit)")
+	flag.Parse()
+
+	if *size < 8 || *size > 65507 {
+		fmt.Fprintf(os.Stderr, "Error: -size %d is out of range 8-65507\n", *size)
+		os.Exit(2)
+	}
+	if *rate < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -rate must not be negative\n")
+		os.Exit(2)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	// Go enables SO_BROADCAST on UDP sockets, so this also sends to a
+	// broadcast address.
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	fmt.Printf("Sending %d-byte packets from %s to %s\n", *size, conn.LocalAddr(), addr)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	var tick <-chan time.Time
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	payload := make([]byte, *size)
+	for i := 8; i < len(payload); i++ {
+		payload[i] = byte(i)
+	}
+
+	var sent, last counters
+	var seq uint64
+	start := time.Now()
+	lastReport := start
+	for *count == 0 || seq < *count {
+		// Checking the context and ticker on every packet would cost more
+		// than sending it; every 64 packets is often enough.
+		if seq%64 == 0 {
+			select {
+			case <-ctx.Done():
+				goto done
+			case now := <-tick:
+				fmt.Println(sent.report(last, now.Sub(lastReport)))
+				last, lastReport = sent, now
+			default:
+			}
+		}
+		if *rate > 0 {
+			// Pace against the start time rather than the previous packet,
+			// so that sleep granularity does not lower the rate.
+			due := start.Add(time.Duration(seq) * time.Second / time.Duration(*rate))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-ctx.Done():
+					goto done
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		seq++
+		binary.BigEndian.PutUint64(payload, seq)
+		n, err := conn.Write(payload)
+		if err != nil {
+			sent.errors++
+			continue
+		}
+		sent.packets++
+		sent.bytes += uint64(n)
+	}
+done:
+	elapsed := time.Since(start)
+	fmt.Printf("Total in %v: %s\n", elapsed.Round(time.Millisecond), sent.report(counters{}, elapsed))
+}
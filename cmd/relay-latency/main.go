@@ -0,0 +1,177 @@
+// Command relay-latency receives packets forwarded by broadcast-relay with
+// -timestamp and reports latency, jitter and loss for every relay socket
+// they come from.
+//
+// Usage:
+//
+//	relay-latency -listen :9999 -interval 5s
+//
+// Latency is measured against this host's clock, so it is only as accurate
+// as the clock synchronization between the two hosts. Jitter and loss do
+// not depend on it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/k0ngk0ng/broadcast-relay/relay"
+)
+
+// stream is what has been received from one relay socket.
+type stream struct {
+	received  uint64
+	reordered uint64
+	first     uint64
+	highest   uint64
+	// transit is the one-way delay of the last packet, and jitter the
+	// smoothed variation of it, as in RFC 3550.
+	transit time.Duration
+	jitter  float64
+	min     time.Duration
+	max     time.Duration
+	total   time.Duration
+}
+
+func (s *stream) add(seq uint64, transit time.Duration) {
+	if s.received > 0 && seq == 1 && s.highest > 1 {
+		// The relay restarted and numbers from 1 again.
+		*s = stream{}
+	}
+	if s.received == 0 {
+		s.first, s.highest = seq, seq
+		s.min, s.max = transit, transit
+	} else {
+		d := transit - s.transit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (float64(d) - s.jitter) / 16
+	}
+	s.received++
+	s.transit = transit
+	s.total += transit
+	s.min = min(s.min, transit)
+	s.max = max(s.max, transit)
+	switch {
+	case seq > s.highest:
+		s.highest = seq
+	case seq < s.highest:
+		s.reordered++
+	}
+	if seq < s.first {
+		s.first = seq
+	}
+}
+
+// lost is the number of packets between the first and highest sequence
+// numbers seen that did not arrive.
+func (s *stream) lost() uint64 {
+	expected := s.highest - s.first + 1
+	if s.received >= expected {
+		return 0
+	}
+	return expected - s.received
+}
+
+func (s *stream) String() string {
+	if s.received == 0 {
+		return "no packets"
+	}
+	expected := s.highest - s.first + 1
+	return fmt.Sprintf("received=%d lost=%d (%.2f%%) reordered=%d latency min/avg/max=%v/%v/%v jitter=%v",
+		s.received, s.lost(), 100*float64(s.lost())/float64(expected), s.reordered,
+		s.min, s.total/time.Duration(s.received), s.max, time.Duration(s.jitter))
+}
+
+func report(streams map[string]*stream, unstamped uint64) {
+	sources := make([]string, 0, len(streams))
+	for src := range streams {
+		sources = append(sources, src)
+	}
+	sort.Strings(sources)
+	for _, src := range sources {
+		fmt.Printf("%s %s\n", src, streams[src])
+	}
+	if unstamped > 0 {
+		fmt.Printf("%d packets too short to carry a -timestamp header\n", unstamped)
+	}
+}
+
+type datagram struct {
+	src      string
+	data     []byte
+	received time.Time
+}
+
+func main() {
+	listen := flag.String("listen", ":9999", "UDP address to receive stamped packets on")
+	interval := flag.Duration("interval", 5*time.Second, "How often to report (0 to report only on exit)")
+	flag.Parse()
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	fmt.Printf("Listening on %s\n", conn.LocalAddr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	packets := make(chan datagram, 1024)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, src, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- datagram{src.String(), append([]byte(nil), buf[:n]...), time.Now()}
+		}
+	}()
+
+	var tick <-chan time.Time
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	streams := make(map[string]*stream)
+	var unstamped uint64
+	for {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				report(streams, unstamped)
+				return
+			}
+			seq, sent, _, ok := relay.ParseStamp(p.data)
+			if !ok {
+				unstamped++
+				continue
+			}
+			s := streams[p.src]
+			if s == nil {
+				s = &stream{}
+				streams[p.src] = s
+			}
+			s.add(seq, p.received.Sub(sent))
+		case <-tick:
+			report(streams, unstamped)
+		case <-ctx.Done():
+			report(streams, unstamped)
+			return
+		}
+	}
+}
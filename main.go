@@ -1,298 +1,258 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
-	"time"
-)
 
-var (
-	version   = "dev"
-	buildTime = "unknown"
+	"github.com/k0ngk0ng/broadcast-relay/relay"
 )
 
-type Config struct {
-	ListenPort    int
-	ListenAddr    string
-	TargetAddrs   []string
-	BufferSize    int
-	Verbose       bool
-	ShowVersion   bool
-}
-
-type Relay struct {
-	config      *Config
-	conn        *net.UDPConn
-	targetConns []*net.UDPAddr
-	stats       *Stats
-	stopChan    chan struct{}
-	wg          sync.WaitGroup
-}
-
-type Stats struct {
-	PacketsReceived uint64
-	PacketsForwarded uint64
-	BytesReceived   uint64
-	BytesForwarded  uint64
-	Errors          uint64
-	mu              sync.RWMutex
-}
-
-func (s *Stats) AddReceived(bytes int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.PacketsReceived++
-	s.BytesReceived += uint64(bytes)
-}
+// Exit statuses besides 0 (stopped by a signal), 1 (runtime error) and 2
+// (bad flags).
+const (
+	// exitIdle is the exit status after the relay stopped because of
+	// -idle-timeout.
+	exitIdle = 3
+	// exitPortInUse is the exit status when the listen port is taken by
+	// another socket.
+	exitPortInUse = 4
+	// exitConfig is the exit status for an invalid configuration,
+	// including targets that do not resolve.
+	exitConfig = 5
+	// exitBind is the exit status when a listen socket or HTTP server
+	// cannot be set up for another reason than the port being in use.
+	exitBind = 6
+)
 
-func (s *Stats) AddForwarded(bytes int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.PacketsForwarded++
-	s.BytesForwarded += uint64(bytes)
+// exitStatus returns the exit status for a fatal error, and its class as
+// printed by -json-errors.
+func exitStatus(err error) (int, string) {
+	var flagErr *relay.FlagError
+	switch {
+	case errors.As(err, &flagErr):
+		return 2, "usage"
+	case errors.Is(err, relay.ErrPortInUse):
+		return exitPortInUse, "bind"
+	case errors.Is(err, relay.ErrBind):
+		return exitBind, "bind"
+	case errors.Is(err, relay.ErrConfig):
+		return exitConfig, "config"
+	}
+	return 1, "runtime"
 }
 
-func (s *Stats) AddError() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.Errors++
+// jsonError is a fatal error as printed by -json-errors.
+type jsonError struct {
+	Msg      string `json:"msg"`
+	Error    string `json:"error"`
+	Class    string `json:"class"`
+	ExitCode int    `json:"exit_code"`
 }
 
-func (s *Stats) String() string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return fmt.Sprintf("Received: %d packets (%d bytes), Forwarded: %d packets (%d bytes), Errors: %d",
-		s.PacketsReceived, s.BytesReceived, s.PacketsForwarded, s.BytesForwarded, s.Errors)
+// printJSONError prints err to stderr as a jsonError.
+func printJSONError(msg string, err error) {
+	code, class := exitStatus(err)
+	json.NewEncoder(os.Stderr).Encode(jsonError{Msg: msg, Error: err.Error(), Class: class, ExitCode: code})
 }
 
-func parseConfig() *Config {
-	config := &Config{}
-
-	flag.IntVar(&config.ListenPort, "port", 9999, "UDP port to listen for broadcast packets")
-	flag.StringVar(&config.ListenAddr, "listen", "0.0.0.0", "Address to listen on (use 0.0.0.0 for all interfaces)")
-
-	var targets string
-	flag.StringVar(&targets, "targets", "", "Comma-separated list of target addresses (ip:port), e.g., 192.168.1.100:9999,10.0.0.50:8888")
-
-	flag.IntVar(&config.BufferSize, "buffer", 65535, "UDP buffer size in bytes")
-	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose logging")
-	flag.BoolVar(&config.ShowVersion, "version", false, "Show version information")
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Broadcast Relay - Forward local broadcast packets to specified IP:Port\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s -port 9999 -targets 192.168.1.100:9999\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s -port 9999 -targets 192.168.1.100:9999,10.0.0.50:8888 -verbose\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s -listen 0.0.0.0 -port 12345 -targets 192.168.2.1:12345\n", os.Args[0])
-	}
-
-	flag.Parse()
-
-	if config.ShowVersion {
-		fmt.Printf("Broadcast Relay v%s (built: %s)\n", version, buildTime)
-		os.Exit(0)
-	}
-
-	if targets == "" {
-		fmt.Fprintln(os.Stderr, "Error: -targets is required")
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	// Parse target addresses
-	for _, target := range strings.Split(targets, ",") {
-		target = strings.TrimSpace(target)
-		if target != "" {
-			config.TargetAddrs = append(config.TargetAddrs, target)
+// jsonErrorsArg reports whether -json-errors is given on the command line
+// or in the environment, for errors from before the flags were parsed.
+func jsonErrorsArg(args []string) bool {
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "json-errors" {
+			continue
 		}
+		if !hasValue {
+			return true
+		}
+		on, _ := strconv.ParseBool(value)
+		return on
 	}
-
-	if len(config.TargetAddrs) == 0 {
-		fmt.Fprintln(os.Stderr, "Error: at least one valid target address is required")
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	return config
+	on, _ := strconv.ParseBool(os.Getenv("RELAY_JSON_ERRORS"))
+	return on
 }
 
-func NewRelay(config *Config) (*Relay, error) {
-	relay := &Relay{
-		config:   config,
-		stats:    &Stats{},
-		stopChan: make(chan struct{}),
-	}
-
-	// Resolve target addresses
-	for _, target := range config.TargetAddrs {
-		addr, err := net.ResolveUDPAddr("udp", target)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve target address %s: %v", target, err)
+// serviceArgs returns args without -service, for the installed service
+// to run with.
+func serviceArgs(args []string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(kept, args[i:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "service" {
+			kept = append(kept, arg)
+			continue
+		}
+		if !hasValue {
+			i++
 		}
-		relay.targetConns = append(relay.targetConns, addr)
-	}
-
-	// Create listening socket
-	listenAddr := fmt.Sprintf("%s:%d", config.ListenAddr, config.ListenPort)
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve listen address: %v", err)
-	}
-
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create UDP socket: %v", err)
-	}
-
-	// Set socket options for receiving broadcast
-	if err := conn.SetReadBuffer(config.BufferSize); err != nil {
-		log.Printf("Warning: failed to set read buffer size: %v", err)
 	}
-
-	relay.conn = conn
-
-	return relay, nil
+	return kept
 }
 
-func (r *Relay) Start() {
-	log.Printf("Starting Broadcast Relay v%s", version)
-	log.Printf("Listening on %s:%d", r.config.ListenAddr, r.config.ListenPort)
-	log.Printf("Forwarding to: %v", r.config.TargetAddrs)
-
-	r.wg.Add(1)
-	go r.receiveLoop()
-
-	// Start stats reporter if verbose
-	if r.config.Verbose {
-		r.wg.Add(1)
-		go r.statsReporter()
+func parseConfig() *relay.Config {
+	config, err := relay.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-}
-
-func (r *Relay) receiveLoop() {
-	defer r.wg.Done()
-
-	buffer := make([]byte, r.config.BufferSize)
-
-	for {
-		select {
-		case <-r.stopChan:
-			return
+	if err != nil {
+		code, class := exitStatus(err)
+		switch {
+		case jsonErrorsArg(os.Args[1:]):
+			printJSONError("Invalid configuration", err)
+		case class == "usage":
+			// The flag package has printed the error already.
 		default:
-		}
-
-		// Set read deadline to allow checking stop channel
-		r.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-
-		n, srcAddr, err := r.conn.ReadFromUDP(buffer)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
-			select {
-			case <-r.stopChan:
-				return
-			default:
-				log.Printf("Error reading UDP packet: %v", err)
-				r.stats.AddError()
-				continue
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if errors.Is(err, relay.ErrNoTargets) {
+				relay.Usage()
 			}
 		}
+		os.Exit(code)
+	}
 
-		r.stats.AddReceived(n)
-
-		if r.config.Verbose {
-			log.Printf("Received %d bytes from %s", n, srcAddr.String())
-		}
-
-		// Forward to all targets
-		data := buffer[:n]
-		for _, target := range r.targetConns {
-			// Skip if target is the source (avoid loops)
-			if srcAddr.IP.Equal(target.IP) && srcAddr.Port == target.Port {
-				if r.config.Verbose {
-					log.Printf("Skipping forward to source: %s", target.String())
-				}
-				continue
+	if config.ShowVersion {
+		fmt.Printf("Broadcast Relay v%s (built: %s)\n", relay.Version, relay.BuildTime)
+		os.Exit(0)
+	}
+	if config.ListInterfaces {
+		if err := relay.ListInterfaces(os.Stdout); err != nil {
+			if config.JSONErrors {
+				printJSONError("Failed to list interfaces", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			}
-
-			go r.forwardPacket(data, target)
+			os.Exit(1)
 		}
+		os.Exit(0)
 	}
+
+	return config
 }
 
-func (r *Relay) forwardPacket(data []byte, target *net.UDPAddr) {
-	conn, err := net.DialUDP("udp", nil, target)
-	if err != nil {
-		log.Printf("Error connecting to target %s: %v", target.String(), err)
-		r.stats.AddError()
-		return
-	}
-	defer conn.Close()
+// reload re-reads the configuration and applies the new target list. On any
+// error the running configuration stays in place.
+func reload(r *relay.Relay) {
+	slog.Info("Reloading configuration...")
 
-	n, err := conn.Write(data)
+	config, err := relay.LoadConfig(os.Args[1:])
+	if err == nil {
+		err = r.Reload(config)
+	}
 	if err != nil {
-		log.Printf("Error forwarding to %s: %v", target.String(), err)
-		r.stats.AddError()
+		slog.Error("Reload failed, keeping current configuration", "error", err)
 		return
 	}
-
-	r.stats.AddForwarded(n)
-
-	if r.config.Verbose {
-		log.Printf("Forwarded %d bytes to %s", n, target.String())
-	}
+	slog.Info("Configuration reloaded", "targets", r.Targets())
 }
 
-func (r *Relay) statsReporter() {
-	defer r.wg.Done()
+// errUpgrade stops the relay for it to restart on the upgrade signal.
+var errUpgrade = errors.New("upgrade requested")
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+func main() {
+	config := parseConfig()
 
-	for {
-		select {
-		case <-r.stopChan:
-			return
-		case <-ticker.C:
-			log.Printf("Stats: %s", r.stats.String())
+	if config.Service != "" {
+		if err := controlService(config.Service, serviceArgs(os.Args[1:])); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
+		os.Exit(0)
 	}
-}
-
-func (r *Relay) Stop() {
-	log.Println("Stopping relay...")
-	close(r.stopChan)
-	r.conn.Close()
-	r.wg.Wait()
-	log.Printf("Final stats: %s", r.stats.String())
-	log.Println("Relay stopped")
-}
 
-func main() {
-	config := parseConfig()
+	// Under -tui the log is held back while the dashboard is shown.
+	out := logOutput()
+	var tail *relay.LogTail
+	if config.TUI {
+		tail = relay.NewLogTail(out)
+		out = tail
+	}
+	// parseConfig has validated the format already.
+	logger, _ := relay.NewLogger(out, config.LogFormat, config.LogLevel)
+	slog.SetDefault(logger)
 
-	relay, err := NewRelay(config)
+	r, err := relay.NewRelay(config)
 	if err != nil {
-		log.Fatalf("Failed to create relay: %v", err)
+		if config.JSONErrors {
+			printJSONError("Failed to create relay", err)
+		} else {
+			slog.Error("Failed to create relay", "error", err)
+		}
+		code, _ := exitStatus(err)
+		os.Exit(code)
+	}
+	r.LogTail = tail
+
+	// The listen sockets are duplicated up front for a restart to hand
+	// over, as the relay closes its own when it stops.
+	var handoff []*os.File
+	if upgradeSignal != nil {
+		if handoff, err = r.ListenFiles(); err != nil {
+			slog.Warn("Restarts will reopen the listen sockets", "error", err)
+		}
 	}
 
-	relay.Start()
+	// SIGINT and SIGTERM stop the relay; SIGHUP reloads the configuration,
+	// SIGUSR1 logs the current stats, and saves them to the -stats-file,
+	// and SIGUSR2 restarts it.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, upgrade := context.WithCancelCause(ctx)
 
-	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	<-sigChan
-	relay.Stop()
+	signals := []os.Signal{syscall.SIGHUP}
+	if statsSignal != nil {
+		signals = append(signals, statsSignal)
+	}
+	if upgradeSignal != nil {
+		signals = append(signals, upgradeSignal)
+	}
+	signal.Notify(sigChan, signals...)
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGHUP:
+				reload(r)
+			case upgradeSignal:
+				slog.Info("Upgrade requested")
+				upgrade(errUpgrade)
+			default:
+				r.LogStats()
+				if config.StatsFile != "" {
+					if err := r.SaveStats(); err != nil {
+						slog.Error("Failed to save stats", "file", config.StatsFile, "error", err)
+					}
+				}
+			}
+		}
+	}()
+
+	switch err := run(ctx, r); {
+	case errors.Is(err, relay.ErrIdleTimeout):
+		os.Exit(exitIdle)
+	case errors.Is(err, relay.ErrMaxLifetime), context.Cause(ctx) == errUpgrade:
+		slog.Info("Restarting", "args", os.Args[1:])
+		if err := restart(handoff); err != nil {
+			slog.Error("Restart failed", "error", err)
+			os.Exit(1)
+		}
+	case err != nil:
+		if config.JSONErrors {
+			printJSONError("Relay failed", err)
+		}
+		os.Exit(1)
+	}
 }
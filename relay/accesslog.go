@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLog writes one JSON line per received packet to the -access-log
+// file, recording where it came from and what happened to it.
+type accessLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// accessRecord is a line in the access log. A packet is either filtered,
+// with the reason, or dispatched, with each target listed under the outcome
+// of the forward to it.
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	Src       string    `json:"src"`
+	Size      int       `json:"size"`
+	Rewritten bool      `json:"rewritten,omitempty"`
+	Filtered  string    `json:"filtered,omitempty"`
+	Forwarded []string  `json:"forwarded,omitempty"`
+	Dropped   []string  `json:"dropped,omitempty"`
+	Failed    []string  `json:"failed,omitempty"`
+}
+
+func openAccessLog(path string) (*accessLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %v", err)
+	}
+	return &accessLog{file: f}, nil
+}
+
+func (l *accessLog) write(rec *accessRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Write(line)
+}
+
+func (l *accessLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// logFiltered records a packet that the receive loop did not forward.
+func (r *Relay) logFiltered(received time.Time, src *net.UDPAddr, size int, reason string) {
+	if r.access == nil {
+		return
+	}
+	r.access.write(&accessRecord{
+		Time:     received,
+		Src:      src.String(),
+		Size:     size,
+		Filtered: reason,
+	})
+}
+
+// logDispatched records the outcome of forwarding pkt to every target.
+func (r *Relay) logDispatched(pkt *packet, targets []*targetConn, results []forwardResult) {
+	rec := &accessRecord{
+		Time:      pkt.received,
+		Src:       pkt.src.String(),
+		Size:      len(pkt.data),
+		Rewritten: pkt.rewritten,
+	}
+	for i, target := range targets {
+		switch results[i] {
+		case forwardOK:
+			rec.Forwarded = append(rec.Forwarded, target.name)
+		case forwardDropped:
+			rec.Dropped = append(rec.Dropped, target.name)
+		case forwardFailed:
+			rec.Failed = append(rec.Failed, target.name)
+		}
+	}
+	r.access.write(rec)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package relay
+
+import "syscall"
+
+// errnoAddrInUse is the error a bind returns when the address is taken.
+const errnoAddrInUse = syscall.EADDRINUSE
+
+// errnoMsgSize is the error a write returns when the datagram is larger
+// than the MTU allows without fragmenting it.
+const errnoMsgSize = syscall.EMSGSIZE
@@ -0,0 +1,10 @@
+package relay
+
+import "golang.org/x/sys/windows"
+
+// errnoAddrInUse is the error a bind returns when the address is taken.
+const errnoAddrInUse = windows.WSAEADDRINUSE
+
+// errnoMsgSize is the error a write returns when the datagram is larger
+// than the MTU allows without fragmenting it.
+const errnoMsgSize = windows.WSAEMSGSIZE
@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// balancer picks the single target of each packet in balance mode.
+type balancer struct {
+	mu sync.Mutex
+	// current holds the smooth weighted round-robin state of each target.
+	current map[*targetConn]int
+}
+
+// pick chooses the target for a packet by smooth weighted round-robin, as nginx
+// does: every candidate's current weight grows by its weight, the largest
+// wins and is lowered by the sum of the weights. A target gets its share of
+// the packets, spread out evenly; with equal weights this is plain
+// round-robin. The result depends only on the sequence of calls.
+//
+// The packet's source src, unless nil, is never picked, and neither are
+// down targets or targets with an open circuit breaker until they are due
+// for a probe, unless no other target is left. pick returns nil if there is
+// no candidate at all.
+func (b *balancer) pick(src *net.UDPAddr, targets []*targetConn, now time.Time) *targetConn {
+	candidates := make([]*targetConn, 0, len(targets))
+	var fallback []*targetConn
+	for _, target := range targets {
+		if src != nil && target.udp() && sameUDPAddr(src, target.addr) {
+			continue
+		}
+		fallback = append(fallback, target)
+		if target.health.allow(now) && target.breaker.ready(now) {
+			candidates = append(candidates, target)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.current == nil {
+		b.current = make(map[*targetConn]int)
+	}
+	// Forget targets that have been removed.
+	if len(b.current) > len(targets) {
+		present := make(map[*targetConn]bool, len(targets))
+		for _, target := range targets {
+			present[target] = true
+		}
+		for target := range b.current {
+			if !present[target] {
+				delete(b.current, target)
+			}
+		}
+	}
+
+	var best *targetConn
+	total := 0
+	for _, target := range candidates {
+		weight := int(target.weight.Load())
+		total += weight
+		b.current[target] += weight
+		if best == nil || b.current[target] > b.current[best] {
+			best = target
+		}
+	}
+	b.current[best] -= total
+	return best
+}
@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToInterface restricts conn to packets arriving on the named interface
+// using IP_BOUND_IF (IPV6_BOUND_IF for IPv6 sockets).
+func bindToInterface(conn *net.UDPConn, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	level, opt := unix.IPPROTO_IP, unix.IP_BOUND_IF
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF
+	}
+
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, ifi.Index)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
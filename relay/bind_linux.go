@@ -0,0 +1,24 @@
+package relay
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToInterface restricts conn to packets arriving on the named interface
+// using SO_BINDTODEVICE. Kernels before 5.7 require CAP_NET_RAW for this.
+func bindToInterface(conn *net.UDPConn, iface string) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.BindToDevice(int(fd), iface)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package relay
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func bindToInterface(conn *net.UDPConn, iface string) error {
+	return fmt.Errorf("binding to an interface is not supported on %s; use -listen with the interface's address instead", runtime.GOOS)
+}
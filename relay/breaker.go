@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerConfig is the -breaker-* configuration. With failures 0 the
+// breaker is disabled.
+type breakerConfig struct {
+	// failures is how many consecutive forwards to a target must fail
+	// within window for its breaker to open.
+	failures int
+	window   time.Duration
+	// cooldown is how long an open breaker skips the target before letting
+	// a probe through.
+	cooldown time.Duration
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	// breakerHalfOpen is an open breaker whose cool-down has passed; the
+	// next forward is a probe that closes or re-opens it.
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops forwarding to a target whose writes keep failing, so
+// that a target on a dead network does not cost a failed write and an error
+// log for every packet. Refusals are left to targetHealth, which handles
+// them on its own; the breaker counts every other forwarding error.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	// since is the time of the first of the consecutive failures.
+	since     time.Time
+	openUntil time.Time
+	// probing is set while the probe of a half-open breaker is in flight.
+	probing bool
+}
+
+// ready reports whether the breaker would let a packet through now,
+// without changing its state.
+func (b *circuitBreaker) ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return !now.Before(b.openUntil)
+	case breakerHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// closed reports whether the breaker is closed.
+func (b *circuitBreaker) closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed
+}
+
+// allow reports whether a packet may be forwarded now. Once the cool-down
+// has passed, the first packet is let through as the probe and the breaker
+// turns half-open.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// cancelProbe gives back the probe allow let through when the packet was
+// not sent after all, so that the next packet is the probe instead. The
+// state stays as it is.
+func (b *circuitBreaker) cancelProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// record updates the breaker with the outcome of a forward and returns the
+// new state, with changed set if the state is different from before.
+func (b *circuitBreaker) record(config breakerConfig, failed bool, now time.Time) (state breakerState, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	before := b.state
+	b.probing = false
+	switch {
+	case !failed:
+		b.state = breakerClosed
+		b.failures = 0
+	case b.state == breakerHalfOpen:
+		b.state = breakerOpen
+		b.openUntil = now.Add(config.cooldown)
+	case b.state == breakerClosed:
+		if b.failures == 0 || now.Sub(b.since) > config.window {
+			b.failures = 0
+			b.since = now
+		}
+		b.failures++
+		if b.failures >= config.failures {
+			b.state = breakerOpen
+			b.openUntil = now.Add(config.cooldown)
+			b.failures = 0
+		}
+	}
+	return b.state, b.state != before
+}
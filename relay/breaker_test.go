@@ -0,0 +1,38 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerCancelProbe(t *testing.T) {
+	config := breakerConfig{failures: 1, window: time.Second, cooldown: time.Second}
+	var b circuitBreaker
+	now := time.Now()
+	if state, _ := b.record(config, true, now); state != breakerOpen {
+		t.Fatalf("state after a failure = %v, want open", state)
+	}
+
+	now = now.Add(config.cooldown)
+	if !b.allow(now) {
+		t.Fatal("allow after the cool-down = false, want the probe let through")
+	}
+	if b.allow(now) {
+		t.Fatal("allow while the probe is in flight = true, want false")
+	}
+
+	// The probe was not sent, e.g. dropped by -chaos-drop.
+	b.cancelProbe()
+	if !b.ready(now) {
+		t.Fatal("ready after cancelProbe = false, want true")
+	}
+	if !b.allow(now) {
+		t.Fatal("allow after cancelProbe = false, want the next packet as the probe")
+	}
+	if b.state != breakerHalfOpen {
+		t.Fatalf("state after cancelProbe = %v, want half-open", b.state)
+	}
+	if state, changed := b.record(config, false, now); state != breakerClosed || !changed {
+		t.Fatalf("record of a successful probe = %v, %v, want closed, true", state, changed)
+	}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+)
+
+// isBroadcastAddr reports whether ip is the limited broadcast address
+// 255.255.255.255 or the directed broadcast address of a subnet on one of
+// the local interfaces.
+func isBroadcastAddr(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if bcast := subnetBroadcast(addr); bcast != nil && ip4.Equal(bcast) {
+			return true
+		}
+	}
+	return false
+}
+
+// subnetBroadcast returns the directed broadcast address of an IPv4
+// interface address, or nil if it has none.
+func subnetBroadcast(addr net.Addr) net.IP {
+	ipnet, ok := addr.(*net.IPNet)
+	if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+		return nil
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		// /31 and /32 subnets have no broadcast address.
+		return nil
+	}
+	bcast := make(net.IP, net.IPv4len)
+	for i, b := range ipnet.IP.To4() {
+		bcast[i] = b | ^ipnet.Mask[i]
+	}
+	return bcast
+}
+
+// localBroadcastAddrs returns the directed broadcast addresses of the
+// subnets on the named interface, or on every broadcast-capable interface
+// that is up if name is empty. Loopback interfaces are skipped.
+func localBroadcastAddrs(name string) ([]net.IP, error) {
+	var ifaces []net.Interface
+	if name != "" {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = []net.Interface{*ifi}
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		ifaces = all
+	}
+
+	var ips []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagBroadcast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %v", ifi.Name, err)
+		}
+		for _, addr := range addrs {
+			if bcast := subnetBroadcast(addr); bcast != nil {
+				ips = append(ips, bcast)
+			}
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package relay
+
+func setBroadcast(fd uintptr) error {
+	return nil
+}
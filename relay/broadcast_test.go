@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSubnetBroadcast(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{"192.168.1.10/24", "192.168.1.255"},
+		{"10.1.2.3/8", "10.255.255.255"},
+		{"172.16.5.1/20", "172.16.15.255"},
+		{"192.168.1.10/31", ""},
+		{"192.168.1.10/32", ""},
+		{"2001:db8::1/64", ""},
+	}
+	for _, tt := range tests {
+		ip, ipnet, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+		if ip4 := ip.To4(); ip4 != nil {
+			ipnet.IP = ip4
+		}
+		got := subnetBroadcast(ipnet)
+		if (got == nil) != (tt.want == "") || got != nil && got.String() != tt.want {
+			t.Errorf("subnetBroadcast(%s) = %v, want %q", tt.cidr, got, tt.want)
+		}
+	}
+}
+
+// TestBroadcastTarget forwards to the directed broadcast address of a local
+// subnet, such as 192.168.1.255, which takes SO_BROADCAST on the socket.
+func TestBroadcastTarget(t *testing.T) {
+	bcasts, err := localBroadcastAddrs("")
+	if err != nil || len(bcasts) == 0 {
+		t.Skipf("no local subnet with a broadcast address: %v", err)
+	}
+	addr := &net.UDPAddr{IP: bcasts[0], Port: 9}
+
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.TargetAddrs = []string{addr.String()}
+	relay, err := NewRelay(config)
+	if err != nil {
+		t.Fatalf("NewRelay with target %s: %v", addr, err)
+	}
+	defer relay.Stop()
+
+	target := relay.targets()[0]
+	if !target.opts.broadcast {
+		t.Fatalf("target %s is not taken for a broadcast address", addr)
+	}
+	_, err = target.write([]byte("broadcast"))
+	var errno syscall.Errno
+	if errors.As(err, &errno) && (errno == syscall.EPERM || errno == syscall.ENETUNREACH) {
+		t.Skipf("broadcast to %s not permitted here: %v", addr, err)
+	}
+	if err != nil {
+		t.Errorf("write to broadcast target %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build unix
+
+package relay
+
+import "golang.org/x/sys/unix"
+
+func setBroadcast(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+}
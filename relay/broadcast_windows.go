@@ -0,0 +1,7 @@
+package relay
+
+import "golang.org/x/sys/windows"
+
+func setBroadcast(fd uintptr) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_BROADCAST, 1)
+}
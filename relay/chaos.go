@@ -0,0 +1,21 @@
+package relay
+
+import (
+	"math/rand"
+	"time"
+)
+
+// chaos applies -chaos-drop and -chaos-delay to a forward to target, as if
+// the packet went through a lossy network, and reports whether to send it.
+// It comes after the -timestamp header is added, so that the drops show
+// up as gaps in the sequence numbers and the delays in the latency.
+func (r *Relay) chaos(target *targetConn) bool {
+	if p := r.config.ChaosDrop; p > 0 && rand.Float64() < p {
+		r.stats.AddChaosDropped(target.name)
+		return false
+	}
+	if d := r.config.ChaosDelay; d > 0 {
+		return r.sleep(time.Duration(rand.Int63n(int64(d))))
+	}
+	return true
+}
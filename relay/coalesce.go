@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxUDPPayload is the largest payload of a UDP datagram over IPv4.
+const maxUDPPayload = 65507
+
+// coalescer batches the datagrams for a UDP or Unix socket target, under
+// -coalesce, into larger ones holding each as a length-prefixed frame, the
+// same framing as on tcp:// targets. It is guarded by the target's mu.
+type coalescer struct {
+	maxBytes int
+	maxDelay time.Duration
+	buf      []byte
+	packets  int
+	// timer sends the batch maxDelay after its first datagram; err is the
+	// error of a send it did, returned by the next write.
+	timer *time.Timer
+	err   error
+}
+
+// coalesced adds data to t's batch, sending the batch first if data would
+// not fit in it and afterwards if it is full. Until then data counts as
+// written. t.mu is held.
+func (t *targetConn) coalesced(data []byte) (int, error) {
+	c := t.coalesce
+	if err := c.err; err != nil {
+		c.err = nil
+		return 0, err
+	}
+	if len(c.buf) > 0 && len(c.buf)+4+len(data) > c.maxBytes {
+		if err := t.flush(); err != nil {
+			return 0, err
+		}
+	}
+	c.buf = appendFrame(c.buf, data)
+	c.packets++
+	switch {
+	case len(c.buf) >= c.maxBytes:
+		if err := t.flush(); err != nil {
+			return 0, err
+		}
+	case c.timer == nil:
+		c.timer = time.AfterFunc(c.maxDelay, t.flushDue)
+	}
+	return len(data), nil
+}
+
+// flushDue sends the batch once its first datagram has waited maxDelay.
+func (t *targetConn) flushDue() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.coalesce.timer = nil
+	t.coalesce.err = t.flush()
+}
+
+// flush sends t's batch as one datagram; on failure the datagrams in it are
+// lost. t.mu is held.
+func (t *targetConn) flush() error {
+	c := t.coalesce
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := t.writeLocked(c.buf)
+	if err != nil {
+		err = fmt.Errorf("%w (%d coalesced packets lost)", err, c.packets)
+	}
+	c.buf = c.buf[:0]
+	c.packets = 0
+	return err
+}
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression formats for -compress.
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressLZ4  = "lz4"
+)
+
+// With -compress, packets forwarded to a target are sent compressed, for a
+// relay with -decompress to restore, with a header:
+//
+//	magic    4 bytes  "BRCZ"
+//	format   1 byte   0 stored, 1 gzip, 2 lz4 block
+//	length   4 bytes  big-endian length of the original packet
+//	data     the packet, compressed in format
+//
+// A packet that does not get smaller is sent as it is, without the header,
+// unless it starts with the magic, when it is sent stored. A relay with
+// -decompress forwards packets without the header as they are.
+const (
+	compressMagic     = "BRCZ"
+	compressHeaderLen = len(compressMagic) + 5
+)
+
+// Format bytes of the compression header.
+const (
+	formatStored = iota
+	formatGzip
+	formatLZ4
+)
+
+func compressFormat(compress string) (uint32, error) {
+	switch compress {
+	case "", CompressNone:
+		return formatStored, nil
+	case CompressGzip:
+		return formatGzip, nil
+	case CompressLZ4:
+		return formatLZ4, nil
+	}
+	return 0, fmt.Errorf("invalid compression %q: must be %s, %s or %s", compress, CompressGzip, CompressLZ4, CompressNone)
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	}}
+	gzipReaders    sync.Pool
+	lz4Compressors = sync.Pool{New: func() any { return new(lz4.Compressor) }}
+)
+
+// compress appends data to dst compressed in format, with the header, or
+// as it is if that is not smaller.
+func compress(dst, data []byte, format uint32) []byte {
+	start := len(dst)
+	dst = append(dst, compressMagic...)
+	dst = append(dst, byte(format), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(dst[start+len(compressMagic)+1:], uint32(len(data)))
+
+	switch format {
+	case formatGzip:
+		buf := bytes.NewBuffer(dst)
+		w := gzipWriters.Get().(*gzip.Writer)
+		w.Reset(buf)
+		// Writes to a bytes.Buffer do not fail.
+		w.Write(data)
+		w.Close()
+		gzipWriters.Put(w)
+		dst = buf.Bytes()
+	case formatLZ4:
+		body, bound := len(dst), lz4.CompressBlockBound(len(data))
+		dst = slices.Grow(dst, bound)[:body+bound]
+		c := lz4Compressors.Get().(*lz4.Compressor)
+		n, err := c.CompressBlock(data, dst[body:])
+		lz4Compressors.Put(c)
+		if err != nil || n == 0 {
+			// Incompressible.
+			dst = dst[:start]
+		} else {
+			dst = dst[:body+n]
+		}
+	}
+	if len(dst) > start && len(dst)-start < len(data) {
+		return dst
+	}
+	dst = dst[:start]
+	if bytes.HasPrefix(data, []byte(compressMagic)) {
+		dst = append(dst, compressMagic...)
+		dst = append(dst, formatStored, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(dst[len(dst)-4:], uint32(len(data)))
+	}
+	return append(dst, data...)
+}
+
+var errCompressed = errors.New("invalid compressed packet")
+
+// decompress restores a packet sent compressed by a relay with -compress
+// into buf, returning data itself if it has no compression header.
+func decompress(buf, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(compressMagic)) {
+		return data, nil
+	}
+	if len(data) < compressHeaderLen {
+		return nil, errCompressed
+	}
+	format := data[len(compressMagic)]
+	length := int(binary.BigEndian.Uint32(data[len(compressMagic)+1:]))
+	body := data[compressHeaderLen:]
+	if length > maxDatagram {
+		return nil, errCompressed
+	}
+
+	switch format {
+	case formatStored:
+		if len(body) != length {
+			return nil, errCompressed
+		}
+		return body, nil
+	case formatGzip:
+		r, _ := gzipReaders.Get().(*gzip.Reader)
+		var err error
+		if r == nil {
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		} else {
+			err = r.Reset(bytes.NewReader(body))
+		}
+		if err != nil {
+			return nil, errCompressed
+		}
+		defer gzipReaders.Put(r)
+		out := buf[:length]
+		if _, err := io.ReadFull(r, out); err != nil {
+			return nil, errCompressed
+		}
+		// Reading on to the end checks the checksum and that nothing is
+		// left over.
+		var extra [1]byte
+		if n, err := r.Read(extra[:]); n != 0 || err != io.EOF {
+			return nil, errCompressed
+		}
+		return out, nil
+	case formatLZ4:
+		n, err := lz4.UncompressBlock(body, buf[:length])
+		if err != nil || n != length {
+			return nil, errCompressed
+		}
+		return buf[:n], nil
+	}
+	return nil, errCompressed
+}
@@ -0,0 +1,998 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the on-disk form of a -config file. Keys mirror the
+// command-line flag names. Pointer fields distinguish "absent" from the zero
+// value so that omitted keys keep their defaults.
+type fileConfig struct {
+	Listen             *string      `yaml:"listen" json:"listen"`
+	Port               *PortList    `yaml:"port" json:"port"`
+	TargetPortMap      PortMap      `yaml:"target-port-map" json:"target-port-map"`
+	ReusePort          *bool        `yaml:"reuseport" json:"reuseport"`
+	SkipBadTargets     *bool        `yaml:"skip-bad-targets" json:"skip-bad-targets"`
+	DNSRefresh         *duration    `yaml:"dns-refresh" json:"dns-refresh"`
+	Preflight          *bool        `yaml:"preflight" json:"preflight"`
+	PreflightTimeout   *duration    `yaml:"preflight-timeout" json:"preflight-timeout"`
+	DryRun             *bool        `yaml:"dry-run" json:"dry-run"`
+	Once               *bool        `yaml:"once" json:"once"`
+	LoopGuard          *bool        `yaml:"loop-guard" json:"loop-guard"`
+	AllowLoopback      *bool        `yaml:"allow-loopback" json:"allow-loopback"`
+	HostLoopGuard      *bool        `yaml:"host-loop-guard" json:"host-loop-guard"`
+	RelayID            *uint        `yaml:"relay-id" json:"relay-id"`
+	Timestamp          *bool        `yaml:"timestamp" json:"timestamp"`
+	Compress           *string      `yaml:"compress" json:"compress"`
+	Decompress         *bool        `yaml:"decompress" json:"decompress"`
+	PrependSource      *bool        `yaml:"prepend-source" json:"prepend-source"`
+	Interface          *string      `yaml:"interface" json:"interface"`
+	MulticastGroups    []string     `yaml:"multicast-groups" json:"multicast-groups"`
+	MulticastInterface *string      `yaml:"multicast-interface" json:"multicast-interface"`
+	Input              *string      `yaml:"input" json:"input"`
+	Output             *string      `yaml:"output" json:"output"`
+	Mode               *string      `yaml:"mode" json:"mode"`
+	FailbackDelay      *duration    `yaml:"failback-delay" json:"failback-delay"`
+	Transparent        *bool        `yaml:"transparent" json:"transparent"`
+	Sample             *Sample      `yaml:"sample" json:"sample"`
+	RateLimit          *RateLimit   `yaml:"rate-limit" json:"rate-limit"`
+	MaxReceiveRate     *RateLimit   `yaml:"max-receive-rate" json:"max-receive-rate"`
+	MinSize            *int         `yaml:"min-size" json:"min-size"`
+	MaxSize            *int         `yaml:"max-size" json:"max-size"`
+	MatchPrefix        []string     `yaml:"match-prefix" json:"match-prefix"`
+	DropPrefix         []string     `yaml:"drop-prefix" json:"drop-prefix"`
+	MatchRegexp        *string      `yaml:"match-regexp" json:"match-regexp"`
+	AllowSrc           []string     `yaml:"allow-src" json:"allow-src"`
+	DenySrc            []string     `yaml:"deny-src" json:"deny-src"`
+	Rewrite            []string     `yaml:"rewrite" json:"rewrite"`
+	DedupWindow        *duration    `yaml:"dedup-window" json:"dedup-window"`
+	DSCP               *int         `yaml:"dscp" json:"dscp"`
+	TTL                *int         `yaml:"ttl" json:"ttl"`
+	NoFragment         *bool        `yaml:"no-fragment" json:"no-fragment"`
+	SourcePort         *int         `yaml:"source-port" json:"source-port"`
+	EgressAddr         *string      `yaml:"egress-addr" json:"egress-addr"`
+	Proxy              *string      `yaml:"proxy" json:"proxy"`
+	TLSCA              *string      `yaml:"tls-ca" json:"tls-ca"`
+	TLSInsecure        *bool        `yaml:"tls-insecure" json:"tls-insecure"`
+	WriteTimeout       *duration    `yaml:"write-timeout" json:"write-timeout"`
+	KeepaliveInterval  *duration    `yaml:"keepalive-interval" json:"keepalive-interval"`
+	KeepalivePayload   *string      `yaml:"keepalive-payload" json:"keepalive-payload"`
+	ChaosDrop          *float64     `yaml:"chaos-drop" json:"chaos-drop"`
+	ChaosDelay         *duration    `yaml:"chaos-delay" json:"chaos-delay"`
+	Coalesce           *bool        `yaml:"coalesce" json:"coalesce"`
+	CoalesceBytes      *int         `yaml:"coalesce-bytes" json:"coalesce-bytes"`
+	CoalesceDelay      *duration    `yaml:"coalesce-delay" json:"coalesce-delay"`
+	Buffer             *int         `yaml:"buffer" json:"buffer"`
+	Workers            *int         `yaml:"workers" json:"workers"`
+	FanoutConcurrency  *int         `yaml:"fanout-concurrency" json:"fanout-concurrency"`
+	MaxQueue           *int         `yaml:"max-queue" json:"max-queue"`
+	DrainTimeout       *duration    `yaml:"drain-timeout" json:"drain-timeout"`
+	IdleTimeout        *duration    `yaml:"idle-timeout" json:"idle-timeout"`
+	MaxLifetime        *duration    `yaml:"max-lifetime" json:"max-lifetime"`
+	ForwardRetries     *int         `yaml:"forward-retries" json:"forward-retries"`
+	RetryDelay         *duration    `yaml:"retry-delay" json:"retry-delay"`
+	BreakerFailures    *int         `yaml:"breaker-failures" json:"breaker-failures"`
+	BreakerWindow      *duration    `yaml:"breaker-window" json:"breaker-window"`
+	BreakerCooldown    *duration    `yaml:"breaker-cooldown" json:"breaker-cooldown"`
+	StatsInterval      *duration    `yaml:"stats-interval" json:"stats-interval"`
+	TUI                *bool        `yaml:"tui" json:"tui"`
+	ErrorLogInterval   *duration    `yaml:"error-log-interval" json:"error-log-interval"`
+	MetricsAddr        *string      `yaml:"metrics-addr" json:"metrics-addr"`
+	OTLPEndpoint       *string      `yaml:"otlp-endpoint" json:"otlp-endpoint"`
+	OTLPInterval       *duration    `yaml:"otlp-interval" json:"otlp-interval"`
+	StatsAddr          *string      `yaml:"stats-addr" json:"stats-addr"`
+	StatsFile          *string      `yaml:"stats-file" json:"stats-file"`
+	StatsFileInterval  *duration    `yaml:"stats-file-interval" json:"stats-file-interval"`
+	TrackSources       *bool        `yaml:"track-sources" json:"track-sources"`
+	TrackSourcesMax    *int         `yaml:"track-sources-max" json:"track-sources-max"`
+	HealthAddr         *string      `yaml:"health-addr" json:"health-addr"`
+	ControlAddr        *string      `yaml:"control-addr" json:"control-addr"`
+	DebugAddr          *string      `yaml:"debug-addr" json:"debug-addr"`
+	GRPCAddr           *string      `yaml:"grpc-addr" json:"grpc-addr"`
+	LogFormat          *string      `yaml:"log-format" json:"log-format"`
+	LogLevel           *slog.Level  `yaml:"log-level" json:"log-level"`
+	AccessLog          *string      `yaml:"access-log" json:"access-log"`
+	Pcap               *string      `yaml:"pcap" json:"pcap"`
+	PcapForwarded      *bool        `yaml:"pcap-forwarded" json:"pcap-forwarded"`
+	DumpRaw            *string      `yaml:"dump-raw" json:"dump-raw"`
+	Replay             *string      `yaml:"replay" json:"replay"`
+	ReplaySpeed        *float64     `yaml:"replay-speed" json:"replay-speed"`
+	Verbose            *bool        `yaml:"verbose" json:"verbose"`
+	TargetsFile        *string      `yaml:"targets-file" json:"targets-file"`
+	Targets            []fileTarget `yaml:"targets" json:"targets"`
+
+	// Routes are only set in the file; their groups name targets.
+	TargetGroups map[string][]string `yaml:"target-groups" json:"target-groups"`
+	Routes       []fileRoute         `yaml:"routes" json:"routes"`
+	RouteDefault *string             `yaml:"route-default" json:"route-default"`
+}
+
+// fileRoute is an entry in the routes list, sending packets that start with
+// one of the hex prefixes, or come from one of the source networks, or
+// both, to the targets of a group, e.g.
+//
+//	target-groups:
+//	  game: [192.168.1.100:9999, 192.168.1.101:9999]
+//	routes:
+//	  - prefixes: [ffffffff54]
+//	    group: game
+//	  - sources: [192.168.2.0/24]
+//	    group: game
+type fileRoute struct {
+	Prefixes []string `yaml:"prefixes" json:"prefixes"`
+	Sources  []string `yaml:"sources" json:"sources"`
+	Group    string   `yaml:"group" json:"group"`
+}
+
+// fileTarget is an entry in the targets list: either a plain address or an
+// object with per-target settings, e.g.
+//
+//	targets:
+//	  - 192.168.1.100:9999
+//	  - address: 10.0.0.50:8888
+//	    rate-limit: 100p/s
+//	    weight: 2
+type fileTarget struct {
+	Address   string     `yaml:"address" json:"address"`
+	RateLimit *RateLimit `yaml:"rate-limit" json:"rate-limit"`
+	Sample    *Sample    `yaml:"sample" json:"sample"`
+	Weight    *int       `yaml:"weight" json:"weight"`
+	Compress  *string    `yaml:"compress" json:"compress"`
+}
+
+func (t *fileTarget) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&t.Address)
+	}
+	if value.Kind == yaml.MappingNode {
+		// Decoding a node does not inherit KnownFields, so check the keys here.
+		for i := 0; i < len(value.Content); i += 2 {
+			switch key := value.Content[i].Value; key {
+			case "address", "rate-limit", "sample", "weight", "compress":
+			default:
+				return fmt.Errorf("line %d: unknown target setting %q", value.Content[i].Line, key)
+			}
+		}
+	}
+	type plain fileTarget
+	return value.Decode((*plain)(t))
+}
+
+func (t *fileTarget) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &t.Address); err == nil {
+		return nil
+	}
+	type plain fileTarget
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(t))
+}
+
+// DefaultConfig returns the configuration used when no flag or config file
+// value is given. It has no targets.
+func DefaultConfig() *Config {
+	return &Config{
+		ListenPorts:       PortList{9999},
+		ListenAddr:        "0.0.0.0",
+		BufferSize:        65535,
+		Workers:           runtime.NumCPU(),
+		FanoutConcurrency: 1,
+		MaxQueue:          defaultMaxQueue,
+		InputMode:         InputBroadcast,
+		OutputMode:        OutputUnicast,
+		Mode:              ModeFanout,
+		FailbackDelay:     10 * time.Second,
+		RouteDefault:      RouteAll,
+		DrainTimeout:      5 * time.Second,
+		PreflightTimeout:  time.Second,
+		RetryDelay:        10 * time.Millisecond,
+		BreakerWindow:     10 * time.Second,
+		BreakerCooldown:   30 * time.Second,
+		StatsInterval:     10 * time.Second,
+		ErrorLogInterval:  10 * time.Second,
+		StatsFileInterval: time.Minute,
+		TrackSourcesMax:   1024,
+		LogFormat:         "text",
+		LogLevel:          slog.LevelInfo,
+		ReplaySpeed:       1,
+		CoalesceBytes:     1400,
+		CoalesceDelay:     10 * time.Millisecond,
+		OTLPInterval:      10 * time.Second,
+	}
+}
+
+// duration is a time.Duration written as a string such as "500ms" or "5s"
+// in config files.
+type duration time.Duration
+
+func (d *duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	return d.set(s)
+}
+
+// LoadConfigFile reads a YAML or JSON config file and returns the resulting
+// Config, with defaults for any settings the file does not mention. Files
+// ending in .json are parsed as JSON, everything else as YAML. Unknown keys
+// are rejected.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var fc fileConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&fc)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&fc)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	config := DefaultConfig()
+	if fc.Listen != nil {
+		config.ListenAddr = *fc.Listen
+	}
+	if fc.Port != nil {
+		config.ListenPorts = *fc.Port
+	}
+	if fc.TargetPortMap != nil {
+		config.TargetPortMap = fc.TargetPortMap
+	}
+	if fc.SkipBadTargets != nil {
+		config.SkipBadTargets = *fc.SkipBadTargets
+	}
+	if fc.DNSRefresh != nil {
+		config.DNSRefresh = time.Duration(*fc.DNSRefresh)
+	}
+	if fc.Preflight != nil {
+		config.Preflight = *fc.Preflight
+	}
+	if fc.PreflightTimeout != nil {
+		config.PreflightTimeout = time.Duration(*fc.PreflightTimeout)
+	}
+	if fc.DryRun != nil {
+		config.DryRun = *fc.DryRun
+	}
+	if fc.Once != nil {
+		config.Once = *fc.Once
+	}
+	if fc.LoopGuard != nil {
+		config.LoopGuard = *fc.LoopGuard
+	}
+	if fc.AllowLoopback != nil {
+		config.AllowLoopback = *fc.AllowLoopback
+	}
+	if fc.HostLoopGuard != nil {
+		config.HostLoopGuard = *fc.HostLoopGuard
+	}
+	if fc.RelayID != nil {
+		config.RelayID = *fc.RelayID
+	}
+	if fc.Timestamp != nil {
+		config.Timestamp = *fc.Timestamp
+	}
+	if fc.Compress != nil {
+		config.Compress = *fc.Compress
+	}
+	if fc.Decompress != nil {
+		config.Decompress = *fc.Decompress
+	}
+	if fc.PrependSource != nil {
+		config.PrependSource = *fc.PrependSource
+	}
+	if fc.ReusePort != nil {
+		config.ReusePort = *fc.ReusePort
+	}
+	if fc.Interface != nil {
+		config.Interface = *fc.Interface
+	}
+	config.MulticastGroups = fc.MulticastGroups
+	if fc.MulticastInterface != nil {
+		config.MulticastInterface = *fc.MulticastInterface
+	}
+	if fc.Input != nil {
+		config.InputMode = *fc.Input
+	}
+	if fc.Output != nil {
+		config.OutputMode = *fc.Output
+	}
+	if fc.Mode != nil {
+		config.Mode = *fc.Mode
+	}
+	if fc.FailbackDelay != nil {
+		config.FailbackDelay = time.Duration(*fc.FailbackDelay)
+	}
+	if fc.Transparent != nil {
+		config.Transparent = *fc.Transparent
+	}
+	if fc.Sample != nil {
+		config.Sample = *fc.Sample
+	}
+	if fc.RateLimit != nil {
+		config.RateLimit = *fc.RateLimit
+	}
+	if fc.MaxReceiveRate != nil {
+		config.MaxReceiveRate = *fc.MaxReceiveRate
+	}
+	if fc.MinSize != nil {
+		config.MinSize = *fc.MinSize
+	}
+	if fc.MaxSize != nil {
+		config.MaxSize = *fc.MaxSize
+	}
+	if config.MatchPrefixes, err = parseHexList(fc.MatchPrefix); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: match-prefix: %v", path, err)
+	}
+	if config.DropPrefixes, err = parseHexList(fc.DropPrefix); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: drop-prefix: %v", path, err)
+	}
+	if fc.MatchRegexp != nil {
+		if err := config.MatchRegexp.Set(*fc.MatchRegexp); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: match-regexp: %v", path, err)
+		}
+	}
+	if config.AllowSrc, err = parseCIDRList(fc.AllowSrc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: allow-src: %v", path, err)
+	}
+	if config.DenySrc, err = parseCIDRList(fc.DenySrc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: deny-src: %v", path, err)
+	}
+	if config.Rewrites, err = parseRewriteRules(fc.Rewrite); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: rewrite: %v", path, err)
+	}
+	if fc.DedupWindow != nil {
+		config.DedupWindow = time.Duration(*fc.DedupWindow)
+	}
+	if fc.DSCP != nil {
+		config.DSCP = *fc.DSCP
+	}
+	if fc.TTL != nil {
+		config.TTL = *fc.TTL
+	}
+	if fc.NoFragment != nil {
+		config.NoFragment = *fc.NoFragment
+	}
+	if fc.SourcePort != nil {
+		config.SourcePort = *fc.SourcePort
+	}
+	if fc.Proxy != nil {
+		config.Proxy = *fc.Proxy
+	}
+	if fc.TLSCA != nil {
+		config.TLSCA = *fc.TLSCA
+	}
+	if fc.TLSInsecure != nil {
+		config.TLSInsecure = *fc.TLSInsecure
+	}
+	if fc.EgressAddr != nil {
+		config.EgressAddr = *fc.EgressAddr
+	}
+	if fc.WriteTimeout != nil {
+		config.WriteTimeout = time.Duration(*fc.WriteTimeout)
+	}
+	if fc.KeepaliveInterval != nil {
+		config.KeepaliveInterval = time.Duration(*fc.KeepaliveInterval)
+	}
+	if fc.KeepalivePayload != nil {
+		if err := config.KeepalivePayload.Set(*fc.KeepalivePayload); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: keepalive-payload: %v", path, err)
+		}
+	}
+	if fc.ChaosDrop != nil {
+		config.ChaosDrop = *fc.ChaosDrop
+	}
+	if fc.ChaosDelay != nil {
+		config.ChaosDelay = time.Duration(*fc.ChaosDelay)
+	}
+	if fc.Coalesce != nil {
+		config.Coalesce = *fc.Coalesce
+	}
+	if fc.CoalesceBytes != nil {
+		config.CoalesceBytes = *fc.CoalesceBytes
+	}
+	if fc.CoalesceDelay != nil {
+		config.CoalesceDelay = time.Duration(*fc.CoalesceDelay)
+	}
+	if fc.Buffer != nil {
+		config.BufferSize = *fc.Buffer
+	}
+	if fc.Workers != nil {
+		config.Workers = *fc.Workers
+	}
+	if fc.FanoutConcurrency != nil {
+		config.FanoutConcurrency = *fc.FanoutConcurrency
+	}
+	if fc.MaxQueue != nil {
+		config.MaxQueue = *fc.MaxQueue
+	}
+	if fc.DrainTimeout != nil {
+		config.DrainTimeout = time.Duration(*fc.DrainTimeout)
+	}
+	if fc.IdleTimeout != nil {
+		config.IdleTimeout = time.Duration(*fc.IdleTimeout)
+	}
+	if fc.MaxLifetime != nil {
+		config.MaxLifetime = time.Duration(*fc.MaxLifetime)
+	}
+	if fc.ForwardRetries != nil {
+		config.ForwardRetries = *fc.ForwardRetries
+	}
+	if fc.RetryDelay != nil {
+		config.RetryDelay = time.Duration(*fc.RetryDelay)
+	}
+	if fc.BreakerFailures != nil {
+		config.BreakerFailures = *fc.BreakerFailures
+	}
+	if fc.BreakerWindow != nil {
+		config.BreakerWindow = time.Duration(*fc.BreakerWindow)
+	}
+	if fc.BreakerCooldown != nil {
+		config.BreakerCooldown = time.Duration(*fc.BreakerCooldown)
+	}
+	if fc.StatsInterval != nil {
+		config.StatsInterval = time.Duration(*fc.StatsInterval)
+		config.statsIntervalSet = true
+	}
+	if fc.TUI != nil {
+		config.TUI = *fc.TUI
+	}
+	if fc.ErrorLogInterval != nil {
+		config.ErrorLogInterval = time.Duration(*fc.ErrorLogInterval)
+	}
+	if fc.MetricsAddr != nil {
+		config.MetricsAddr = *fc.MetricsAddr
+	}
+	if fc.OTLPEndpoint != nil {
+		config.OTLPEndpoint = *fc.OTLPEndpoint
+	}
+	if fc.OTLPInterval != nil {
+		config.OTLPInterval = time.Duration(*fc.OTLPInterval)
+	}
+	if fc.StatsAddr != nil {
+		config.StatsAddr = *fc.StatsAddr
+	}
+	if fc.StatsFile != nil {
+		config.StatsFile = *fc.StatsFile
+	}
+	if fc.StatsFileInterval != nil {
+		config.StatsFileInterval = time.Duration(*fc.StatsFileInterval)
+	}
+	if fc.TrackSources != nil {
+		config.TrackSources = *fc.TrackSources
+	}
+	if fc.TrackSourcesMax != nil {
+		config.TrackSourcesMax = *fc.TrackSourcesMax
+	}
+	if fc.HealthAddr != nil {
+		config.HealthAddr = *fc.HealthAddr
+	}
+	if fc.ControlAddr != nil {
+		config.ControlAddr = *fc.ControlAddr
+	}
+	if fc.DebugAddr != nil {
+		config.DebugAddr = *fc.DebugAddr
+	}
+	if fc.GRPCAddr != nil {
+		config.GRPCAddr = *fc.GRPCAddr
+	}
+	if fc.LogFormat != nil {
+		config.LogFormat = *fc.LogFormat
+	}
+	if fc.LogLevel != nil {
+		config.LogLevel = *fc.LogLevel
+	}
+	if fc.AccessLog != nil {
+		config.AccessLog = *fc.AccessLog
+	}
+	if fc.Pcap != nil {
+		config.PcapFile = *fc.Pcap
+	}
+	if fc.PcapForwarded != nil {
+		config.PcapForwarded = *fc.PcapForwarded
+	}
+	if fc.DumpRaw != nil {
+		config.DumpRaw = *fc.DumpRaw
+	}
+	if fc.Replay != nil {
+		config.Replay = *fc.Replay
+	}
+	if fc.ReplaySpeed != nil {
+		config.ReplaySpeed = *fc.ReplaySpeed
+	}
+	if fc.Verbose != nil {
+		config.Verbose = *fc.Verbose
+	}
+	if fc.TargetsFile != nil {
+		config.TargetsFile = *fc.TargetsFile
+	}
+	for _, ft := range fc.Targets {
+		target := strings.TrimSpace(ft.Address)
+		if target == "" {
+			return nil, fmt.Errorf("invalid config file %s: empty target address", path)
+		}
+		config.TargetAddrs = append(config.TargetAddrs, target)
+		if ft.RateLimit != nil {
+			if config.TargetRateLimits == nil {
+				config.TargetRateLimits = make(map[string]RateLimit)
+			}
+			config.TargetRateLimits[target] = *ft.RateLimit
+		}
+		if ft.Sample != nil {
+			if config.TargetSamples == nil {
+				config.TargetSamples = make(map[string]Sample)
+			}
+			config.TargetSamples[target] = *ft.Sample
+		}
+		if ft.Weight != nil {
+			if *ft.Weight < 1 {
+				return nil, fmt.Errorf("invalid config file %s: target %s: weight must be at least 1", path, target)
+			}
+			if config.TargetWeights == nil {
+				config.TargetWeights = make(map[string]int)
+			}
+			config.TargetWeights[target] = *ft.Weight
+		}
+		if ft.Compress != nil {
+			if config.TargetCompress == nil {
+				config.TargetCompress = make(map[string]string)
+			}
+			config.TargetCompress[target] = *ft.Compress
+		}
+	}
+	for i, fr := range fc.Routes {
+		prefixes, err := parseHexList(fr.Prefixes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: route %d: %v", path, i+1, err)
+		}
+		sources, err := parseCIDRList(fr.Sources)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: route %d: %v", path, i+1, err)
+		}
+		if len(prefixes) == 0 && len(sources) == 0 {
+			return nil, fmt.Errorf("invalid config file %s: route %d: no prefixes or sources", path, i+1)
+		}
+		group, ok := fc.TargetGroups[fr.Group]
+		if !ok {
+			return nil, fmt.Errorf("invalid config file %s: route %d: unknown target group %q", path, i+1, fr.Group)
+		}
+		route := Route{Prefixes: prefixes, Sources: sources, Group: fr.Group}
+		for _, target := range group {
+			route.Targets = append(route.Targets, strings.TrimSpace(target))
+		}
+		config.Routes = append(config.Routes, route)
+	}
+	if fc.RouteDefault != nil {
+		config.RouteDefault = *fc.RouteDefault
+	}
+
+	return config, nil
+}
+
+// mergeConfigFile copies settings from a config file into config for every
+// option that was not given explicitly on the command line.
+func mergeConfigFile(config, file *Config, setFlags map[string]bool) {
+	if !setFlags["listen"] {
+		config.ListenAddr = file.ListenAddr
+	}
+	if !setFlags["port"] {
+		config.ListenPorts = file.ListenPorts
+	}
+	if !setFlags["target-port-map"] {
+		config.TargetPortMap = file.TargetPortMap
+	}
+	if !setFlags["skip-bad-targets"] {
+		config.SkipBadTargets = file.SkipBadTargets
+	}
+	if !setFlags["dns-refresh"] {
+		config.DNSRefresh = file.DNSRefresh
+	}
+	if !setFlags["preflight"] {
+		config.Preflight = file.Preflight
+	}
+	if !setFlags["preflight-timeout"] {
+		config.PreflightTimeout = file.PreflightTimeout
+	}
+	if !setFlags["dry-run"] {
+		config.DryRun = file.DryRun
+	}
+	if !setFlags["once"] {
+		config.Once = file.Once
+	}
+	if !setFlags["loop-guard"] {
+		config.LoopGuard = file.LoopGuard
+	}
+	if !setFlags["allow-loopback"] {
+		config.AllowLoopback = file.AllowLoopback
+	}
+	if !setFlags["host-loop-guard"] {
+		config.HostLoopGuard = file.HostLoopGuard
+	}
+	if !setFlags["relay-id"] {
+		config.RelayID = file.RelayID
+	}
+	if !setFlags["timestamp"] {
+		config.Timestamp = file.Timestamp
+	}
+	if !setFlags["compress"] {
+		config.Compress = file.Compress
+	}
+	if !setFlags["decompress"] {
+		config.Decompress = file.Decompress
+	}
+	if !setFlags["prepend-source"] {
+		config.PrependSource = file.PrependSource
+	}
+	if !setFlags["reuseport"] {
+		config.ReusePort = file.ReusePort
+	}
+	if !setFlags["interface"] {
+		config.Interface = file.Interface
+	}
+	if !setFlags["multicast-groups"] {
+		config.MulticastGroups = file.MulticastGroups
+	}
+	if !setFlags["multicast-interface"] {
+		config.MulticastInterface = file.MulticastInterface
+	}
+	if !setFlags["input"] {
+		config.InputMode = file.InputMode
+	}
+	if !setFlags["output"] {
+		config.OutputMode = file.OutputMode
+	}
+	if !setFlags["mode"] {
+		config.Mode = file.Mode
+	}
+	if !setFlags["failback-delay"] {
+		config.FailbackDelay = file.FailbackDelay
+	}
+	if !setFlags["transparent"] {
+		config.Transparent = file.Transparent
+	}
+	if !setFlags["sample"] {
+		config.Sample = file.Sample
+	}
+	if !setFlags["rate-limit"] {
+		config.RateLimit = file.RateLimit
+	}
+	if !setFlags["max-receive-rate"] {
+		config.MaxReceiveRate = file.MaxReceiveRate
+	}
+	// Per-target limits only come from the file and override -rate-limit.
+	config.TargetRateLimits = file.TargetRateLimits
+	config.TargetSamples = file.TargetSamples
+	config.TargetWeights = file.TargetWeights
+	config.TargetCompress = file.TargetCompress
+	config.Routes = file.Routes
+	config.RouteDefault = file.RouteDefault
+	if !setFlags["min-size"] {
+		config.MinSize = file.MinSize
+	}
+	if !setFlags["max-size"] {
+		config.MaxSize = file.MaxSize
+	}
+	if !setFlags["match-prefix"] {
+		config.MatchPrefixes = file.MatchPrefixes
+	}
+	if !setFlags["drop-prefix"] {
+		config.DropPrefixes = file.DropPrefixes
+	}
+	if !setFlags["match-regexp"] {
+		config.MatchRegexp = file.MatchRegexp
+	}
+	if !setFlags["allow-src"] {
+		config.AllowSrc = file.AllowSrc
+	}
+	if !setFlags["deny-src"] {
+		config.DenySrc = file.DenySrc
+	}
+	if !setFlags["rewrite"] {
+		config.Rewrites = file.Rewrites
+	}
+	if !setFlags["dedup-window"] {
+		config.DedupWindow = file.DedupWindow
+	}
+	if !setFlags["dscp"] {
+		config.DSCP = file.DSCP
+	}
+	if !setFlags["ttl"] {
+		config.TTL = file.TTL
+	}
+	if !setFlags["no-fragment"] {
+		config.NoFragment = file.NoFragment
+	}
+	if !setFlags["source-port"] {
+		config.SourcePort = file.SourcePort
+	}
+	if !setFlags["proxy"] {
+		config.Proxy = file.Proxy
+	}
+	if !setFlags["tls-ca"] {
+		config.TLSCA = file.TLSCA
+	}
+	if !setFlags["tls-insecure"] {
+		config.TLSInsecure = file.TLSInsecure
+	}
+	if !setFlags["egress-addr"] {
+		config.EgressAddr = file.EgressAddr
+	}
+	if !setFlags["write-timeout"] {
+		config.WriteTimeout = file.WriteTimeout
+	}
+	if !setFlags["keepalive-interval"] {
+		config.KeepaliveInterval = file.KeepaliveInterval
+	}
+	if !setFlags["keepalive-payload"] {
+		config.KeepalivePayload = file.KeepalivePayload
+	}
+	if !setFlags["chaos-drop"] {
+		config.ChaosDrop = file.ChaosDrop
+	}
+	if !setFlags["chaos-delay"] {
+		config.ChaosDelay = file.ChaosDelay
+	}
+	if !setFlags["coalesce"] {
+		config.Coalesce = file.Coalesce
+	}
+	if !setFlags["coalesce-bytes"] {
+		config.CoalesceBytes = file.CoalesceBytes
+	}
+	if !setFlags["coalesce-delay"] {
+		config.CoalesceDelay = file.CoalesceDelay
+	}
+	if !setFlags["buffer"] {
+		config.BufferSize = file.BufferSize
+	}
+	if !setFlags["workers"] {
+		config.Workers = file.Workers
+	}
+	if !setFlags["fanout-concurrency"] {
+		config.FanoutConcurrency = file.FanoutConcurrency
+	}
+	if !setFlags["max-queue"] {
+		config.MaxQueue = file.MaxQueue
+	}
+	if !setFlags["drain-timeout"] {
+		config.DrainTimeout = file.DrainTimeout
+	}
+	if !setFlags["idle-timeout"] {
+		config.IdleTimeout = file.IdleTimeout
+	}
+	if !setFlags["max-lifetime"] {
+		config.MaxLifetime = file.MaxLifetime
+	}
+	if !setFlags["forward-retries"] {
+		config.ForwardRetries = file.ForwardRetries
+	}
+	if !setFlags["retry-delay"] {
+		config.RetryDelay = file.RetryDelay
+	}
+	if !setFlags["breaker-failures"] {
+		config.BreakerFailures = file.BreakerFailures
+	}
+	if !setFlags["breaker-window"] {
+		config.BreakerWindow = file.BreakerWindow
+	}
+	if !setFlags["breaker-cooldown"] {
+		config.BreakerCooldown = file.BreakerCooldown
+	}
+	if !setFlags["stats-interval"] {
+		config.StatsInterval = file.StatsInterval
+		config.statsIntervalSet = file.statsIntervalSet
+	}
+	if !setFlags["tui"] {
+		config.TUI = file.TUI
+	}
+	if !setFlags["error-log-interval"] {
+		config.ErrorLogInterval = file.ErrorLogInterval
+	}
+	if !setFlags["metrics-addr"] {
+		config.MetricsAddr = file.MetricsAddr
+	}
+	if !setFlags["otlp-endpoint"] {
+		config.OTLPEndpoint = file.OTLPEndpoint
+	}
+	if !setFlags["otlp-interval"] {
+		config.OTLPInterval = file.OTLPInterval
+	}
+	if !setFlags["stats-addr"] {
+		config.StatsAddr = file.StatsAddr
+	}
+	if !setFlags["stats-file"] {
+		config.StatsFile = file.StatsFile
+	}
+	if !setFlags["stats-file-interval"] {
+		config.StatsFileInterval = file.StatsFileInterval
+	}
+	if !setFlags["track-sources"] {
+		config.TrackSources = file.TrackSources
+	}
+	if !setFlags["track-sources-max"] {
+		config.TrackSourcesMax = file.TrackSourcesMax
+	}
+	if !setFlags["health-addr"] {
+		config.HealthAddr = file.HealthAddr
+	}
+	if !setFlags["control-addr"] {
+		config.ControlAddr = file.ControlAddr
+	}
+	if !setFlags["debug-addr"] {
+		config.DebugAddr = file.DebugAddr
+	}
+	if !setFlags["grpc-addr"] {
+		config.GRPCAddr = file.GRPCAddr
+	}
+	if !setFlags["log-format"] {
+		config.LogFormat = file.LogFormat
+	}
+	if !setFlags["log-level"] {
+		config.LogLevel = file.LogLevel
+	}
+	if !setFlags["access-log"] {
+		config.AccessLog = file.AccessLog
+	}
+	if !setFlags["pcap"] {
+		config.PcapFile = file.PcapFile
+	}
+	if !setFlags["pcap-forwarded"] {
+		config.PcapForwarded = file.PcapForwarded
+	}
+	if !setFlags["dump-raw"] {
+		config.DumpRaw = file.DumpRaw
+	}
+	if !setFlags["replay"] {
+		config.Replay = file.Replay
+	}
+	if !setFlags["replay-speed"] {
+		config.ReplaySpeed = file.ReplaySpeed
+	}
+	if !setFlags["verbose"] {
+		config.Verbose = file.Verbose
+	}
+	if !setFlags["targets"] {
+		config.TargetAddrs = file.TargetAddrs
+	}
+	if !setFlags["targets-file"] {
+		config.TargetsFile = file.TargetsFile
+	}
+}
+
+// targetSettings holds the settings that apply to individual targets: the
+// default rate limit and sample, and the per-target rate limits, samples
+// and weights from the config file, keyed by target address as written
+// there.
+type targetSettings struct {
+	defaultLimit  RateLimit
+	limits        map[string]RateLimit
+	defaultSample Sample
+	samples       map[string]Sample
+	weights       map[string]int
+	// compress holds the -compress formats, as in the header, of the
+	// targets that override defaultCompress.
+	defaultCompress uint32
+	compress        map[string]uint32
+	// origins holds the srv:// target each target read from SRV records
+	// came from, whose settings it gets.
+	origins map[string]srvOrigin
+	// ports holds the listen ports whose packets each target is sent
+	// under -target-port-map, and shifted the target each copy it added
+	// was made from.
+	ports   map[string][]int
+	shifted map[string]string
+}
+
+func configTargetSettings(config *Config) targetSettings {
+	settings := targetSettings{
+		defaultLimit:  config.RateLimit,
+		limits:        config.TargetRateLimits,
+		defaultSample: config.Sample,
+		samples:       config.TargetSamples,
+		weights:       config.TargetWeights,
+	}
+	// validate has checked the formats.
+	settings.defaultCompress, _ = compressFormat(config.Compress)
+	for target, compress := range config.TargetCompress {
+		if settings.compress == nil {
+			settings.compress = make(map[string]uint32)
+		}
+		settings.compress[target], _ = compressFormat(compress)
+	}
+	return settings
+}
+
+// configured returns target as written in the configuration: the target
+// it was copied from under -target-port-map, or its srv:// target if it was
+// read from SRV records.
+func (s targetSettings) configured(target string) string {
+	if from, ok := s.shifted[target]; ok {
+		target = from
+	}
+	if origin, ok := s.origins[target]; ok {
+		return origin.srv
+	}
+	return target
+}
+
+func (s targetSettings) limit(target string) RateLimit {
+	target = s.configured(target)
+	if limit, ok := s.limits[target]; ok {
+		return limit
+	}
+	return s.defaultLimit
+}
+
+func (s targetSettings) sample(target string) Sample {
+	target = s.configured(target)
+	if sample, ok := s.samples[target]; ok {
+		return sample
+	}
+	return s.defaultSample
+}
+
+// compression is the target's -compress format.
+func (s targetSettings) compression(target string) uint32 {
+	target = s.configured(target)
+	if format, ok := s.compress[target]; ok {
+		return format
+	}
+	return s.defaultCompress
+}
+
+// weight is the target's share of the packets in balance mode. A target
+// read from SRV records without a weight of its own, or of its srv://
+// target, has its record's weight, or 1 for a weight of 0; a copy made
+// under -target-port-map has the weight of the target it was made from.
+func (s targetSettings) weight(target string) int {
+	if weight, ok := s.weights[target]; ok {
+		return weight
+	}
+	if from, ok := s.shifted[target]; ok {
+		return s.weight(from)
+	}
+	origin, ok := s.origins[target]
+	if !ok {
+		return 1
+	}
+	if weight, ok := s.weights[origin.srv]; ok {
+		return weight
+	}
+	return max(origin.weight, 1)
+}
@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlConfig = `
+listen: 127.0.0.1
+port: [9000, 9001]
+dns-refresh: 30s
+rate-limit: 1MB/s
+targets:
+  - 192.168.1.100:9999
+  - address: 10.0.0.50:8888
+    rate-limit: 100p/s
+    weight: 2
+target-groups:
+  video: [10.0.0.50:8888]
+routes:
+  - prefixes: ["0x01"]
+    group: video
+`
+
+const jsonConfig = `{
+	"listen": "127.0.0.1",
+	"port": [9000, 9001],
+	"dns-refresh": "30s",
+	"rate-limit": "1MB/s",
+	"targets": [
+		"192.168.1.100:9999",
+		{"address": "10.0.0.50:8888", "rate-limit": "100p/s", "weight": 2}
+	],
+	"target-groups": {"video": ["10.0.0.50:8888"]},
+	"routes": [{"prefixes": ["0x01"], "group": "video"}]
+}`
+
+func TestLoadConfigFile(t *testing.T) {
+	yamlPath := writeConfigFile(t, "relay.yaml", yamlConfig)
+	fromYAML, err := LoadConfigFile(yamlPath)
+	if err != nil {
+		t.Fatalf("LoadConfigFile(%s): %v", yamlPath, err)
+	}
+	jsonPath := writeConfigFile(t, "relay.json", jsonConfig)
+	fromJSON, err := LoadConfigFile(jsonPath)
+	if err != nil {
+		t.Fatalf("LoadConfigFile(%s): %v", jsonPath, err)
+	}
+
+	for _, config := range []*Config{fromYAML, fromJSON} {
+		if config.ListenAddr != "127.0.0.1" {
+			t.Errorf("ListenAddr = %q, want 127.0.0.1", config.ListenAddr)
+		}
+		if want := (PortList{9000, 9001}); !reflect.DeepEqual(config.ListenPorts, want) {
+			t.Errorf("ListenPorts = %v, want %v", config.ListenPorts, want)
+		}
+		if config.DNSRefresh != 30*time.Second {
+			t.Errorf("DNSRefresh = %v, want 30s", config.DNSRefresh)
+		}
+		if got := config.RateLimit.String(); got != "1000000B/s" {
+			t.Errorf("RateLimit = %q, want 1000000B/s", got)
+		}
+		if want := []string{"192.168.1.100:9999", "10.0.0.50:8888"}; !reflect.DeepEqual(config.TargetAddrs, want) {
+			t.Errorf("TargetAddrs = %v, want %v", config.TargetAddrs, want)
+		}
+		if got := config.TargetRateLimits["10.0.0.50:8888"].String(); got != "100p/s" {
+			t.Errorf("target rate limit = %q, want 100p/s", got)
+		}
+		if got := config.TargetWeights["10.0.0.50:8888"]; got != 2 {
+			t.Errorf("target weight = %d, want 2", got)
+		}
+		if len(config.Routes) != 1 || config.Routes[0].Group != "video" ||
+			!reflect.DeepEqual(config.Routes[0].Targets, []string{"10.0.0.50:8888"}) {
+			t.Errorf("Routes = %+v, want one to the video group", config.Routes)
+		}
+		// Keys left out keep their defaults.
+		if want := DefaultConfig().BufferSize; config.BufferSize != want {
+			t.Errorf("BufferSize = %d, want the default %d", config.BufferSize, want)
+		}
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("YAML and JSON load differently:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+}
+
+func TestLoadConfigFileEmpty(t *testing.T) {
+	config, err := LoadConfigFile(writeConfigFile(t, "relay.yaml", ""))
+	if err != nil {
+		t.Fatalf("LoadConfigFile of an empty file: %v", err)
+	}
+	if !reflect.DeepEqual(config, DefaultConfig()) {
+		t.Errorf("empty file = %+v, want the defaults", config)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"malformed YAML", "relay.yaml", "listen: [127.0.0.1\n", "invalid config file"},
+		{"malformed JSON", "relay.json", `{"listen": "127.0.0.1"`, "invalid config file"},
+		{"unknown YAML key", "relay.yaml", "listne: 127.0.0.1\n", `field listne not found`},
+		{"unknown JSON key", "relay.json", `{"listne": "127.0.0.1"}`, `unknown field "listne"`},
+		{"unknown target setting", "relay.yaml", "targets:\n  - address: 10.0.0.1:9999\n    wieght: 2\n", `unknown target setting "wieght"`},
+		{"bad value", "relay.yaml", "dns-refresh: soon\n", "invalid config file"},
+		{"empty target", "relay.json", `{"targets": [" "]}`, "empty target address"},
+		{"bad weight", "relay.yaml", "targets:\n  - address: 10.0.0.1:9999\n    weight: 0\n", "weight must be at least 1"},
+		{"unknown group", "relay.yaml", "routes:\n  - prefixes: [\"0x01\"]\n    group: video\n", `unknown target group "video"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.file, tt.content)
+			_, err := LoadConfigFile(path)
+			if err == nil {
+				t.Fatal("LoadConfigFile succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil ||
+		!strings.Contains(err.Error(), "failed to read config file") {
+		t.Errorf("missing file: error = %v, want failed to read config file", err)
+	}
+}
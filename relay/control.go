@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type targetRequest struct {
+	Target string `json:"target"`
+}
+
+type targetsResponse struct {
+	Targets []string `json:"targets"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// handleTargets implements the control API:
+//
+//	GET    /targets                        list the current targets
+//	POST   /targets {"target": "ip:port"}  add a target
+//	DELETE /targets {"target": "ip:port"}  remove a target (or ?target=ip:port)
+//
+// Every response carries the resulting target list.
+func (r *Relay) handleTargets(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeTargets(w, http.StatusOK, r.Targets(), nil)
+
+	case http.MethodPost, http.MethodDelete:
+		target := req.URL.Query().Get("target")
+		if target == "" {
+			var body targetRequest
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				writeTargets(w, http.StatusBadRequest, r.Targets(), errors.New("request body must be {\"target\": \"ip:port\"}"))
+				return
+			}
+			target = body.Target
+		}
+		if target == "" {
+			writeTargets(w, http.StatusBadRequest, r.Targets(), errors.New("missing target"))
+			return
+		}
+
+		if req.Method == http.MethodPost {
+			if err := r.AddTarget(target); err != nil {
+				writeTargets(w, http.StatusBadRequest, r.Targets(), err)
+				return
+			}
+			writeTargets(w, http.StatusCreated, r.Targets(), nil)
+			return
+		}
+
+		if err := r.RemoveTarget(target); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errTargetNotFound) {
+				status = http.StatusNotFound
+			}
+			writeTargets(w, status, r.Targets(), err)
+			return
+		}
+		writeTargets(w, http.StatusOK, r.Targets(), nil)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeTargets(w http.ResponseWriter, status int, targets []string, err error) {
+	resp := targetsResponse{Targets: targets}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type debugInfo struct {
+	Version   string    `json:"version"`
+	BuildTime string    `json:"build_time"`
+	GoVersion string    `json:"go_version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	PID       int       `json:"pid"`
+	Started   time.Time `json:"started"`
+	Uptime    string    `json:"uptime"`
+	Runtime   struct {
+		Goroutines   int    `json:"goroutines"`
+		NumCPU       int    `json:"num_cpu"`
+		GOMAXPROCS   int    `json:"gomaxprocs"`
+		HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+		HeapObjects  uint64 `json:"heap_objects"`
+		TotalAlloc   uint64 `json:"total_alloc_bytes"`
+		Sys          uint64 `json:"sys_bytes"`
+		NumGC        uint32 `json:"num_gc"`
+		PauseTotalNs uint64 `json:"gc_pause_total_ns"`
+	} `json:"runtime"`
+	// Config has every option as it would be given on the command line.
+	Config map[string]string `json:"config"`
+}
+
+// handleDebug registers /debug/info and the net/http/pprof handlers on
+// addr, except /debug/pprof/cmdline: the command line may hold the proxy
+// password, which /debug/info redacts.
+func (r *Relay) handleDebug(addr string) {
+	r.handle(addr, "/debug/info", r.handleDebugInfo)
+	r.handle(addr, "/debug/pprof/", pprof.Index)
+	r.handle(addr, "/debug/pprof/profile", pprof.Profile)
+	r.handle(addr, "/debug/pprof/symbol", pprof.Symbol)
+	r.handle(addr, "/debug/pprof/trace", pprof.Trace)
+}
+
+// handleDebugInfo writes the build, the Go runtime and the configuration
+// as JSON, for support requests.
+func (r *Relay) handleDebugInfo(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info := debugInfo{
+		Version:   Version,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		PID:       os.Getpid(),
+		Started:   r.startTime(),
+		Uptime:    time.Since(r.startTime()).Round(time.Second).String(),
+		Config:    configFlags(r.lastConfig.Load()),
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	info.Runtime.Goroutines = runtime.NumGoroutine()
+	info.Runtime.NumCPU = runtime.NumCPU()
+	info.Runtime.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	info.Runtime.HeapAlloc = mem.HeapAlloc
+	info.Runtime.HeapObjects = mem.HeapObjects
+	info.Runtime.TotalAlloc = mem.TotalAlloc
+	info.Runtime.Sys = mem.Sys
+	info.Runtime.NumGC = mem.NumGC
+	info.Runtime.PauseTotalNs = mem.PauseTotalNs
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(info)
+}
+
+// configFlags returns the value of every flag for config, keyed by flag
+// name. It binds a flag set to a copy of config, so that the flags print
+// exactly what they would parse; the proxy password is redacted.
+func configFlags(config *Config) map[string]string {
+	var bound Config
+	var targets string
+	fs := newFlagSet(&bound, &targets)
+	// Binding the flags set their defaults; the copy replaces them.
+	bound = *config
+	targets = strings.Join(config.TargetAddrs, ",")
+	if u, err := url.Parse(bound.Proxy); err == nil && u.User != nil {
+		bound.Proxy = u.Redacted()
+	}
+
+	flags := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	return flags
+}
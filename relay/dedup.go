@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/maphash"
+	"net"
+	"time"
+)
+
+// dedupCacheSize bounds the number of recent packets remembered for
+// -dedup-window. When it is full the oldest entry is forgotten early, so at
+// very high rates some duplicates may get through.
+const dedupCacheSize = 8192
+
+// dedupCache remembers hashes of recently forwarded packets. Entries are
+// kept in arrival order and expire a window after they were first seen. It
+// is used by the receive loop only and is not safe for concurrent use.
+type dedupCache struct {
+	window  time.Duration
+	hash    maphash.Hash
+	order   *list.List // of dedupEntry, oldest first
+	entries map[uint64]*list.Element
+}
+
+type dedupEntry struct {
+	sum  uint64
+	seen time.Time
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	d := &dedupCache{
+		window:  window,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element, dedupCacheSize),
+	}
+	d.hash.SetSeed(maphash.MakeSeed())
+	return d
+}
+
+// duplicate reports whether the same payload from the same source was seen
+// within the window, and remembers it otherwise.
+func (d *dedupCache) duplicate(src *net.UDPAddr, data []byte, now time.Time) bool {
+	d.hash.Reset()
+	d.hash.Write(src.IP.To16())
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(src.Port))
+	d.hash.Write(port[:])
+	d.hash.Write(data)
+	sum := d.hash.Sum64()
+
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		entry := e.Value.(dedupEntry)
+		if now.Sub(entry.seen) < d.window && d.order.Len() < dedupCacheSize {
+			break
+		}
+		d.order.Remove(e)
+		delete(d.entries, entry.sum)
+	}
+
+	if _, ok := d.entries[sum]; ok {
+		return true
+	}
+	d.entries[sum] = d.order.PushBack(dedupEntry{sum: sum, seen: now})
+	return false
+}
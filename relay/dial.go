@@ -0,0 +1,174 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// socketOptions are the settings applied to a forwarding socket when it is
+// dialed.
+type socketOptions struct {
+	// broadcast enables SO_BROADCAST, without which the kernel refuses to
+	// send to broadcast addresses.
+	broadcast bool
+	// dscp is the DSCP value to mark packets with; 0 leaves the default.
+	dscp int
+	// ttl is the IPv4 TTL or IPv6 hop limit; 0 leaves the default.
+	ttl int
+	// sourcePort is the local port to bind; 0 lets the system pick. All
+	// targets share it, so SO_REUSEPORT is set on every socket bound to it.
+	sourcePort int
+	// proxy is the SOCKS5 proxy to forward through, or nil to send
+	// directly.
+	proxy *url.URL
+	// writeTimeout bounds each write to a target; 0 leaves UDP and Unix
+	// socket writes unbounded and TCP writes at tcpTimeout.
+	writeTimeout time.Duration
+	// egress is the local address to send from, or the zero Addr to let
+	// the routing table pick.
+	egress netip.Addr
+	// tls is the configuration tls:// targets start from.
+	tls *tls.Config
+	// coalesceBytes, if set, batches the datagrams to UDP and Unix socket
+	// targets into ones of up to that many bytes, sent at the latest
+	// coalesceDelay after the first.
+	coalesceBytes int
+	coalesceDelay time.Duration
+	// noFragment sets the DF bit, so that datagrams too big for the path
+	// fail to send instead of being fragmented.
+	noFragment bool
+}
+
+// parseEgressAddr parses -egress-addr, which must be an IP address assigned
+// to one of the host's interfaces; an IPv6 link-local address may carry its
+// zone, as in fe80::1%eth0.
+func parseEgressAddr(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid -egress-addr %q: must be an IP address", s)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("-egress-addr: failed to list the host's addresses: %v", err)
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipnet.IP); ok && ip.Unmap() == addr.WithZone("").Unmap() {
+				return addr, nil
+			}
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("-egress-addr %s is not an address of this host (see -list-interfaces)", s)
+}
+
+// localUDPAddr is the address forwarding sockets bind, or nil for any.
+func (o socketOptions) localUDPAddr() *net.UDPAddr {
+	if o.sourcePort == 0 && !o.egress.IsValid() {
+		return nil
+	}
+	return &net.UDPAddr{IP: o.egress.AsSlice(), Zone: o.egress.Zone(), Port: o.sourcePort}
+}
+
+// dialTarget opens the connected forwarding socket for addr.
+func dialTarget(network string, addr *net.UDPAddr, opts socketOptions) (*net.UDPConn, error) {
+	var dialer net.Dialer
+	if local := opts.localUDPAddr(); local != nil {
+		dialer.LocalAddr = local
+	}
+	if opts.broadcast || opts.sourcePort > 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				if opts.sourcePort > 0 {
+					if sockErr = setReusePort(fd); sockErr != nil {
+						sockErr = fmt.Errorf("failed to share source port %d: %v", opts.sourcePort, sockErr)
+						return
+					}
+				}
+				if opts.broadcast {
+					sockErr = setBroadcast(fd)
+				}
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	c, err := dialer.Dial(network, addr.String())
+	if errors.Is(err, errnoAddrInUse) {
+		return nil, fmt.Errorf("source port %d is already in use by another socket", opts.sourcePort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.UDPConn)
+
+	if opts.dscp > 0 {
+		if err := setDSCP(conn, opts.dscp); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set DSCP %d: %v", opts.dscp, err)
+		}
+	}
+	if opts.ttl > 0 {
+		if err := setTTL(conn, opts.ttl); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set TTL %d: %v", opts.ttl, err)
+		}
+	}
+	if opts.noFragment {
+		if err := setDontFragment(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set Don't Fragment: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+func isIPv6Conn(conn net.Conn) bool {
+	var ip net.IP
+	switch local := conn.LocalAddr().(type) {
+	case *net.UDPAddr:
+		ip = local.IP
+	case *net.TCPAddr:
+		ip = local.IP
+	}
+	return ip != nil && ip.To4() == nil
+}
+
+// setDSCP marks packets sent on conn with dscp, using the IPv4 ToS byte or
+// the IPv6 traffic class depending on the socket's address family.
+func setDSCP(conn net.Conn, dscp int) error {
+	tos := dscp << 2
+	if isIPv6Conn(conn) {
+		return ipv6.NewConn(conn).SetTrafficClass(tos)
+	}
+	return ipv4.NewConn(conn).SetTOS(tos)
+}
+
+// setTTL sets the TTL (IPv4) or hop limit (IPv6) of packets sent on conn.
+// Multicast packets have a separate setting, defaulting to 1, which is set
+// too so that the value applies whatever the target.
+func setTTL(conn *net.UDPConn, ttl int) error {
+	if isIPv6Conn(conn) {
+		p := ipv6.NewPacketConn(conn)
+		if err := p.SetHopLimit(ttl); err != nil {
+			return err
+		}
+		return p.SetMulticastHopLimit(ttl)
+	}
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetTTL(ttl); err != nil {
+		return err
+	}
+	return p.SetMulticastTTL(ttl)
+}
@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// dnsRefresher reads the records of srv:// targets again and re-resolves
+// the targets given by hostname every -dns-refresh, and moves those whose
+// address changed to the new one.
+func (r *Relay) dnsRefresher() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.DNSRefresh)
+	defer ticker.Stop()
+
+	var srv srvRefresh
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.refreshSRV(&srv)
+			r.refreshTargets()
+		}
+	}
+}
+
+// refreshTargets re-resolves every hostname target once. A target keeps its
+// address when the name still resolves to it, so that a name with several
+// addresses does not move around, and when resolving fails, which is logged
+// once until it succeeds again.
+func (r *Relay) refreshTargets() {
+	r.targetsMu.RLock()
+	targets, settings := r.targetConns, r.settings
+	r.targetsMu.RUnlock()
+
+	for _, tc := range targets {
+		if !isHostnameTarget(tc.target) {
+			continue
+		}
+		same, err := resolvesTo(r.ctx, tc.target, tc.addr)
+		switch {
+		case err != nil && !tc.dnsFailing:
+			slog.Warn("Failed to re-resolve target, keeping its last address", "target", tc.target, "addr", tc.name, "error", err)
+			tc.dnsFailing = true
+		case err == nil && tc.dnsFailing:
+			slog.Info("Target resolves again", "target", tc.target)
+			tc.dnsFailing = false
+		}
+		if err != nil || same {
+			continue
+		}
+
+		replacement, err := newTargetConn(tc.target, r.sockOpts, settings)
+		if err != nil {
+			slog.Warn("Failed to connect to target's new address, keeping its last address", "target", tc.target, "addr", tc.name, "error", err)
+			continue
+		}
+		if !r.replaceTarget(tc, replacement) {
+			replacement.close()
+			continue
+		}
+		slog.Info("Target address changed", "target", tc.target, "old", tc.name, "new", replacement.name)
+	}
+}
+
+// replaceTarget puts replacement in the place of old and closes old. It
+// reports false, changing nothing, if old has been removed in the meantime
+// or replacement's address is already a target.
+func (r *Relay) replaceTarget(old, replacement *targetConn) bool {
+	r.targetsMu.Lock()
+	defer r.targetsMu.Unlock()
+
+	i := -1
+	for j, tc := range r.targetConns {
+		switch {
+		case tc == old:
+			i = j
+		case tc.name == replacement.name:
+			slog.Warn("Target's new address is already a target, keeping its last address", "target", old.target, "addr", old.name, "new", replacement.name)
+			return false
+		}
+	}
+	if i < 0 {
+		return false
+	}
+
+	// The slice may be in use by dispatch, so it is copied, not changed.
+	targets := make([]*targetConn, len(r.targetConns))
+	copy(targets, r.targetConns)
+	targets[i] = replacement
+	r.targetConns = targets
+	r.stats.addTarget(replacement.name)
+	old.close()
+	return true
+}
+
+// isHostnameTarget reports whether target, as written in the configuration,
+// names its host rather than giving an IP address.
+func isHostnameTarget(target string) bool {
+	hostPort, _ := targetHostPort(target)
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil || host == "" {
+		return false
+	}
+	_, err = netip.ParseAddr(host)
+	return err != nil
+}
+
+// resolvesTo reports whether the host of target still resolves to addr's
+// IP, among any others.
+func resolvesTo(ctx context.Context, target string, addr *net.UDPAddr) (bool, error) {
+	hostPort, _ := targetHostPort(target)
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return false, err
+	}
+	current, _ := netip.AddrFromSlice(addr.IP)
+	for _, ip := range ips {
+		if ip.Unmap() == current.Unmap() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
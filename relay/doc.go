@@ -0,0 +1,20 @@
+// Package relay forwards UDP broadcast, multicast and unicast packets
+// received on one or more ports to a list of targets. It is the core of the
+// broadcast-relay command and can be embedded in other programs:
+//
+//	config := relay.DefaultConfig()
+//	config.ListenPorts = relay.PortList{9999}
+//	config.TargetAddrs = []string{"192.168.1.100:9999"}
+//
+//	r, err := relay.NewRelay(config)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	// Run returns once ctx is cancelled.
+//	if err := r.Run(ctx); err != nil {
+//		log.Print(err)
+//	}
+//
+// The relay logs through the default slog logger. Targets can be changed
+// while it runs with AddTarget, RemoveTarget and SetTargets.
+package relay
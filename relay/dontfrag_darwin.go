@@ -0,0 +1,33 @@
+package relay
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets the DF bit on packets sent on conn using IP_DONTFRAG
+// (IPV6_DONTFRAG for IPv6 sockets), so that writes larger than the
+// interface MTU fail with EMSGSIZE.
+func setDontFragment(conn *net.UDPConn) error {
+	level, opt := unix.IPPROTO_IP, unix.IP_DONTFRAG
+	if isIPv6Conn(conn) {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// pathMTU is not available on macOS.
+func pathMTU(conn net.Conn) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets the DF bit on packets sent on conn and makes writes
+// larger than the path MTU fail with EMSGSIZE, using IP_MTU_DISCOVER
+// (IPV6_MTU_DISCOVER for IPv6 sockets).
+func setDontFragment(conn *net.UDPConn) error {
+	level, opt, value := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO
+	if isIPv6Conn(conn) {
+		level, opt, value = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// pathMTU returns the path MTU the kernel knows for conn's destination,
+// from IP_MTU (IPV6_MTU).
+func pathMTU(conn net.Conn) (int, bool) {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	level, opt := unix.IPPROTO_IP, unix.IP_MTU
+	if isIPv6Conn(conn) {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+	var mtu int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		mtu, sockErr = unix.GetsockoptInt(int(fd), level, opt)
+	}); err != nil || sockErr != nil {
+		return 0, false
+	}
+	return mtu, true
+}
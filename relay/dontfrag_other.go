@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+
+package relay
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func setDontFragment(conn *net.UDPConn) error {
+	return fmt.Errorf("-no-fragment is not supported on %s", runtime.GOOS)
+}
+
+func pathMTU(conn net.Conn) (int, bool) {
+	return 0, false
+}
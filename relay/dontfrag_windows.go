@@ -0,0 +1,40 @@
+package relay
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// IP_DONTFRAGMENT and IPV6_DONTFRAG from ws2ipdef.h, which x/sys/windows
+// does not define.
+const (
+	ipDontFragment = 14
+	ipv6DontFrag   = 14
+)
+
+// setDontFragment sets the DF bit on packets sent on conn using
+// IP_DONTFRAGMENT (IPV6_DONTFRAG for IPv6 sockets), so that writes larger
+// than the path MTU fail with WSAEMSGSIZE.
+func setDontFragment(conn *net.UDPConn) error {
+	level, opt := windows.IPPROTO_IP, ipDontFragment
+	if isIPv6Conn(conn) {
+		level, opt = windows.IPPROTO_IPV6, ipv6DontFrag
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = windows.SetsockoptInt(windows.Handle(fd), level, opt, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// pathMTU is not available on Windows.
+func pathMTU(conn net.Conn) (int, bool) {
+	return 0, false
+}
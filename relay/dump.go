@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// dumpQueueSize is the number of payloads that may wait for the -dump-raw
+// writer. Payloads arriving while the queue is full are left out.
+const dumpQueueSize = 1024
+
+// rawDump writes every received payload to a -dump-raw file as a
+// length-prefixed frame, the framing of tcp:// targets, which -replay
+// reads back. Like the pcap writer, it writes on a goroutine of its own.
+type rawDump struct {
+	file     *os.File
+	buf      *bufio.Writer
+	payloads chan []byte
+	quit     chan struct{}
+	done     chan struct{}
+	dropped  atomic.Uint64
+}
+
+func openRawDump(path string) (*rawDump, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raw dump file: %v", err)
+	}
+	d := &rawDump{
+		file:     f,
+		buf:      bufio.NewWriter(f),
+		payloads: make(chan []byte, dumpQueueSize),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d, nil
+}
+
+// add queues a copy of payload.
+func (d *rawDump) add(payload []byte) {
+	select {
+	case d.payloads <- appendFrame(nil, payload):
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+func (d *rawDump) run() {
+	defer close(d.done)
+
+	var failed bool
+	write := func(frame []byte) {
+		if failed {
+			return
+		}
+		if _, err := d.buf.Write(frame); err != nil {
+			slog.Error("Failed to write raw dump file, dump stopped", "error", err)
+			failed = true
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame := <-d.payloads:
+			write(frame)
+		case <-ticker.C:
+			d.buf.Flush()
+		case <-d.quit:
+			for {
+				select {
+				case frame := <-d.payloads:
+					write(frame)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close writes the remaining queued payloads and closes the file.
+func (d *rawDump) close() error {
+	close(d.quit)
+	<-d.done
+	if n := d.dropped.Load(); n > 0 {
+		slog.Warn("Packets left out of the raw dump file because the writer fell behind", "packets", n)
+	}
+	if err := d.buf.Flush(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
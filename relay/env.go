@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is prepended to a flag name, upper-cased and with dashes turned
+// into underscores, to get the environment variable that sets the flag,
+// e.g. RELAY_PORT for -port and RELAY_LOG_FORMAT for -log-format.
+const envPrefix = "RELAY_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag that was not given on the command line from its
+// environment variable. Empty variables are ignored, so that a container
+// spec can leave a setting blank.
+func applyEnv(fs *flag.FlagSet) error {
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || setFlags[f.Name] || f.Name == "version" || f.Name == "service" {
+			return
+		}
+		name := envName(f.Name)
+		value := os.Getenv(name)
+		if value == "" {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s (-%s): %v", value, name, f.Name, setErr)
+		}
+	})
+	return err
+}
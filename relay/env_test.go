@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	for flagName, want := range map[string]string{
+		"port":          "RELAY_PORT",
+		"log-format":    "RELAY_LOG_FORMAT",
+		"dns-refresh":   "RELAY_DNS_REFRESH",
+		"otlp-endpoint": "RELAY_OTLP_ENDPOINT",
+	} {
+		if got := envName(flagName); got != want {
+			t.Errorf("envName(%q) = %q, want %q", flagName, got, want)
+		}
+	}
+}
+
+// TestLoadConfigPrecedence checks, for each of a few settings, that a flag
+// wins over its environment variable, which wins over the config file,
+// which wins over the default.
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "relay.yaml", `
+port: 9000
+dns-refresh: 1m
+targets: [127.0.0.1:9000]
+`)
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		// get picks the setting out of the config, to compare with want.
+		get  func(*Config) any
+		want any
+	}{
+		{"port default", nil, nil, func(c *Config) any { return c.ListenPorts }, PortList{9999}},
+		{"port file", []string{"-config", file}, nil, func(c *Config) any { return c.ListenPorts }, PortList{9000}},
+		{"port env", []string{"-config", file}, map[string]string{"RELAY_PORT": "9001"}, func(c *Config) any { return c.ListenPorts }, PortList{9001}},
+		{"port flag", []string{"-config", file, "-port", "9002"}, map[string]string{"RELAY_PORT": "9001"}, func(c *Config) any { return c.ListenPorts }, PortList{9002}},
+		{"port empty env", []string{"-config", file}, map[string]string{"RELAY_PORT": ""}, func(c *Config) any { return c.ListenPorts }, PortList{9000}},
+
+		{"dns-refresh default", nil, nil, func(c *Config) any { return c.DNSRefresh }, time.Duration(0)},
+		{"dns-refresh file", []string{"-config", file}, nil, func(c *Config) any { return c.DNSRefresh }, time.Minute},
+		{"dns-refresh env", []string{"-config", file}, map[string]string{"RELAY_DNS_REFRESH": "2m"}, func(c *Config) any { return c.DNSRefresh }, 2 * time.Minute},
+		{"dns-refresh flag", []string{"-config", file, "-dns-refresh", "3m"}, map[string]string{"RELAY_DNS_REFRESH": "2m"}, func(c *Config) any { return c.DNSRefresh }, 3 * time.Minute},
+
+		{"targets file", []string{"-config", file}, nil, func(c *Config) any { return c.TargetAddrs }, []string{"127.0.0.1:9000"}},
+		{"targets env", []string{"-config", file}, map[string]string{"RELAY_TARGETS": "127.0.0.1:9001, 127.0.0.1:9002"}, func(c *Config) any { return c.TargetAddrs }, []string{"127.0.0.1:9001", "127.0.0.1:9002"}},
+		{"targets flag", []string{"-config", file, "-targets", "127.0.0.1:9003"}, map[string]string{"RELAY_TARGETS": "127.0.0.1:9001"}, func(c *Config) any { return c.TargetAddrs }, []string{"127.0.0.1:9003"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.args
+			if args == nil {
+				args = []string{"-targets", "127.0.0.1:9000"}
+			}
+			config, err := LoadConfig(args)
+			if err != nil {
+				t.Fatalf("LoadConfig(%q): %v", args, err)
+			}
+			if got := tt.get(config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvErrors(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"RELAY_PORT", "abc", `invalid value "abc" for RELAY_PORT (-port): `},
+		{"RELAY_DNS_REFRESH", "soon", `invalid value "soon" for RELAY_DNS_REFRESH (-dns-refresh): `},
+		{"RELAY_REUSEPORT", "maybe", `invalid value "maybe" for RELAY_REUSEPORT (-reuseport): `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := LoadConfig([]string{"-targets", "127.0.0.1:9000"})
+			if err == nil {
+				t.Fatalf("LoadConfig with %s=%s succeeded, want an error", tt.name, tt.value)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+			if !errors.Is(err, ErrConfig) {
+				t.Errorf("error %q is not ErrConfig", err)
+			}
+		})
+	}
+
+	// A flag given on the command line is not read from the environment,
+	// however malformed the variable.
+	t.Setenv("RELAY_PORT", "abc")
+	if _, err := LoadConfig([]string{"-targets", "127.0.0.1:9000", "-port", "9001"}); err != nil {
+		t.Errorf("LoadConfig with -port and a malformed RELAY_PORT: %v", err)
+	}
+}
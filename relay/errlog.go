@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errorLog throttles the logs of repeated errors under -error-log-interval:
+// the first of an error, by message, target and error text, is logged, and
+// the repeats within the interval are only counted, for a summary at its
+// end. The errors are counted in the stats either way.
+type errorLog struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[errorKey]*errorEntry
+}
+
+type errorKey struct {
+	msg, target, err string
+}
+
+type errorEntry struct {
+	logged     time.Time
+	suppressed int
+}
+
+func newErrorLog(interval time.Duration) *errorLog {
+	return &errorLog{interval: interval, entries: make(map[errorKey]*errorEntry)}
+}
+
+// allow reports whether the error key occurred for is to be logged now.
+func (l *errorLog) allow(key errorKey, now time.Time) bool {
+	if l.interval <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := l.entries[key]
+	if entry == nil {
+		l.entries[key] = &errorEntry{logged: now}
+		return true
+	}
+	if now.Sub(entry.logged) >= l.interval && entry.suppressed == 0 {
+		entry.logged = now
+		return true
+	}
+	entry.suppressed++
+	return false
+}
+
+// flush logs a summary of the errors suppressed since the last one, and
+// forgets the errors that have stopped, so that they are logged at once if
+// they recur.
+func (l *errorLog) flush(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, entry := range l.entries {
+		switch {
+		case entry.suppressed > 0:
+			attrs := []any{"message", key.msg}
+			if key.target != "" {
+				attrs = append(attrs, "target", key.target)
+			}
+			if key.err != "" {
+				attrs = append(attrs, "error", key.err)
+			}
+			attrs = append(attrs, "suppressed", entry.suppressed, "interval", l.interval)
+			slog.Error("Repeated errors were not logged", attrs...)
+			entry.logged, entry.suppressed = now, 0
+		case now.Sub(entry.logged) >= l.interval:
+			delete(l.entries, key)
+		}
+	}
+}
+
+// logError logs an error, for target if it is not empty, unless the same
+// one was logged within -error-log-interval.
+func (r *Relay) logError(msg, target string, err error, attrs ...any) {
+	key := errorKey{msg: msg, target: target}
+	if err != nil {
+		key.err = err.Error()
+	}
+	if !r.errorLog.allow(key, time.Now()) {
+		return
+	}
+	if target != "" {
+		attrs = append(attrs, "target", target)
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	slog.Error(msg, attrs...)
+}
+
+// errorLogFlusher summarizes the suppressed errors every
+// -error-log-interval, and once more when the relay stops.
+func (r *Relay) errorLogFlusher() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.errorLog.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			r.errorLog.flush(time.Now())
+			return
+		case now := <-ticker.C:
+			r.errorLog.flush(now)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package relay
+
+import "errors"
+
+// ErrConfig and ErrBind classify the errors of LoadConfig and NewRelay for
+// callers that react to them differently: errors.Is(err, ErrConfig) means
+// the configuration is invalid, including targets that do not resolve, and
+// errors.Is(err, ErrBind) that a listen socket or HTTP server could not be
+// set up. Other errors happened at run time.
+var (
+	ErrConfig = errors.New("invalid configuration")
+	ErrBind   = errors.New("failed to bind")
+)
+
+// ErrTargetResolve is wrapped by the errors of targets whose address, or
+// SRV records, could not be looked up.
+var ErrTargetResolve = errors.New("failed to resolve target")
+
+// A TargetError is the error of NewRelay, Reload, SetTargets or AddTarget
+// for a target that could not be resolved or connected to.
+type TargetError struct {
+	// Target is the target as configured.
+	Target string
+	Err    error
+}
+
+func (e *TargetError) Error() string { return e.Err.Error() }
+func (e *TargetError) Unwrap() error { return e.Err }
+
+// A BindError is the error of NewRelay for a listen socket or HTTP server
+// that could not be set up. It is an ErrBind error.
+type BindError struct {
+	// Addr is the listen address, as host:port.
+	Addr string
+	Err  error
+}
+
+func (e *BindError) Error() string   { return e.Err.Error() }
+func (e *BindError) Unwrap() []error { return []error{ErrBind, e.Err} }
+
+// classifiedError marks err as belonging to class without changing its
+// message.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string   { return e.err.Error() }
+func (e *classifiedError) Unwrap() []error { return []error{e.class, e.err} }
+
+// classify marks err, unless nil, as a class error.
+func classify(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
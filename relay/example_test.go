@@ -0,0 +1,54 @@
+package relay_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/k0ngk0ng/broadcast-relay/relay"
+)
+
+func ExampleNewRelay() {
+	// A target to forward to, standing in for a host on the network.
+	target, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer target.Close()
+
+	config := relay.DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = relay.PortList{39999}
+	config.TargetAddrs = []string{target.LocalAddr().String()}
+	r, err := relay.NewRelay(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.Start(context.Background())
+
+	src, err := net.Dial("udp4", "127.0.0.1:39999")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+	src.Write([]byte("hello"))
+
+	buf := make([]byte, 1500)
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := target.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("target got %q\n", buf[:n])
+
+	r.Stop()
+	snap := r.Snapshot()
+	fmt.Println("packets forwarded:", snap.PacketsForwarded)
+	fmt.Println("targets:", len(snap.TargetAddrs))
+	// Output:
+	// target got "hello"
+	// packets forwarded: 1
+	// targets: 1
+}
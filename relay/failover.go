@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// failover picks the targets of each packet in failover mode. The targets
+// are in priority order, as configured: the active one is the first that is
+// up, neither refusing packets nor with an open circuit breaker, and it is
+// sent every packet. When it goes down, the next one up takes over at once.
+// A target before the active one that comes back up is sent a copy of every
+// packet for -failback-delay before it takes over again, and going down in
+// that time starts the wait anew, so that a flapping target does not take
+// the traffic back and forth. The targets before the active one that are
+// down are sent a copy of a packet whenever they are due for a probe, which
+// is how they are seen to come back.
+type failover struct {
+	mu     sync.Mutex
+	active *targetConn
+	// pending is the target before the active one that came back up, and
+	// since when it has been up.
+	pending *targetConn
+	since   time.Time
+	// none is set while no target is up.
+	none bool
+}
+
+// up reports whether target is up in the sense of failover mode.
+func (t *targetConn) up() bool {
+	return !t.health.down() && t.breaker.closed()
+}
+
+// due reports whether a packet to target would be let through now, as the
+// probe of a down target or open breaker.
+func (t *targetConn) due(now time.Time) bool {
+	return t.health.allow(now) && t.breaker.ready(now)
+}
+
+// pick returns the targets to send a packet to among targets: the active
+// one, and the ones before it taking over from it or due for a probe. While
+// no target is up, those due for a probe are picked, or else the first, for
+// the packet to be counted as an error there. The packet's source src,
+// unless nil, is never picked.
+func (f *failover) pick(src *net.UDPAddr, targets []*targetConn, now time.Time, delay time.Duration) []*targetConn {
+	var first *targetConn
+	for _, target := range targets {
+		if target.up() {
+			first = target
+			break
+		}
+	}
+	active := f.update(targets, first, now, delay)
+
+	var picked []*targetConn
+	var fallback *targetConn
+	for _, target := range targets {
+		if src != nil && target.udp() && sameUDPAddr(src, target.addr) {
+			if target == active {
+				break
+			}
+			continue
+		}
+		if fallback == nil {
+			fallback = target
+		}
+		if target == active {
+			picked = append(picked, target)
+			break
+		}
+		if target.up() || target.due(now) {
+			picked = append(picked, target)
+		}
+	}
+	if active == nil && len(picked) == 0 && fallback != nil {
+		picked = append(picked, fallback)
+	}
+	return picked
+}
+
+// update moves the active target on, given the first of targets that is
+// up, and returns it.
+func (f *failover) update(targets []*targetConn, first *targetConn, now time.Time, delay time.Duration) *targetConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.active
+	switch {
+	case old == nil || !old.up() || !slices.Contains(targets, old):
+		f.active, f.pending = first, nil
+		switch {
+		case old != nil && first == nil:
+			slog.Warn("No target is up to fail over to", "target", old.name)
+			f.none = true
+		case old != nil:
+			slog.Warn("Active target is down or removed, failing over", "from", old.name, "to", first.name)
+		case first != nil && f.none:
+			slog.Info("Target is up again, forwarding to it", "target", first.name)
+			f.none = false
+		}
+	case first != old:
+		// first comes before the active target, and has come back.
+		if f.pending != first {
+			f.pending, f.since = first, now
+		}
+		if now.Sub(f.since) >= delay {
+			slog.Info("Failing back to a recovered target", "from", old.name, "to", first.name)
+			f.active, f.pending = first, nil
+		}
+	default:
+		f.pending = nil
+	}
+	return f.active
+}
+
+// current returns the active target, nil if there is none.
+func (f *failover) current() *targetConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// markActive marks the active targets of failover mode in snap: the one
+// of all targets, and the one of each route.
+func (r *Relay) markActive(snap *StatsSnapshot) {
+	failovers := []*failover{&r.failover}
+	if routes := r.routes.Load(); routes != nil {
+		for _, route := range routes.routes {
+			failovers = append(failovers, &route.failover)
+		}
+	}
+	targets := r.targets()
+	for _, f := range failovers {
+		active := f.current()
+		if active == nil || !slices.Contains(targets, active) {
+			continue
+		}
+		if ts, ok := snap.Targets[active.name]; ok {
+			ts.Active = true
+			snap.Targets[active.name] = ts
+		}
+	}
+}
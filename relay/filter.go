@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// HexList is a comma-separated list of hex-encoded byte strings, such as
+// the payload prefixes given to -match-prefix and -drop-prefix. An optional
+// 0x in front of each item is accepted.
+type HexList [][]byte
+
+func parseHexList(items []string) (HexList, error) {
+	var list HexList
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		b, err := decodeHex(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex prefix %q: %v", item, err)
+		}
+		if len(b) == 0 {
+			return nil, fmt.Errorf("invalid hex prefix %q: empty", item)
+		}
+		list = append(list, b)
+	}
+	return list, nil
+}
+
+// decodeHex decodes a hex string with an optional 0x in front.
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	return hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+}
+
+func (l *HexList) String() string {
+	items := make([]string, len(*l))
+	for i, b := range *l {
+		items[i] = hex.EncodeToString(b)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *HexList) Set(value string) error {
+	list, err := parseHexList(strings.Split(value, ","))
+	if err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// Regexp is a regular expression, such as -match-regexp, compiled when it
+// is set so that an invalid pattern is rejected with the flags. The zero
+// Regexp is unset; setting it to "" unsets it.
+type Regexp struct{ *regexp.Regexp }
+
+func (r *Regexp) String() string {
+	if r == nil || r.Regexp == nil {
+		return ""
+	}
+	return r.Regexp.String()
+}
+
+func (r *Regexp) Set(value string) error {
+	if value == "" {
+		r.Regexp = nil
+		return nil
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	r.Regexp = re
+	return nil
+}
+
+func hasAnyPrefix(data []byte, prefixes HexList) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterReason reports why a received packet should not be forwarded, or
+// "" if it passes every filter. It does not allocate.
+func (r *Relay) filterReason(src *net.UDPAddr, data []byte) string {
+	switch {
+	case r.isOwnPacket(src):
+		return "sent by this relay"
+	case r.config.MinSize > 0 && len(data) < r.config.MinSize:
+		return "smaller than -min-size"
+	case r.config.MaxSize > 0 && len(data) > r.config.MaxSize:
+		return "larger than -max-size"
+	case len(r.config.MatchPrefixes) > 0 && !hasAnyPrefix(data, r.config.MatchPrefixes):
+		return "does not match -match-prefix"
+	case hasAnyPrefix(data, r.config.DropPrefixes):
+		return "matches -drop-prefix"
+	case r.config.MatchRegexp.Regexp != nil && !r.config.MatchRegexp.Match(data):
+		return "does not match -match-regexp"
+	case r.routes.Load().unrouted(src, data):
+		return "matches no route"
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// handleHealthz reports that the process is alive.
+func (r *Relay) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+// handleReadyz reports whether the relay is receiving and has somewhere to
+// forward to, with 503 and the reason if not.
+func (r *Relay) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := r.ready(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %v\n", err)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+func (r *Relay) ready() error {
+	if !r.running.Load() {
+		return errors.New("relay is not running")
+	}
+	if err := r.listenError(); err != nil {
+		return err
+	}
+	if len(r.targets()) == 0 {
+		return errors.New("no targets")
+	}
+	return nil
+}
+
+// setListenError records the outcome of the last read from l; nil clears
+// an earlier error.
+func (r *Relay) setListenError(l *listener, err error) {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	l.err = err
+}
+
+// listenError returns the error of the first listen socket whose last read
+// failed.
+func (r *Relay) listenError() error {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	for _, l := range r.listeners {
+		if l.err != nil {
+			return fmt.Errorf("listen socket on port %d: %v", l.port, l.err)
+		}
+	}
+	return nil
+}
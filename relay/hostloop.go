@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// hostAddrsRefresh is how often -host-loop-guard re-reads the host's
+// addresses, which change as interfaces come and go or get new leases.
+const hostAddrsRefresh = 30 * time.Second
+
+// hostAddrs is the set of this host's IP addresses, loopback ones included.
+type hostAddrs map[netip.Addr]struct{}
+
+// localHostAddrs returns the addresses of every interface of this host.
+func localHostAddrs() (hostAddrs, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the host's addresses: %v", err)
+	}
+	set := make(hostAddrs, len(addrs))
+	for _, a := range addrs {
+		if prefix, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(prefix.IP); ok {
+				set[ip.Unmap()] = struct{}{}
+			}
+		}
+	}
+	return set, nil
+}
+
+// has reports whether ip is one of the host's addresses.
+func (h hostAddrs) has(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	_, ok = h[addr.Unmap().WithZone("")]
+	return ok
+}
+
+// isHostPort reports, under -host-loop-guard, whether addr is one of the
+// relay's listen ports on any address of this host, so that a packet sent
+// there would come straight back.
+func (r *Relay) isHostPort(addr *net.UDPAddr) bool {
+	host := r.hostAddrs.Load()
+	return host != nil && slices.Contains(r.config.ListenPorts, addr.Port) && host.has(addr.IP)
+}
+
+// withoutHostPorts returns targets without those isHostPort reports, for
+// balance and failover mode to never choose one. It returns targets itself
+// when there are none.
+func (r *Relay) withoutHostPorts(targets []*targetConn) []*targetConn {
+	if r.hostAddrs.Load() == nil {
+		return targets
+	}
+	i := slices.IndexFunc(targets, func(target *targetConn) bool {
+		return target.udp() && r.isHostPort(target.addr)
+	})
+	if i < 0 {
+		return targets
+	}
+	kept := slices.Clone(targets[:i])
+	for _, target := range targets[i+1:] {
+		if !target.udp() || !r.isHostPort(target.addr) {
+			kept = append(kept, target)
+		}
+	}
+	return kept
+}
+
+// hostAddrsWatcher keeps the -host-loop-guard addresses up to date.
+func (r *Relay) hostAddrsWatcher() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(hostAddrsRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.refreshHostAddrs()
+		}
+	}
+}
+
+// refreshHostAddrs re-reads the host's addresses, keeping the last ones if
+// that fails.
+func (r *Relay) refreshHostAddrs() {
+	addrs, err := localHostAddrs()
+	if err != nil {
+		slog.Warn("Keeping the last host addresses for -host-loop-guard", "error", err)
+		return
+	}
+	r.hostAddrs.Store(&addrs)
+}
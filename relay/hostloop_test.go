@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freePort returns a UDP port of 127.0.0.1 that was free a moment ago.
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn := listenTarget(t, "udp4", "127.0.0.1:0")
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// TestPickSkipsHostPorts checks that balance and failover mode, like
+// fan-out, never forward to the relay's own listen port under
+// -host-loop-guard, even where it would be the first target.
+func TestPickSkipsHostPorts(t *testing.T) {
+	for _, mode := range []string{ModeBalance, ModeFailover} {
+		t.Run(mode, func(t *testing.T) {
+			target := listenTarget(t, "udp4", "127.0.0.1:0")
+			port := freePort(t)
+			config := DefaultConfig()
+			config.Mode = mode
+			config.HostLoopGuard = true
+			config.TargetAddrs = []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), target.LocalAddr().String()}
+			config.ListenAddr = "127.0.0.1"
+			config.ListenPorts = PortList{port}
+			r, err := NewRelay(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Start(context.Background())
+			defer r.Stop()
+
+			src, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			const count = 4
+			for i := 0; i < count; i++ {
+				if _, err := src.Write(testPayload(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			buf := make([]byte, 2048)
+			for i := 0; i < count; i++ {
+				target.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := target.Read(buf); err != nil {
+					t.Fatalf("target got %d of %d packets: %v", i, count, err)
+				}
+			}
+			if ts := r.snapshot().Targets[config.TargetAddrs[0]]; ts.PacketsForwarded != 0 || ts.Errors != 0 {
+				t.Errorf("own listen port was picked: %+v", ts)
+			}
+		})
+	}
+}
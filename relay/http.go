@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// httpServer is one HTTP listener. Endpoints configured with the same
+// address share a server.
+type httpServer struct {
+	addr   string
+	paths  []string
+	mux    *http.ServeMux
+	ln     net.Listener
+	server *http.Server
+	// h2c is set when the server has a gRPC endpoint, so that it accepts
+	// HTTP/2 without TLS.
+	h2c bool
+}
+
+// handle registers handler for pattern on the HTTP server for addr,
+// creating the server on first use.
+func (r *Relay) handle(addr, pattern string, handler http.HandlerFunc) *httpServer {
+	var srv *httpServer
+	for _, s := range r.httpServers {
+		if s.addr == addr {
+			srv = s
+			break
+		}
+	}
+	if srv == nil {
+		srv = &httpServer{addr: addr, mux: http.NewServeMux()}
+		r.httpServers = append(r.httpServers, srv)
+	}
+	srv.mux.HandleFunc(pattern, handler)
+	srv.paths = append(srv.paths, pattern)
+	return srv
+}
+
+// listenHTTP opens the listeners of all registered HTTP servers so that
+// address errors are reported before the relay starts.
+func (r *Relay) listenHTTP() error {
+	for _, srv := range r.httpServers {
+		ln, err := net.Listen("tcp", srv.addr)
+		if err != nil {
+			r.closeHTTP()
+			return &BindError{Addr: srv.addr, Err: fmt.Errorf("failed to listen on HTTP address %s: %v", srv.addr, err)}
+		}
+		srv.ln = ln
+	}
+	return nil
+}
+
+func (r *Relay) closeHTTP() {
+	for _, srv := range r.httpServers {
+		if srv.ln != nil {
+			srv.ln.Close()
+		}
+	}
+}
+
+func (r *Relay) startHTTP() {
+	for _, srv := range r.httpServers {
+		srv.server = &http.Server{
+			Handler:           srv.mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		if srv.h2c {
+			h2s := &http2.Server{}
+			// This only fails on TLS settings, which are not used; it lets
+			// Shutdown close the HTTP/2 connections too.
+			http2.ConfigureServer(srv.server, h2s)
+			srv.server.Handler = h2c.NewHandler(srv.mux, h2s)
+		}
+		slog.Info("Serving HTTP", "paths", srv.paths, "addr", "http://"+srv.ln.Addr().String())
+
+		r.wg.Add(1)
+		go func(srv *httpServer) {
+			defer r.wg.Done()
+			if err := srv.server.Serve(srv.ln); err != nil && err != http.ErrServerClosed {
+				slog.Error("HTTP server error", "addr", srv.addr, "error", err)
+			}
+		}(srv)
+	}
+}
+
+func (r *Relay) stopHTTP() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, srv := range r.httpServers {
+		if srv.server == nil {
+			continue
+		}
+		if err := srv.server.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down HTTP server", "addr", srv.addr, "error", err)
+		}
+	}
+}
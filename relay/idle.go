@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrIdleTimeout is returned by Run when the relay stopped because no
+// packet was received within the idle timeout.
+var ErrIdleTimeout = errors.New("no packets received within the idle timeout")
+
+// ErrMaxLifetime is returned by Run when the relay stopped because it had
+// run for -max-lifetime.
+var ErrMaxLifetime = errors.New("the maximum lifetime was reached")
+
+// Idle returns a channel that is closed once no packet has been received for
+// -idle-timeout. Without an idle timeout it is never closed.
+func (r *Relay) Idle() <-chan struct{} {
+	return r.idle
+}
+
+// idleWatcher closes r.idle when the idle timeout passes without a packet.
+// Instead of resetting a timer for every packet, the receive loops record
+// when they last read one, and the timer is re-armed from that.
+func (r *Relay) idleWatcher() {
+	defer r.wg.Done()
+
+	timeout := r.config.IdleTimeout
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-timer.C:
+			last := time.Unix(0, r.lastReceived.Load())
+			if wait := timeout - time.Since(last); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			slog.Info("No packets received within the idle timeout", "idle_timeout", timeout)
+			close(r.idle)
+			return
+		}
+	}
+}
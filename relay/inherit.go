@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Sockets are inherited with the systemd socket activation protocol: the
+// parent passes them as file descriptors 3 onward, LISTEN_FDS says how many
+// and LISTEN_PID is the process they are meant for. The relay's own
+// restarts, under -max-lifetime or on SIGUSR2, hand over their listen
+// sockets the same way.
+const (
+	ListenFDsStart = 3
+	listenPIDEnv   = "LISTEN_PID"
+	listenFDsEnv   = "LISTEN_FDS"
+	listenNamesEnv = "LISTEN_FDNAMES"
+)
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	// inherited holds the inherited UDP sockets not yet taken by a
+	// listener, by port.
+	inherited map[int]*net.UDPConn
+)
+
+// loadInherited takes the sockets passed by the parent process, once, and
+// clears the environment variables so that they do not reach processes the
+// relay starts.
+func loadInherited() {
+	inheritOnce.Do(func() {
+		pid, fds := os.Getenv(listenPIDEnv), os.Getenv(listenFDsEnv)
+		os.Unsetenv(listenPIDEnv)
+		os.Unsetenv(listenFDsEnv)
+		os.Unsetenv(listenNamesEnv)
+		if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		n, err := strconv.Atoi(fds)
+		if err != nil || n < 1 {
+			slog.Warn("Ignoring invalid "+listenFDsEnv, "value", fds)
+			return
+		}
+
+		inherited = make(map[int]*net.UDPConn, n)
+		for fd := ListenFDsStart; fd < ListenFDsStart+n; fd++ {
+			conn, err := inheritedConn(fd)
+			if err != nil {
+				slog.Warn("Ignoring inherited socket", "fd", fd, "error", err)
+				continue
+			}
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			if _, ok := inherited[port]; ok {
+				slog.Warn("Ignoring inherited socket, another one has the same port", "fd", fd, "port", port)
+				conn.Close()
+				continue
+			}
+			inherited[port] = conn
+		}
+	})
+}
+
+// inheritedConn turns the inherited file descriptor fd into a UDP socket.
+func inheritedConn(fd int) (*net.UDPConn, error) {
+	f := os.NewFile(uintptr(fd), "fd "+strconv.Itoa(fd))
+	if f == nil {
+		return nil, fmt.Errorf("not a valid file descriptor")
+	}
+	// FilePacketConn works on a duplicate.
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("not a UDP socket")
+	}
+	return conn, nil
+}
+
+// takeInherited returns the inherited socket for port, or nil if there is
+// none.
+func takeInherited(port int) *net.UDPConn {
+	loadInherited()
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	conn := inherited[port]
+	delete(inherited, port)
+	return conn
+}
+
+// closeInherited closes the inherited sockets no listener took.
+func closeInherited() {
+	loadInherited()
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	for port, conn := range inherited {
+		slog.Warn("Closing inherited socket, the relay does not listen on its port", "addr", conn.LocalAddr())
+		conn.Close()
+		delete(inherited, port)
+	}
+}
+
+// ListenFiles returns duplicates of the relay's listen sockets, in the
+// order of its listen ports, for a process that takes over from it to
+// inherit: they stay open when the relay stops, and packets arriving in
+// between wait in them. The caller closes them.
+func (r *Relay) ListenFiles() ([]*os.File, error) {
+	var files []*os.File
+	for _, l := range r.listeners {
+		if l.conn == nil {
+			continue
+		}
+		f, err := l.conn.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("failed to duplicate the socket for port %d: %v", l.port, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,45 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"text/tabwriter"
+)
+
+// ListInterfaces writes the network interfaces to w, one line per address
+// with the interface name, its flags, the address and, for IPv4 subnets that
+// have one, the directed broadcast address. Empty columns are "-", so every
+// line has four whitespace-separated fields after the header. Interfaces are
+// listed in system order, their addresses as the system reports them.
+func ListInterfaces(w io.Writer) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tFLAGS\tADDRESS\tBROADCAST")
+	for _, ifi := range ifaces {
+		flags := ifi.Flags.String()
+		if flags == "0" {
+			flags = "-"
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return fmt.Errorf("interface %s: %v", ifi.Name, err)
+		}
+		if len(addrs) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\n", ifi.Name, flags)
+			continue
+		}
+		for _, addr := range addrs {
+			bcast := "-"
+			if ip := subnetBroadcast(addr); ip != nil && ifi.Flags&net.FlagBroadcast != 0 {
+				bcast = ip.String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ifi.Name, flags, addr, bcast)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// HexBytes is a byte string given in hex, with an optional 0x in front,
+// such as the -keepalive-payload.
+type HexBytes []byte
+
+func (b HexBytes) String() string {
+	return hex.EncodeToString(b)
+}
+
+// Set implements flag.Value.
+func (b *HexBytes) Set(s string) error {
+	decoded, err := decodeHex(s)
+	if err != nil {
+		return fmt.Errorf("invalid hex %q: %v", s, err)
+	}
+	*b = decoded
+	return nil
+}
+
+// keepaliveLoop sends the -keepalive-interval heartbeats until the relay
+// stops. It checks four times per interval, so that a target is sent one
+// at most a quarter of the interval late, and at most every millisecond.
+func (r *Relay) keepaliveLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(max(r.config.KeepaliveInterval/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.sendKeepalives(now)
+		}
+	}
+}
+
+// sendKeepalives sends a heartbeat to every target that has been sent
+// nothing for -keepalive-interval, the relay's uptime counting as such for
+// those never sent anything. Broadcast addresses and Unix sockets, which
+// have no state in between to keep, and targets down and not due for a
+// probe are left out.
+func (r *Relay) sendKeepalives(now time.Time) {
+	interval := r.config.KeepaliveInterval
+	for _, target := range r.targets() {
+		if target.opts.broadcast || target.unix != nil {
+			continue
+		}
+		last := max(target.lastSent.Load(), r.started.Load())
+		if now.Sub(time.Unix(0, last)) < interval || !target.health.allow(now) {
+			continue
+		}
+		err := target.heartbeat(r.config.KeepalivePayload)
+		if errors.Is(err, errTargetClosed) {
+			continue
+		}
+		r.recordHealth(target, err, now)
+		if err != nil {
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				r.logError("Failed to send keepalive", target.name, err)
+			}
+			continue
+		}
+		target.lastSent.Store(now.UnixNano())
+		r.stats.AddKeepalive(target.name)
+	}
+}
+
+// heartbeat writes data to the target as it is, outside of any -coalesce
+// batch.
+func (t *targetConn) heartbeat(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errTargetClosed
+	}
+	_, err := t.writeLocked(data)
+	return err
+}
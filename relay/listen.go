@@ -0,0 +1,169 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrPortInUse is wrapped by the error NewRelay returns when a listen port is
+// already in use.
+var ErrPortInUse = errors.New("listen port already in use")
+
+// portInUseError turns a failed bind of port into an error that says what to
+// do about it.
+func portInUseError(port int, reusePort bool) error {
+	if reusePort {
+		return fmt.Errorf("%w: UDP port %d is bound by a socket without SO_REUSEPORT; stop the other process or choose a different -port", ErrPortInUse, port)
+	}
+	return fmt.Errorf("%w: another process is bound to UDP port %d; stop it, choose a different -port, or pass -reuseport to every relay sharing the port", ErrPortInUse, port)
+}
+
+// listenUDP opens the listen socket. With reusePort, SO_REUSEADDR and
+// SO_REUSEPORT are set first so that several relays can bind the same port.
+func listenUDP(network string, addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listener is one listen socket. Every listener has its own receive loop,
+// and all of them feed the same forwarding queue. With -replay, listeners
+// have no socket and only stand for their port.
+type listener struct {
+	conn   *net.UDPConn
+	port   int
+	groups []multicastGroup
+	// tag is the port as reported in the per-port stats, or empty when
+	// the relay listens on a single port.
+	tag string
+	// countDrops is set when the kernel reports, with the packets read,
+	// how many it dropped on the socket's full receive buffer.
+	countDrops bool
+	// err is the outcome of the last read, guarded by Relay.healthMu.
+	err       error
+	closeOnce sync.Once
+}
+
+// close leaves the multicast groups and closes the socket, which unblocks
+// a pending read. Calling it again has no effect.
+func (l *listener) close() {
+	l.closeOnce.Do(func() {
+		if l.conn == nil {
+			return
+		}
+		if err := leaveMulticastGroups(l.conn, l.groups); err != nil {
+			slog.Warn("Failed to leave multicast groups", "port", l.port, "error", err)
+		}
+		l.conn.Close()
+	})
+}
+
+// PortList is the -port flag: one or more comma-separated UDP ports. In a
+// config file, port is a single number or a list of numbers.
+type PortList []int
+
+func newPortList(ports []int) (PortList, error) {
+	if len(ports) == 0 {
+		return nil, errors.New("no port given")
+	}
+	for i, port := range ports {
+		if port < 0 || port > 65535 {
+			return nil, fmt.Errorf("port %d is out of range 0-65535", port)
+		}
+		if slices.Contains(ports[:i], port) {
+			return nil, fmt.Errorf("port %d is listed twice", port)
+		}
+	}
+	return PortList(ports), nil
+}
+
+func (p PortList) String() string {
+	items := make([]string, len(p))
+	for i, port := range p {
+		items[i] = strconv.Itoa(port)
+	}
+	return strings.Join(items, ",")
+}
+
+// Set implements flag.Value.
+func (p *PortList) Set(s string) error {
+	var ports []int
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		port, err := strconv.Atoi(item)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", item)
+		}
+		ports = append(ports, port)
+	}
+	list, err := newPortList(ports)
+	if err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+func (p *PortList) UnmarshalYAML(value *yaml.Node) error {
+	var ports []int
+	if value.Kind == yaml.SequenceNode {
+		if err := value.Decode(&ports); err != nil {
+			return err
+		}
+	} else {
+		var port int
+		if err := value.Decode(&port); err != nil {
+			return err
+		}
+		ports = []int{port}
+	}
+	list, err := newPortList(ports)
+	if err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+func (p *PortList) UnmarshalJSON(data []byte) error {
+	var ports []int
+	if err := json.Unmarshal(data, &ports); err != nil {
+		var port int
+		if err := json.Unmarshal(data, &port); err != nil {
+			return errors.New("port must be a number or a list of numbers")
+		}
+		ports = []int{port}
+	}
+	list, err := newPortList(ports)
+	if err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewRelayPortInUse(t *testing.T) {
+	taken := listenTarget(t, "udp4", "127.0.0.1:0")
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{port}
+	config.TargetAddrs = []string{"127.0.0.1:9"}
+	relay, err := NewRelay(config)
+	if err == nil {
+		relay.Stop()
+		t.Fatalf("NewRelay on port %d, already bound: no error", port)
+	}
+
+	if !errors.Is(err, ErrBind) {
+		t.Errorf("error %q is not ErrBind", err)
+	}
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("error %q is not ErrPortInUse", err)
+	}
+	var bindErr *BindError
+	if !errors.As(err, &bindErr) {
+		t.Fatalf("error %q is not a *BindError", err)
+	}
+	if want := fmt.Sprintf("127.0.0.1:%d", port); bindErr.Addr != want {
+		t.Errorf("BindError.Addr = %q, want %q", bindErr.Addr, want)
+	}
+	want := fmt.Sprintf("another process is bound to UDP port %d; stop it, choose a different -port, or pass -reuseport", port)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %q, want it to contain %q", err, want)
+	}
+}
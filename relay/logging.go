@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// NewLogger returns the logger for -log-format and -log-level. Both formats
+// are structured: "text" writes key=value pairs, "json" one object per line.
+func NewLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+}
+
+// logAttrs returns the counters as log attributes, with the per-target
+// counters grouped under "targets" and, on relays with several listen
+// ports, the per-port counters under "ports".
+func (s StatsSnapshot) logAttrs() []any {
+	targets := make([]any, 0, len(s.Targets))
+	for _, name := range sortedKeys(s.Targets) {
+		ts := s.Targets[name]
+		attrs := []any{
+			"packets_forwarded", ts.PacketsForwarded,
+			"bytes_forwarded", ts.BytesForwarded,
+			"packets_sampled", ts.PacketsSampled,
+			"packets_chaos_dropped", ts.ChaosDropped,
+			"packets_dropped", ts.PacketsDropped,
+			"errors", ts.Errors,
+			"down", ts.Down,
+		}
+		if ts.Breaker != "" {
+			attrs = append(attrs, "breaker", ts.Breaker)
+		}
+		if ts.Active {
+			attrs = append(attrs, "active", true)
+		}
+		if ts.TooBig > 0 {
+			attrs = append(attrs, "packets_too_big", ts.TooBig)
+		}
+		if ts.Keepalives > 0 {
+			attrs = append(attrs, "keepalives", ts.Keepalives)
+		}
+		if ts.BytesUncompressed > 0 {
+			attrs = append(attrs, "bytes_uncompressed", ts.BytesUncompressed, "bytes_compressed", ts.BytesCompressed)
+		}
+		targets = append(targets, slog.Group(name, attrs...))
+	}
+	attrs := []any{
+		"packets_received", s.PacketsReceived,
+		"bytes_received", s.BytesReceived,
+		"packets_forwarded", s.PacketsForwarded,
+		"bytes_forwarded", s.BytesForwarded,
+		"packets_filtered", s.PacketsFiltered,
+		"packets_duplicate", s.PacketsDuplicate,
+		"packets_rewritten", s.PacketsRewritten,
+		"packets_denied", s.PacketsDenied,
+		"packets_sampled", s.PacketsSampled,
+		"packets_dropped", s.PacketsDropped,
+		"packets_receive_dropped", s.ReceiveDropped,
+		"packets_loop_dropped", s.LoopDropped,
+		"packets_truncated", s.Truncated,
+		"packets_chaos_dropped", s.ChaosDropped,
+		"packets_no_targets", s.NoTargets,
+		"packets_queue_dropped", s.QueueDropped,
+		"packets_kernel_dropped", s.KernelDropped,
+		"packets_too_big", s.TooBig,
+		"queue_depth", s.QueueDepth,
+		"errors", s.Errors,
+		slog.Group("rates",
+			"received_pps", s.Rates.ReceivedPPS,
+			"received_bps", s.Rates.ReceivedBPS,
+			"forwarded_pps", s.Rates.ForwardedPPS,
+			"forwarded_bps", s.Rates.ForwardedBPS,
+		),
+		slog.Group("targets", targets...),
+	}
+	if len(s.Ports) > 0 {
+		ports := make([]any, 0, len(s.Ports))
+		for _, port := range sortedKeys(s.Ports) {
+			ps := s.Ports[port]
+			ports = append(ports, slog.Group(port,
+				"packets_received", ps.PacketsReceived,
+				"bytes_received", ps.BytesReceived,
+			))
+		}
+		attrs = append(attrs, slog.Group("ports", ports...))
+	}
+	return attrs
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+)
+
+// With -loop-guard, packets forwarded to the targets carry a header naming
+// every relay they have passed through:
+//
+//	magic    4 bytes  "BRLG"
+//	version  1 byte   1
+//	count    1 byte   number of relay IDs that follow, 1-32
+//	ids      count × 4 bytes, big-endian relay IDs, oldest first
+//	payload  the original packet
+//
+// A relay with -loop-guard strips the header from the packets it receives
+// and drops those whose IDs include its own. Packets without the header are
+// forwarded as usual, so senders need not know about it.
+const (
+	loopGuardMagic   = "BRLG"
+	loopGuardVersion = 1
+	// maxLoopHops is the most relay IDs a header can hold. A packet that
+	// has passed through that many relays is dropped as a loop too.
+	maxLoopHops   = 32
+	loopHeaderLen = len(loopGuardMagic) + 2
+)
+
+// loopGuard adds and checks the loop-guard header for the relay with the
+// given ID.
+type loopGuard struct {
+	id uint32
+}
+
+// newRelayID returns a random nonzero relay ID, for relays that were not
+// given one with -relay-id.
+func newRelayID() uint32 {
+	for {
+		if id := rand.Uint32(); id != 0 {
+			return id
+		}
+	}
+}
+
+// strip removes the loop-guard header from data. It returns the payload and
+// the relay IDs from the header, still encoded, or the reason to drop the
+// packet. Data without a header is returned as is.
+func (g loopGuard) strip(data []byte) (payload, hops []byte, reason string) {
+	if !bytes.HasPrefix(data, []byte(loopGuardMagic)) {
+		return data, nil, ""
+	}
+	end, ok := loopHeaderEnd(data)
+	if !ok {
+		return nil, nil, "malformed -loop-guard header"
+	}
+	count := int(data[len(loopGuardMagic)+1])
+	hops = data[loopHeaderLen:end]
+	for i := 0; i < len(hops); i += 4 {
+		if binary.BigEndian.Uint32(hops[i:]) == g.id {
+			return nil, nil, "loop: already forwarded by this relay"
+		}
+	}
+	if count >= maxLoopHops {
+		return nil, nil, "loop: too many relay hops"
+	}
+	return data[end:], hops, ""
+}
+
+// loopHeaderEnd returns the length of the loop-guard header data starts
+// with, or false if the header is malformed.
+func loopHeaderEnd(data []byte) (int, bool) {
+	if len(data) < loopHeaderLen || data[len(loopGuardMagic)] != loopGuardVersion {
+		return 0, false
+	}
+	count := int(data[len(loopGuardMagic)+1])
+	end := loopHeaderLen + 4*count
+	if count == 0 || len(data) < end {
+		return 0, false
+	}
+	return end, true
+}
+
+// mark appends to dst the header with hops and this relay's ID, followed by
+// payload.
+func (g loopGuard) mark(dst, hops, payload []byte) []byte {
+	dst = append(dst, loopGuardMagic...)
+	dst = append(dst, loopGuardVersion, byte(len(hops)/4+1))
+	dst = append(dst, hops...)
+	dst = binary.BigEndian.AppendUint32(dst, g.id)
+	return append(dst, payload...)
+}
@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// relayMetric is a metric of both /metrics and the OTLP export. Its name is
+// the OpenTelemetry one, e.g. relay.packets.received; on /metrics the dots
+// are underscores and counters end in _total, relay_packets_received_total.
+type relayMetric struct {
+	name, unit, help string
+	gauge            bool
+	// Exactly one of total, target and port gives the metric's values: one
+	// for the relay, one per target, or one per listen port, the latter
+	// only under several -listen-ports.
+	total  func(r *Relay, snap StatsSnapshot) uint64
+	target func(TargetStats) uint64
+	port   func(PortStats) uint64
+	// when, if set, reports whether the relay has the metric at all.
+	when func(r *Relay) bool
+}
+
+// promName returns the metric's Prometheus name.
+func (m *relayMetric) promName() string {
+	name := strings.ReplaceAll(m.name, ".", "_")
+	if !m.gauge {
+		name += "_total"
+	}
+	return name
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// relayMetrics are the metrics, in the order /metrics lists them.
+var relayMetrics = []relayMetric{
+	{name: "relay.packets.received", unit: "{packet}", help: "Packets received on the listen socket.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.PacketsReceived }},
+	{name: "relay.bytes.received", unit: "By", help: "Bytes received on the listen socket.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.BytesReceived }},
+	{name: "relay.port.packets.received", unit: "{packet}", help: "Packets received, by listen port.",
+		port: func(ps PortStats) uint64 { return ps.PacketsReceived }},
+	{name: "relay.port.bytes.received", unit: "By", help: "Bytes received, by listen port.",
+		port: func(ps PortStats) uint64 { return ps.BytesReceived }},
+	{name: "relay.packets.filtered", unit: "{packet}", help: "Packets not forwarded because of their size or content.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.PacketsFiltered }},
+	{name: "relay.packets.duplicate", unit: "{packet}", help: "Packets suppressed as duplicates by -dedup-window.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.PacketsDuplicate }},
+	{name: "relay.packets.rewritten", unit: "{packet}", help: "Packets whose payload was changed by -rewrite.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.PacketsRewritten }},
+	{name: "relay.packets.denied", unit: "{packet}", help: "Packets not forwarded because of their source address (-allow-src, -deny-src).",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.PacketsDenied }},
+	{name: "relay.packets.forwarded", unit: "{packet}", help: "Packets forwarded, by target.",
+		target: func(ts TargetStats) uint64 { return ts.PacketsForwarded }},
+	{name: "relay.bytes.forwarded", unit: "By", help: "Bytes forwarded, by target.",
+		target: func(ts TargetStats) uint64 { return ts.BytesForwarded }},
+	{name: "relay.packets.receive_dropped", unit: "{packet}", help: "Received packets dropped by -max-receive-rate.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.ReceiveDropped }},
+	{name: "relay.packets.loop_dropped", unit: "{packet}", help: "Received packets dropped by -loop-guard.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.LoopDropped }},
+	{name: "relay.packets.truncated", unit: "{packet}", help: "Received packets that filled the read buffer and were probably truncated (raise -buffer).",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.Truncated }},
+	{name: "relay.packets.no_targets", unit: "{packet}", help: "Received packets not forwarded because every target had been removed.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.NoTargets }},
+	{name: "relay.packets.queue_dropped", unit: "{packet}", help: "Received packets dropped because the forward queue was full.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.QueueDropped }},
+	{name: "relay.packets.kernel_dropped", unit: "{packet}", help: "Packets the kernel dropped because a listen socket's receive buffer was full (Linux; raise -buffer).",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.KernelDropped }},
+	{name: "relay.queue.depth", unit: "{packet}", help: "Received packets waiting for a forwarding worker.", gauge: true,
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return uint64(snap.QueueDepth) }},
+	{name: "relay.queue.capacity", unit: "{packet}", help: "Maximum number of packets the forward queue holds (-max-queue).", gauge: true,
+		total: func(r *Relay, _ StatsSnapshot) uint64 { return uint64(r.config.MaxQueue) }},
+	{name: "relay.packets.dropped", unit: "{packet}", help: "Packets dropped by the rate limit, by target.",
+		target: func(ts TargetStats) uint64 { return ts.PacketsDropped }},
+	{name: "relay.packets.sampled", unit: "{packet}", help: "Packets left out by -sample, by target.",
+		target: func(ts TargetStats) uint64 { return ts.PacketsSampled }},
+	{name: "relay.packets.chaos_dropped", unit: "{packet}", help: "Packets dropped on purpose by -chaos-drop, by target.",
+		target: func(ts TargetStats) uint64 { return ts.ChaosDropped }},
+	{name: "relay.packets.too_big", unit: "{packet}", help: "Forwards that failed because the packet exceeded the path MTU under -no-fragment, by target.",
+		target: func(ts TargetStats) uint64 { return ts.TooBig }},
+	{name: "relay.keepalives", unit: "{packet}", help: "Heartbeats sent under -keepalive-interval, by target.",
+		target: func(ts TargetStats) uint64 { return ts.Keepalives }},
+	{name: "relay.bytes.uncompressed", unit: "By", help: "Bytes forwarded under -compress, before compression, by target.",
+		target: func(ts TargetStats) uint64 { return ts.BytesUncompressed }},
+	{name: "relay.bytes.compressed", unit: "By", help: "Bytes forwarded under -compress, after compression, by target.",
+		target: func(ts TargetStats) uint64 { return ts.BytesCompressed }},
+	{name: "relay.target.up", unit: "1", help: "Whether the target accepts packets (0 while it refuses them), by target.", gauge: true,
+		target: func(ts TargetStats) uint64 { return boolValue(!ts.Down) }},
+	{name: "relay.target.breaker_open", unit: "1", help: "Whether the target's circuit breaker is open (1) or closed (0), by target.", gauge: true,
+		target: func(ts TargetStats) uint64 { return boolValue(ts.Breaker != "") },
+		when:   func(r *Relay) bool { return r.breaker.failures > 0 }},
+	{name: "relay.target.active", unit: "1", help: "Whether the target is the active one of -mode failover (1) or not (0), by target.", gauge: true,
+		target: func(ts TargetStats) uint64 { return boolValue(ts.Active) },
+		when:   func(r *Relay) bool { return r.config.Mode == ModeFailover }},
+	{name: "relay.errors", unit: "{error}", help: "Receive and forwarding errors.",
+		total: func(_ *Relay, snap StatsSnapshot) uint64 { return snap.Errors }},
+	{name: "relay.forward.errors", unit: "{error}", help: "Forwarding errors, by target.",
+		target: func(ts TargetStats) uint64 { return ts.Errors }},
+}
+
+// handleMetrics writes the relay counters in the Prometheus text exposition
+// format. Forwarding counters are only reported per target; sum them for a
+// total.
+func (r *Relay) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	snap := r.snapshot()
+
+	targets := sortedKeys(snap.Targets)
+	ports := sortedKeys(snap.Ports)
+
+	var b strings.Builder
+	for i := range relayMetrics {
+		m := &relayMetrics[i]
+		if m.when != nil && !m.when(r) || m.port != nil && len(ports) == 0 {
+			continue
+		}
+		name, typ := m.promName(), "counter"
+		if m.gauge {
+			typ = "gauge"
+		}
+		writeHeader(&b, name, typ, m.help)
+		switch {
+		case m.total != nil:
+			fmt.Fprintf(&b, "%s %d\n", name, m.total(r, snap))
+		case m.target != nil:
+			for _, target := range targets {
+				writeTargetSample(&b, name, target, m.target(snap.Targets[target]))
+			}
+		case m.port != nil:
+			for _, port := range ports {
+				writeLabeledSample(&b, name, "port", port, m.port(snap.Ports[port]))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+func writeHeader(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeTargetSample(b *strings.Builder, name, target string, value uint64) {
+	writeLabeledSample(b, name, "target", target, value)
+}
+
+func writeLabeledSample(b *strings.Builder, name, label, value string, v uint64) {
+	fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(value), v)
+}
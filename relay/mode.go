@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Input modes select what the listen socket receives.
+const (
+	// InputBroadcast receives broadcast and unicast traffic to the listen
+	// port, plus any -multicast-groups.
+	InputBroadcast = "broadcast"
+	// InputMulticast is for relays fed by multicast groups; it requires
+	// -multicast-groups.
+	InputMulticast = "multicast"
+)
+
+// Output modes select where packets are forwarded.
+const (
+	// OutputUnicast forwards to the configured targets only.
+	OutputUnicast = "unicast"
+	// OutputBroadcast also re-broadcasts on the local subnets, to the
+	// listen port, for example on relays fed by unicast from mesh peers.
+	OutputBroadcast = "broadcast"
+)
+
+// Forwarding modes select how many targets get each packet.
+const (
+	// ModeFanout forwards every packet to every target.
+	ModeFanout = "fanout"
+	// ModeBalance forwards every packet to one target, chosen by weighted
+	// round-robin, to spread the load over replicas.
+	ModeBalance = "balance"
+	// ModeFailover forwards every packet to the first target, in the
+	// configured order, that is up, for a primary with standbys.
+	ModeFailover = "failover"
+)
+
+func validateModes(config *Config) error {
+	switch config.InputMode {
+	case InputBroadcast:
+	case InputMulticast:
+		if len(config.MulticastGroups) == 0 {
+			return fmt.Errorf("-input %s requires -multicast-groups", InputMulticast)
+		}
+	default:
+		return fmt.Errorf("invalid -input %q: must be %s or %s", config.InputMode, InputBroadcast, InputMulticast)
+	}
+
+	switch config.OutputMode {
+	case OutputUnicast:
+	case OutputBroadcast:
+		// The local subnets are broadcast to at the listen port, which
+		// is ambiguous with several.
+		if len(config.ListenPorts) > 1 {
+			return fmt.Errorf("-output %s supports a single -port", OutputBroadcast)
+		}
+	default:
+		return fmt.Errorf("invalid -output %q: must be %s or %s", config.OutputMode, OutputUnicast, OutputBroadcast)
+	}
+
+	switch config.Mode {
+	case ModeFanout, ModeBalance, ModeFailover:
+	default:
+		return fmt.Errorf("invalid -mode %q: must be %s, %s or %s", config.Mode, ModeFanout, ModeBalance, ModeFailover)
+	}
+	return nil
+}
+
+// outputTargets returns the addresses to forward to: the configured targets
+// and, in broadcast output mode, the broadcast address of every local
+// subnet (on -interface, if set) at the listen port.
+func outputTargets(config *Config) ([]string, error) {
+	if config.OutputMode != OutputBroadcast {
+		return config.TargetAddrs, nil
+	}
+
+	ips, err := localBroadcastAddrs(config.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find local broadcast addresses: %v", err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("-output %s: no local interface has an IPv4 broadcast address", OutputBroadcast)
+	}
+
+	targets := append([]string(nil), config.TargetAddrs...)
+	for _, ip := range ips {
+		targets = append(targets, net.JoinHostPort(ip.String(), strconv.Itoa(config.ListenPorts[0])))
+	}
+	return targets, nil
+}
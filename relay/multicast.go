@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// multicastGroup is a group the listen socket has joined.
+type multicastGroup struct {
+	ip    net.IP
+	iface *net.Interface
+}
+
+func (g multicastGroup) String() string {
+	if g.iface == nil {
+		return g.ip.String()
+	}
+	return g.ip.String() + " on " + g.iface.Name
+}
+
+// joinMulticastGroups makes conn a member of each group, on the named
+// interface or, if ifaceName is empty, on the interface the system picks.
+// If any join fails, the groups joined so far are left again.
+func joinMulticastGroups(conn *net.UDPConn, groups []string, ifaceName string) ([]multicastGroup, error) {
+	var iface *net.Interface
+	if ifaceName != "" {
+		ifi, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, fmt.Errorf("unknown multicast interface %s: %v", ifaceName, err)
+		}
+		iface = ifi
+	}
+
+	var joined []multicastGroup
+	for _, group := range groups {
+		ip := net.ParseIP(group)
+		if ip == nil || !ip.IsMulticast() {
+			leaveMulticastGroups(conn, joined)
+			return nil, fmt.Errorf("%s is not a multicast group address", group)
+		}
+
+		g := multicastGroup{ip: ip, iface: iface}
+		var err error
+		if ip.To4() != nil {
+			err = ipv4.NewPacketConn(conn).JoinGroup(iface, &net.UDPAddr{IP: ip})
+		} else {
+			err = ipv6.NewPacketConn(conn).JoinGroup(iface, &net.UDPAddr{IP: ip})
+		}
+		if err != nil {
+			leaveMulticastGroups(conn, joined)
+			return nil, fmt.Errorf("failed to join multicast group %s: %v", g, err)
+		}
+		joined = append(joined, g)
+	}
+	return joined, nil
+}
+
+func leaveMulticastGroups(conn *net.UDPConn, groups []multicastGroup) error {
+	var firstErr error
+	for _, g := range groups {
+		var err error
+		if g.ip.To4() != nil {
+			err = ipv4.NewPacketConn(conn).LeaveGroup(g.iface, &net.UDPAddr{IP: g.ip})
+		} else {
+			err = ipv6.NewPacketConn(conn).LeaveGroup(g.iface, &net.UDPAddr{IP: g.ip})
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to leave multicast group %s: %v", g, err)
+		}
+	}
+	return firstErr
+}
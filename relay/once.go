@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// ErrNotForwarded is returned by Run with -once when the packet could not
+// be forwarded to any target.
+var ErrNotForwarded = errors.New("the packet was not forwarded to any target")
+
+// takeOnce claims the one packet -once handles, reporting false if another
+// receive loop has claimed it already.
+func (r *Relay) takeOnce() bool {
+	return r.onceTaken.CompareAndSwap(false, true)
+}
+
+// finishOnce logs the outcome of the -once packet, forwarded to that many
+// targets, and lets Run return.
+func (r *Relay) finishOnce(pkt *packet, forwarded int) {
+	if forwarded == 0 && !r.config.DryRun {
+		slog.Error("Received a packet but could not forward it", "size", len(pkt.data), "src", pkt.src.String())
+		r.onceErr = ErrNotForwarded
+	} else {
+		slog.Info("Handled one packet, exiting", "size", len(pkt.data), "src", pkt.src.String(), "forwarded", forwarded)
+	}
+	close(r.onceDone)
+}
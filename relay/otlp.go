@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// otlpTimeout bounds the final export when the relay stops.
+const otlpTimeout = 5 * time.Second
+
+// parseOTLPEndpoint returns the URL metrics are posted to for -otlp-endpoint:
+// the endpoint itself if it has a path, /v1/metrics on it otherwise.
+func parseOTLPEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid -otlp-endpoint %q: must be an http:// or https:// URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	return u.String(), nil
+}
+
+// otlpEndpoint returns the collector the metrics are exported to: the one
+// of -otlp-endpoint, else the one of OTEL_EXPORTER_OTLP_METRICS_ENDPOINT or
+// OTEL_EXPORTER_OTLP_ENDPOINT. The export is off if it is empty.
+func otlpEndpoint(config *Config) string {
+	if config.OTLPEndpoint != "" {
+		return config.OTLPEndpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+}
+
+// otlpProtocol returns the OTLP protocol of OTEL_EXPORTER_OTLP_METRICS_PROTOCOL
+// or OTEL_EXPORTER_OTLP_PROTOCOL, http/protobuf by default.
+func otlpProtocol() (string, error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	switch protocol {
+	case "", "http/protobuf":
+		return "http/protobuf", nil
+	case "grpc":
+		return "grpc", nil
+	}
+	return "", fmt.Errorf("unsupported OTLP protocol %q: must be http/protobuf or grpc", protocol)
+}
+
+// newOTLPExporter returns the exporter for the protocol, sending to
+// -otlp-endpoint if it is set. The SDK reads the other OTEL_EXPORTER_OTLP_*
+// variables, such as the endpoint and headers, and retries failed exports
+// with backoff.
+func newOTLPExporter(ctx context.Context, config *Config) (sdkmetric.Exporter, error) {
+	protocol, err := otlpProtocol()
+	if err != nil {
+		return nil, err
+	}
+	if protocol == "grpc" {
+		var opts []otlpmetricgrpc.Option
+		if config.OTLPEndpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpointURL(config.OTLPEndpoint))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	}
+	var opts []otlpmetrichttp.Option
+	if config.OTLPEndpoint != "" {
+		u, _ := parseOTLPEndpoint(config.OTLPEndpoint)
+		opts = append(opts, otlpmetrichttp.WithEndpointURL(u))
+	}
+	return otlpmetrichttp.New(ctx, opts...)
+}
+
+// loggedExporter logs the first of consecutive failed exports, once the
+// SDK has given up retrying it, and the export that succeeds after them.
+type loggedExporter struct {
+	sdkmetric.Exporter
+	endpoint string
+	failing  atomic.Bool
+}
+
+func (e *loggedExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := e.Exporter.Export(ctx, rm)
+	switch {
+	case err != nil && !e.failing.Swap(true):
+		slog.Warn("Failed to export metrics over OTLP, will retry", "endpoint", e.endpoint, "error", err)
+	case err == nil && e.failing.Swap(false):
+		slog.Info("Exporting metrics over OTLP again", "endpoint", e.endpoint)
+	}
+	// The metrics are cumulative, so the next export makes up for this one;
+	// the error is not handed on for the SDK to log every time.
+	return nil
+}
+
+// startOTLP starts exporting the metrics of relayMetrics every
+// -otlp-interval, from a meter provider; its Shutdown exports them a last
+// time.
+func (r *Relay) startOTLP(endpoint string) (*sdkmetric.MeterProvider, error) {
+	ctx := context.Background()
+	exp, err := newOTLPExporter(ctx, r.config)
+	if err != nil {
+		return nil, err
+	}
+	// Later options take precedence: OTEL_RESOURCE_ATTRIBUTES and
+	// OTEL_SERVICE_NAME over the relay's own attributes.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", "broadcast-relay"),
+			attribute.String("service.version", Version),
+		),
+		resource.WithHost(),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		// The resource has the attributes that could be found.
+		slog.Warn("Incomplete OTLP resource attributes", "error", err)
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(&loggedExporter{Exporter: exp, endpoint: endpoint},
+			sdkmetric.WithInterval(r.config.OTLPInterval))),
+	)
+	if err := r.registerOTLPMetrics(provider.Meter("github.com/k0ngk0ng/broadcast-relay/relay",
+		metric.WithInstrumentationVersion(Version))); err != nil {
+		provider.Shutdown(ctx)
+		return nil, err
+	}
+	return provider, nil
+}
+
+// registerOTLPMetrics creates an observable instrument for each of
+// relayMetrics, and a callback that observes them all from one snapshot
+// at every export.
+func (r *Relay) registerOTLPMetrics(meter metric.Meter) error {
+	instruments := make([]metric.Int64Observable, len(relayMetrics))
+	observables := make([]metric.Observable, len(relayMetrics))
+	for i := range relayMetrics {
+		m := &relayMetrics[i]
+		var err error
+		if m.gauge {
+			instruments[i], err = meter.Int64ObservableGauge(m.name, metric.WithUnit(m.unit), metric.WithDescription(m.help))
+		} else {
+			instruments[i], err = meter.Int64ObservableCounter(m.name, metric.WithUnit(m.unit), metric.WithDescription(m.help))
+		}
+		if err != nil {
+			return err
+		}
+		observables[i] = instruments[i]
+	}
+	_, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		snap := r.snapshot()
+		for i := range relayMetrics {
+			m := &relayMetrics[i]
+			if m.when != nil && !m.when(r) {
+				continue
+			}
+			switch {
+			case m.total != nil:
+				o.ObserveInt64(instruments[i], int64(m.total(r, snap)))
+			case m.target != nil:
+				for name, ts := range snap.Targets {
+					o.ObserveInt64(instruments[i], int64(m.target(ts)), metric.WithAttributes(attribute.String("target", name)))
+				}
+			case m.port != nil:
+				for port, ps := range snap.Ports {
+					o.ObserveInt64(instruments[i], int64(m.port(ps)), metric.WithAttributes(attribute.String("port", port)))
+				}
+			}
+		}
+		return nil
+	}, observables...)
+	return err
+}
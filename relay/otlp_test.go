@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestOTLPExport checks the metrics a relay exports to a collector when it
+// stops, and their resource attributes.
+func TestOTLPExport(t *testing.T) {
+	requests := make(chan *colmetricpb.ExportMetricsServiceRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/metrics" {
+			t.Errorf("export to %s, want /v1/metrics", req.URL.Path)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		request := &colmetricpb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Errorf("decoding export: %v", err)
+		}
+		requests <- request
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "deployment.environment=test")
+
+	config := DefaultConfig()
+	config.TargetAddrs = []string{"127.0.0.1:9"}
+	config.OTLPEndpoint = collector.URL
+	config.OTLPInterval = time.Hour
+	r, src := startRelay(t, config)
+	if _, err := src.Write([]byte("counted")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); r.snapshot().PacketsReceived == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("relay received no packet")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Stop()
+
+	var request *colmetricpb.ExportMetricsServiceRequest
+	select {
+	case request = <-requests:
+	default:
+		t.Fatal("no export when the relay stopped")
+	}
+	if len(request.ResourceMetrics) != 1 {
+		t.Fatalf("export of %d resources, want 1", len(request.ResourceMetrics))
+	}
+	rm := request.ResourceMetrics[0]
+	attrs := make(map[string]string)
+	for _, kv := range rm.Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	for key, want := range map[string]string{"service.name": "broadcast-relay", "service.version": Version, "deployment.environment": "test"} {
+		if attrs[key] != want {
+			t.Errorf("resource attribute %s = %q, want %q", key, attrs[key], want)
+		}
+	}
+
+	metrics := make(map[string]*metricpb.Metric)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m
+		}
+	}
+	received := metrics["relay.packets.received"]
+	if received == nil || received.GetSum() == nil {
+		t.Fatalf("relay.packets.received = %v, want a sum", received)
+	}
+	if sum := received.GetSum(); !sum.IsMonotonic || sum.AggregationTemporality != metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE ||
+		len(sum.DataPoints) != 1 || sum.DataPoints[0].GetAsInt() != 1 {
+		t.Errorf("relay.packets.received = %v, want a cumulative count of 1", sum)
+	}
+	up := metrics["relay.target.up"]
+	if up == nil || up.GetGauge() == nil || len(up.GetGauge().DataPoints) != 1 {
+		t.Fatalf("relay.target.up = %v, want a gauge of the target", up)
+	}
+	point := up.GetGauge().DataPoints[0]
+	if len(point.Attributes) != 1 || point.Attributes[0].Key != "target" || point.Attributes[0].Value.GetStringValue() != "127.0.0.1:9" {
+		t.Errorf("relay.target.up attributes = %v, want target=127.0.0.1:9", point.Attributes)
+	}
+	if metrics["relay.target.active"] != nil {
+		t.Error("relay.target.active exported outside of -mode failover")
+	}
+}
+
+func TestOTLPProtocol(t *testing.T) {
+	tests := []struct {
+		metrics, all, want string
+	}{
+		{"", "", "http/protobuf"},
+		{"", "grpc", "grpc"},
+		{"http/protobuf", "grpc", "http/protobuf"},
+		{"", "http/json", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL", tt.metrics)
+		t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", tt.all)
+		got, err := otlpProtocol()
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("protocol of %q, %q = %q, %v, want %q", tt.metrics, tt.all, got, err, tt.want)
+		}
+	}
+}
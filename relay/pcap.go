@@ -0,0 +1,192 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapQueueSize is the number of packets that may wait for the pcap writer.
+// Packets arriving while the queue is full are left out of the capture.
+const pcapQueueSize = 1024
+
+// pcapSnapLen is the capture length in the file header; no UDP packet is
+// longer, so packets are never truncated.
+const pcapSnapLen = 65536 + 128
+
+// pcapWriter writes packets to a -pcap file as raw IP packets, with IP and
+// UDP headers synthesized from their addresses, for viewing in Wireshark.
+// Packets are written on a goroutine of their own so that a slow disk never
+// holds up receiving or forwarding.
+type pcapWriter struct {
+	file    *os.File
+	buf     *bufio.Writer
+	w       *pcapgo.Writer
+	records chan pcapRecord
+	quit    chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+type pcapRecord struct {
+	time    time.Time
+	src     *net.UDPAddr
+	dst     *net.UDPAddr
+	payload []byte
+}
+
+func openPcap(path string) (*pcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap file: %v", err)
+	}
+	p := &pcapWriter{
+		file:    f,
+		buf:     bufio.NewWriter(f),
+		records: make(chan pcapRecord, pcapQueueSize),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	p.w = pcapgo.NewWriter(p.buf)
+	if err := p.w.WriteFileHeader(pcapSnapLen, layers.LinkTypeRaw); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write pcap file: %v", err)
+	}
+	go p.run()
+	return p, nil
+}
+
+// add queues a packet from src to dst. The addresses and payload are
+// copied, so the caller may reuse them.
+func (p *pcapWriter) add(t time.Time, src, dst *net.UDPAddr, payload []byte) {
+	rec := pcapRecord{
+		time:    t,
+		src:     &net.UDPAddr{IP: slices.Clone(src.IP), Port: src.Port, Zone: src.Zone},
+		dst:     &net.UDPAddr{IP: slices.Clone(dst.IP), Port: dst.Port, Zone: dst.Zone},
+		payload: slices.Clone(payload),
+	}
+	select {
+	case p.records <- rec:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *pcapWriter) run() {
+	defer close(p.done)
+
+	var failed bool
+	write := func(rec pcapRecord) {
+		if failed {
+			return
+		}
+		if err := p.write(rec); err != nil {
+			slog.Error("Failed to write pcap file, capture stopped", "error", err)
+			failed = true
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec := <-p.records:
+			write(rec)
+		case <-ticker.C:
+			p.buf.Flush()
+		case <-p.quit:
+			// Write out what was queued before the relay stopped.
+			for {
+				select {
+				case rec := <-p.records:
+					write(rec)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *pcapWriter) write(rec pcapRecord) error {
+	data, err := encodeUDPPacket(rec.src, rec.dst, rec.payload)
+	if err != nil {
+		return err
+	}
+	return p.w.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     rec.time,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}, data)
+}
+
+// close writes the remaining queued packets and closes the file. Packets
+// added afterwards are ignored.
+func (p *pcapWriter) close() error {
+	close(p.quit)
+	<-p.done
+	if n := p.dropped.Load(); n > 0 {
+		slog.Warn("Packets left out of the pcap file because the writer fell behind", "packets", n)
+	}
+	if err := p.buf.Flush(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+// encodeUDPPacket builds an IPv4 or IPv6 packet carrying payload from src
+// to dst. If the addresses are of different families, as when a dual-stack
+// socket receives IPv4, the destination is replaced by the unspecified
+// address of the source's family.
+func encodeUDPPacket(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port),
+		DstPort: layers.UDPPort(dst.Port),
+	}
+
+	var ip gopacket.NetworkLayer
+	if src4 := src.IP.To4(); src4 != nil {
+		dst4 := dst.IP.To4()
+		if dst4 == nil {
+			dst4 = net.IPv4zero.To4()
+		}
+		ip = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src4,
+			DstIP:    dst4,
+		}
+	} else {
+		dst6 := dst.IP
+		if dst6.To4() != nil || dst6 == nil {
+			dst6 = net.IPv6unspecified
+		}
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      src.IP,
+			DstIP:      dst6,
+		}
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), udp, gopacket.Payload(payload))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PortMap is the -target-port-map flag: for listen ports, the port to send
+// the packets received on them to at every target, instead of the target's
+// own, as comma-separated listen=target pairs.
+type PortMap map[int]int
+
+func (m PortMap) String() string {
+	ports := make([]int, 0, len(m))
+	for port := range m {
+		ports = append(ports, port)
+	}
+	slices.Sort(ports)
+	items := make([]string, len(ports))
+	for i, port := range ports {
+		items[i] = strconv.Itoa(port) + "=" + strconv.Itoa(m[port])
+	}
+	return strings.Join(items, ",")
+}
+
+// Set implements flag.Value.
+func (m *PortMap) Set(s string) error {
+	ports := make(PortMap)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		from, to, ok := strings.Cut(item, "=")
+		listen, err1 := strconv.Atoi(strings.TrimSpace(from))
+		target, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if !ok || err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid port mapping %q: must be listen=target, e.g., 9999=8888", item)
+		}
+		if _, ok := ports[listen]; ok {
+			return fmt.Errorf("port %d is mapped twice", listen)
+		}
+		ports[listen] = target
+	}
+	*m = ports
+	return nil
+}
+
+// validate checks that every mapped port is a listen port of config, and
+// the ports they map to are valid.
+func (m PortMap) validate(config *Config) error {
+	for listen, target := range m {
+		if !slices.Contains(config.ListenPorts, listen) {
+			return fmt.Errorf("-target-port-map: %d is not a listen port", listen)
+		}
+		if target < 1 || target > 65535 {
+			return fmt.Errorf("-target-port-map: port %d is out of range 1-65535", target)
+		}
+	}
+	return nil
+}
+
+// shiftTargets applies config's -target-port-map to targets: for each
+// mapped listen port, every target but Unix sockets gets a copy at the
+// mapped port, which the packets received on that port are sent to
+// instead. The targets themselves are sent the packets of the other listen
+// ports, and left out when there are none. settings records which ports
+// each target is sent, and the target a copy was made from, whose settings
+// and target groups it shares.
+func shiftTargets(targets []string, settings *targetSettings, config *Config) []string {
+	portMap := config.TargetPortMap
+	if len(portMap) == 0 {
+		return targets
+	}
+	var unmapped, mapped []int
+	for _, port := range config.ListenPorts {
+		if _, ok := portMap[port]; ok {
+			mapped = append(mapped, port)
+		} else {
+			unmapped = append(unmapped, port)
+		}
+	}
+
+	settings.ports = make(map[string][]int)
+	settings.shifted = make(map[string]string)
+	var shifted []string
+	add := func(target string, ports ...int) {
+		if _, ok := settings.ports[target]; !ok {
+			shifted = append(shifted, target)
+		}
+		settings.ports[target] = append(settings.ports[target], ports...)
+	}
+	for _, target := range targets {
+		if _, ok, _ := unixTarget(target); ok {
+			add(target, config.ListenPorts...)
+		} else if len(unmapped) > 0 {
+			add(target, unmapped...)
+		}
+	}
+	for _, listen := range mapped {
+		port := strconv.Itoa(portMap[listen])
+		for _, target := range targets {
+			if _, ok, _ := unixTarget(target); ok {
+				continue
+			}
+			hostPort, scheme := targetHostPort(target)
+			host, _, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				// Kept as it is, for resolving it to report the error.
+				add(target, listen)
+				continue
+			}
+			moved := scheme + net.JoinHostPort(host, port)
+			if _, ok := settings.shifted[moved]; !ok && !slices.Contains(targets, moved) {
+				settings.shifted[moved] = target
+			}
+			add(moved, listen)
+		}
+	}
+	return shifted
+}
+
+// portTargets returns the targets that packets received on the listen port
+// are sent, under -target-port-map portMap.
+func portTargets(targets []*targetConn, port int, portMap PortMap) []*targetConn {
+	_, mapped := portMap[port]
+	sent := make([]*targetConn, 0, len(targets))
+	for _, target := range targets {
+		if ports := target.ports.Load(); ports != nil {
+			if slices.Contains(*ports, port) {
+				sent = append(sent, target)
+			}
+		} else if !mapped {
+			// A target added through the control API is sent the
+			// packets of the listen ports not in the map.
+			sent = append(sent, target)
+		}
+	}
+	return sent
+}
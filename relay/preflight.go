@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// preflightGrace is how much longer than -preflight-timeout preflight waits
+// for the probes, whose reads end at the timeout, to report.
+const preflightGrace = 100 * time.Millisecond
+
+// preflight probes every target once, in parallel, and logs the outcome,
+// waiting little more than -preflight-timeout. Targets that refuse the
+// probe are marked down, as if they had refused a packet.
+func (r *Relay) preflight() {
+	timeout := r.config.PreflightTimeout
+	targets := r.targets()
+
+	type outcome struct {
+		target *targetConn
+		err    error
+	}
+	// Buffered, so that probes still running after the timeout can finish.
+	results := make(chan outcome, len(targets))
+	for _, target := range targets {
+		go func(target *targetConn) {
+			results <- outcome{target, target.probe(timeout)}
+		}(target)
+	}
+
+	timer := time.NewTimer(timeout + preflightGrace)
+	defer timer.Stop()
+
+	var ok, failed int
+	for done := 0; done < len(targets); done++ {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				failed++
+				slog.Warn("Preflight: target is not reachable", "target", res.target.name, "error", res.err)
+				if wentDown, _ := res.target.health.record(res.err, time.Now()); wentDown {
+					r.stats.SetDown(res.target.name, true)
+				}
+				continue
+			}
+			ok++
+			slog.Info("Preflight: target is reachable", "target", res.target.name)
+		case <-timer.C:
+			slog.Warn("Preflight: timed out waiting for targets", "timeout", timeout, "pending", len(targets)-done)
+			done = len(targets)
+		}
+	}
+	slog.Info("Preflight finished", "reachable", ok, "unreachable", failed, "targets", len(targets))
+}
+
+// probe checks that the target can be reached. A TCP or Unix socket target
+// is reachable once connected. A UDP target is sent an empty datagram; one
+// that is refused (ICMP port unreachable) shows as an error reading the
+// socket within timeout, while silence means no refusal arrived.
+func (t *targetConn) probe(timeout time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errTargetClosed
+	}
+	if t.conn == nil {
+		conn, err := t.dial()
+		if err != nil {
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+		t.conn = conn
+		t.setLocal(conn)
+	}
+	// Through the proxy, the socket leads to the proxy, not the target.
+	if !t.udp() || t.opts.proxy != nil {
+		return nil
+	}
+
+	if _, err := t.conn.Write(nil); err != nil {
+		t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	t.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer t.conn.SetReadDeadline(time.Time{})
+	var buf [1]byte
+	if _, err := t.conn.Read(buf[:]); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RateLimit is a forwarding rate written as "200p/s" (packets per second)
+// or "1MB/s" (bytes per second, with decimal K, M and G prefixes). The zero
+// value means unlimited.
+type RateLimit struct {
+	rate  float64
+	bytes bool
+}
+
+var byteUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"GB", 1e9},
+	{"MB", 1e6},
+	{"KB", 1e3},
+	{"B", 1},
+}
+
+func parseRateLimit(s string) (RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return RateLimit{}, nil
+	}
+
+	value, ok := strings.CutSuffix(s, "/s")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: must end in /s, e.g. 200p/s or 1MB/s", s)
+	}
+
+	var limit RateLimit
+	scale := 1.0
+	if v, ok := strings.CutSuffix(value, "p"); ok {
+		value = v
+	} else {
+		upper := strings.ToUpper(value)
+		for _, unit := range byteUnits {
+			if strings.HasSuffix(upper, unit.suffix) {
+				value = value[:len(value)-len(unit.suffix)]
+				scale = unit.scale
+				limit.bytes = true
+				break
+			}
+		}
+		if !limit.bytes {
+			return RateLimit{}, fmt.Errorf("invalid rate limit %q: unit must be p, B, KB, MB or GB", s)
+		}
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", s)
+	}
+	limit.rate = rate * scale
+	if limit.rate == 0 {
+		return RateLimit{}, nil
+	}
+	return limit, nil
+}
+
+func (l RateLimit) String() string {
+	switch {
+	case l.rate == 0:
+		return ""
+	case l.bytes:
+		return strconv.FormatFloat(l.rate, 'f', -1, 64) + "B/s"
+	default:
+		return strconv.FormatFloat(l.rate, 'f', -1, 64) + "p/s"
+	}
+}
+
+// Set implements flag.Value.
+func (l *RateLimit) Set(s string) error {
+	v, err := parseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+func (l *RateLimit) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	return l.Set(s)
+}
+
+func (l *RateLimit) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rate limit must be a string such as \"200p/s\"")
+	}
+	return l.Set(s)
+}
+
+// tokenBucket enforces a RateLimit. It holds up to one second's worth of
+// tokens, so short bursts at up to twice the rate get through.
+type tokenBucket struct {
+	limit  RateLimit
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.rate, last: time.Now()}
+}
+
+// allow reports whether a packet of size bytes may be sent now, and takes
+// its tokens if so. A full bucket always admits one packet, even one that
+// costs more than the bucket holds; the bucket then goes into debt.
+func (b *tokenBucket) allow(size int) bool {
+	cost := 1.0
+	if b.limit.bytes {
+		cost = float64(size)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.limit.rate, b.tokens+now.Sub(b.last).Seconds()*b.limit.rate)
+	b.last = now
+
+	if b.tokens < cost && b.tokens < b.limit.rate {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
@@ -0,0 +1,3046 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// Version and BuildTime describe the build; the Makefile sets them.
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+)
+
+// Config holds the relay settings. Start from DefaultConfig, or build one
+// from a command line with LoadConfig.
+type Config struct {
+	ConfigFile string
+	// ListenPorts each get their own listen socket.
+	ListenPorts PortList
+	ListenAddr  string
+	TargetAddrs []string
+	// TargetsFile names a file listing more targets, one per line, that is
+	// re-read whenever it changes.
+	TargetsFile string
+	// MulticastGroups are joined on the listen socket so that traffic to
+	// them is relayed like broadcast traffic.
+	MulticastGroups    []string
+	MulticastInterface string
+	// InputMode and OutputMode are one of the input* and output* modes.
+	InputMode  string
+	OutputMode string
+	// ReusePort lets several relays bind the same listen port.
+	ReusePort bool
+	// Interface restricts the listen socket to packets arriving on the
+	// named network interface.
+	Interface string
+	// Transparent forwards packets with the original sender as source
+	// address instead of the relay's own (Linux, IPv4, needs CAP_NET_RAW).
+	Transparent bool
+	// SkipBadTargets drops targets that cannot be resolved, with a warning,
+	// instead of failing.
+	SkipBadTargets bool
+	// DNSRefresh is how often targets given by hostname are resolved
+	// again, following address changes, and the SRV records of srv://
+	// targets read again. Zero resolves them only once.
+	DNSRefresh time.Duration
+	// Preflight probes every target once at startup and logs which can be
+	// reached, waiting at most PreflightTimeout for the answers.
+	Preflight        bool
+	PreflightTimeout time.Duration
+	// RateLimit caps forwarding to each target; TargetRateLimits overrides
+	// it for individual targets, keyed by address as written in the config.
+	RateLimit        RateLimit
+	TargetRateLimits map[string]RateLimit
+	// Sample forwards only one of every N packets to each target;
+	// TargetSamples overrides it for individual targets, like
+	// TargetRateLimits.
+	Sample        Sample
+	TargetSamples map[string]Sample
+	// MaxReceiveRate caps the packets the relay processes in total; packets
+	// over it are dropped as soon as they are read.
+	MaxReceiveRate RateLimit
+	// Mode is ModeFanout, ModeBalance or ModeFailover. In balance mode
+	// targets get a share of the packets in proportion to TargetWeights,
+	// which come from the config file; the default weight is 1. In failover
+	// mode a target that comes back up before the active one takes over
+	// after FailbackDelay.
+	Mode          string
+	TargetWeights map[string]int
+	FailbackDelay time.Duration
+	// Routes, if set, send a packet to the targets of the first route
+	// that matches it instead of to all; RouteDefault, RouteAll or
+	// RouteDrop, says what becomes of packets no route matches. Both come
+	// from the config file.
+	Routes       []Route
+	RouteDefault string
+	// MinSize and MaxSize bound the size of forwarded packets; packets
+	// outside the range are filtered. Zero disables a bound.
+	MinSize int
+	MaxSize int
+	// MatchPrefixes, if set, limits forwarding to packets whose payload
+	// starts with one of them; packets starting with a DropPrefixes entry
+	// are never forwarded.
+	MatchPrefixes HexList
+	DropPrefixes  HexList
+	// MatchRegexp, if set, limits forwarding to packets whose payload it
+	// matches. It is checked after the prefixes, which are cheaper.
+	MatchRegexp Regexp
+	// AllowSrc, if set, limits forwarding to packets from these source
+	// networks; packets from a DenySrc network are never forwarded.
+	AllowSrc CIDRList
+	DenySrc  CIDRList
+	// Rewrites are applied in order to the payload of every forwarded
+	// packet.
+	Rewrites RewriteRules
+	// DedupWindow suppresses a packet identical to one from the same source
+	// seen less than this long ago. Zero disables deduplication.
+	DedupWindow time.Duration
+	// DSCP marks forwarded packets for QoS. Zero leaves the default.
+	DSCP int
+	// TTL sets the IPv4 TTL or IPv6 hop limit of forwarded packets. Zero
+	// leaves the default.
+	TTL int
+	// SourcePort is the local port UDP targets are forwarded from. Zero
+	// lets the system pick one.
+	SourcePort int
+	// EgressAddr is the local IP address forwarded packets are sent from,
+	// which picks the outgoing interface on a multi-homed host. Empty lets
+	// the routing table decide.
+	EgressAddr string
+	// Proxy is a socks5:// URL to forward through instead of sending to
+	// the targets directly. Empty forwards directly.
+	Proxy string
+	// TLSCA is a PEM file of the CA certificates tls:// targets are
+	// verified against instead of the system roots; TLSInsecure skips
+	// the verification.
+	TLSCA       string
+	TLSInsecure bool
+	// WriteTimeout fails a write to a target that blocks for longer, so
+	// that a stuck target cannot hold up a forwarding worker. Zero leaves
+	// UDP and Unix socket writes unbounded and TCP writes at 2s.
+	WriteTimeout time.Duration
+	// BufferSize is the socket receive buffer size, and the largest
+	// datagram read in full, up to 65535.
+	BufferSize int
+	Workers    int
+	// FanoutConcurrency is how many targets a worker forwards one packet
+	// to at the same time; 1 forwards to them one after another.
+	FanoutConcurrency int
+	// MaxQueue is how many received packets may wait for a worker; more
+	// are dropped and counted in QueueDropped.
+	MaxQueue     int
+	DrainTimeout time.Duration
+	// IdleTimeout stops the relay when no packet arrives for that long;
+	// zero disables it.
+	IdleTimeout time.Duration
+	// DryRun receives and filters packets as usual but never forwards
+	// them.
+	DryRun bool
+	// Once stops the relay after the first packet that passes the filters
+	// has been forwarded, or logged under DryRun.
+	Once bool
+	// LoopGuard adds a header naming this relay, RelayID, to forwarded
+	// packets and drops received packets whose header already names it.
+	// A zero RelayID is replaced by a random one.
+	LoopGuard bool
+	RelayID   uint
+	// AllowLoopback forwards a packet to a UDP target that is its own
+	// source too, which is skipped by default.
+	AllowLoopback bool
+	// Timestamp prefixes forwarded packets with a per-target sequence
+	// number and the send time, as read by ParseStamp.
+	Timestamp bool
+	// ForwardRetries is how many times a failed forward is retried, waiting
+	// RetryDelay before the first retry and twice as long before each next.
+	ForwardRetries int
+	RetryDelay     time.Duration
+	// BreakerFailures is how many consecutive forwards to a target must
+	// fail within BreakerWindow for the target to be skipped for
+	// BreakerCooldown. Zero disables the circuit breaker.
+	BreakerFailures int
+	BreakerWindow   time.Duration
+	BreakerCooldown time.Duration
+	// StatsInterval is how often stats are logged; zero disables periodic
+	// stats. They are logged with -verbose, or whenever the interval is set
+	// explicitly.
+	StatsInterval    time.Duration
+	statsIntervalSet bool
+	MetricsAddr      string
+	StatsAddr        string
+	HealthAddr       string
+	ControlAddr      string
+	// TrackSources counts received packets per source IP, for at most
+	// TrackSourcesMax sources, for /stats and the stats log.
+	TrackSources    bool
+	TrackSourcesMax int
+	// DebugAddr serves /debug/info and the pprof handlers; it is meant
+	// for support and profiling, not to be exposed.
+	DebugAddr string
+	// LogFormat is "text" or "json". Verbose lowers LogLevel to debug.
+	LogFormat string
+	LogLevel  slog.Level
+	// AccessLog is a file to record every received packet in.
+	AccessLog string
+	// PcapFile is a capture file to write received packets to, and with
+	// PcapForwarded also the forwarded ones.
+	PcapFile      string
+	PcapForwarded bool
+	Verbose       bool
+	ShowVersion   bool
+	// ListInterfaces asks for the network interfaces to be listed, with
+	// ListInterfaces, instead of running the relay.
+	ListInterfaces bool
+	// JSONErrors asks for a fatal error to be printed as a JSON object. It
+	// is a command-line option only, as it applies to errors in the config
+	// file too.
+	JSONErrors bool
+	// Replay is a pcap, pcapng or length-framed file, or "-" for standard
+	// input, whose packets are forwarded instead of listening. ReplaySpeed
+	// divides their original spacing; 0 replays them back to back.
+	Replay      string
+	ReplaySpeed float64
+	// Service is "install" or "uninstall" to register the relay, with the
+	// other arguments, as a Windows service or remove it, instead of
+	// running it. It is a command-line option only.
+	Service string
+	// Coalesce batches the datagrams for each UDP and Unix socket target
+	// into ones of up to CoalesceBytes, sent at most CoalesceDelay after
+	// the first datagram in them, each datagram a length-prefixed frame.
+	Coalesce      bool
+	CoalesceBytes int
+	CoalesceDelay time.Duration
+	// ChaosDrop is the fraction of forwards to drop at random, and
+	// ChaosDelay the most a forward is delayed at random, to test how the
+	// receivers cope with a lossy network.
+	ChaosDrop  float64
+	ChaosDelay time.Duration
+	// OTLPEndpoint is an OpenTelemetry collector to push the metrics to
+	// over OTLP every OTLPInterval; if empty, OTEL_EXPORTER_OTLP_ENDPOINT
+	// names it, and the export is off without either.
+	OTLPEndpoint string
+	OTLPInterval time.Duration
+	// MaxLifetime makes Run return ErrMaxLifetime once the relay has run
+	// for that long, for the caller to restart it; zero disables it.
+	MaxLifetime time.Duration
+	// GRPCAddr serves the Subscribe packet stream of relay.proto over gRPC.
+	GRPCAddr string
+	// HostLoopGuard treats every address of this host as the relay's own
+	// when recognizing its packets and targets that would loop back.
+	HostLoopGuard bool
+	// Compress compresses the packets forwarded to every target but
+	// broadcast addresses, in CompressGzip or CompressLZ4 format, for a
+	// relay with Decompress to restore; TargetCompress overrides it for
+	// individual targets, like TargetSamples.
+	Compress       string
+	TargetCompress map[string]string
+	Decompress     bool
+	// PrependSource prefixes forwarded packets with the address of their
+	// source, as read by ParseSource.
+	PrependSource bool
+	// NoFragment sets the Don't Fragment bit on packets to UDP targets, so
+	// that those too big for the path fail with an error instead of being
+	// fragmented or lost on the way.
+	NoFragment bool
+	// TargetPortMap sends the packets received on its listen ports to the
+	// ports it maps them to at every target instead of the targets' own.
+	TargetPortMap PortMap
+	// TUI shows a live dashboard of the stats on standard output.
+	TUI bool
+	// DumpRaw is a file to write every received payload to, each as a
+	// 4-byte big-endian length followed by the payload.
+	DumpRaw string
+	// ErrorLogInterval logs a repeated error, of the same message, target
+	// and error text, at most once per interval, with a summary of the
+	// repeats; zero logs every error.
+	ErrorLogInterval time.Duration
+	// KeepaliveInterval sends KeepalivePayload to every target that has
+	// been sent nothing for that long; zero disables it.
+	KeepaliveInterval time.Duration
+	KeepalivePayload  HexBytes
+	// StatsFile is a JSON file the counters are saved to every
+	// StatsFileInterval and on stop, and added to the stats from on start,
+	// for totals over restarts.
+	StatsFile         string
+	StatsFileInterval time.Duration
+}
+
+// Relay receives UDP packets on its listen sockets and forwards them to its
+// targets. Create one with NewRelay, then call Run, or Start and Stop.
+type Relay struct {
+	// OnPacket, if set, is called with every packet that passed the
+	// filters, after -rewrite, and returns the payload to forward instead;
+	// nil drops the packet. src and payload are copies the handler may keep
+	// or modify. It runs on a forwarding worker, so it should return
+	// quickly. Set it before Start.
+	OnPacket func(src *net.UDPAddr, payload []byte) []byte
+	// LogTail, if set, is the log output, whose latest lines the -tui
+	// dashboard shows while the log is held back. Set it before Start.
+	LogTail *LogTail
+
+	config      *Config
+	listeners   []*listener
+	raw         *rawSender
+	targetConns []*targetConn
+	settings    targetSettings
+	// receiveLimit, shared by all listen sockets, enforces
+	// -max-receive-rate.
+	receiveLimit *tokenBucket
+	balancer     balancer
+	failover     failover
+	routes       atomic.Pointer[routeTable]
+	breaker      breakerConfig
+	loopGuard    *loopGuard
+	sockOpts     socketOptions
+	stats        *Stats
+	targetsMu    sync.RWMutex
+	httpServers  []*httpServer
+	access       *accessLog
+	pcap         *pcapWriter
+	dump         *rawDump
+	errorLog     *errorLog
+	// lastReceived is when the last packet was read, in Unix nanoseconds,
+	// kept for the idle timeout.
+	lastReceived atomic.Int64
+	idle         chan struct{}
+	// queueFull is set from when the forward queue overflows until it is
+	// half empty again.
+	queueFull atomic.Bool
+	// noTargets is set while every target has been removed.
+	noTargets atomic.Bool
+	// onceTaken is set when -once has received its packet, and onceDone
+	// closed when it has been handled, with onceErr the outcome.
+	onceTaken  atomic.Bool
+	onceDone   chan struct{}
+	onceErr    error
+	queue      chan *packet
+	packetPool sync.Pool
+	// started is when the relay was started, in Unix nanoseconds, or 0
+	// before.
+	started  atomic.Int64
+	running  atomic.Bool
+	healthMu sync.Mutex
+	// replay is the -replay file, read in place of the listen sockets;
+	// replayDone is closed when it has been forwarded, with replayErr the
+	// error that ended it early.
+	replay     *replaySource
+	replayDone chan struct{}
+	replayErr  error
+	// ctx is cancelled when the relay stops, which ends its goroutines.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	// sources counts packets per source IP under -track-sources, or is nil.
+	sources *sourceTracker
+	// debug is set when debug logging is enabled. Per-packet messages
+	// check it first so that they cost nothing otherwise.
+	debug     bool
+	wg        sync.WaitGroup
+	recvWg    sync.WaitGroup
+	forwardWg sync.WaitGroup
+	// lastConfig is the configuration the relay was created or last
+	// reloaded with, which changes to the -targets-file are applied with.
+	lastConfig atomic.Pointer[Config]
+	// otlp exports the metrics to the OTLP collector from Start on, or is
+	// nil.
+	otlp *sdkmetric.MeterProvider
+	// stream hands packets to the -grpc-addr subscribers, or is nil.
+	stream *packetStream
+	// hostAddrs holds this host's addresses under -host-loop-guard, or nil.
+	hostAddrs atomic.Pointer[hostAddrs]
+	// sourceLen is the length of the -prepend-source header, or 0.
+	sourceLen int
+}
+
+// defaultMaxQueue is the default -max-queue: the number of received packets
+// that may wait for a free worker before further ones are dropped.
+const defaultMaxQueue = 1024
+
+// Bounds of -buffer. Packet buffers are never larger than a UDP datagram,
+// as every queued packet has one, and the socket receive buffer is never
+// smaller than an Ethernet frame.
+const (
+	maxDatagram   = 65535
+	minReadBuffer = 1500
+	maxBufferSize = 64 << 20
+)
+
+// udpHeaders is the size of the IPv4 and UDP headers, which a datagram's
+// payload leaves of the MTU.
+const udpHeaders = 28
+
+// packet is a received datagram waiting to be forwarded. Packets are
+// pooled together with their buffer and source address: the receive loop
+// reads straight into a packet and hands it to the workers, which put it
+// back once every target has been written, so that forwarding does not
+// allocate.
+type packet struct {
+	src      *net.UDPAddr
+	data     []byte
+	buf      []byte
+	received time.Time
+	// rewritten is set when -rewrite or OnPacket changed data, which then
+	// no longer points into buf.
+	rewritten bool
+	// hops holds the relay IDs from the received -loop-guard header, and
+	// marked is data with this relay's header added, sent to every target
+	// but broadcast addresses. markBuf keeps marked's memory for reuse.
+	hops    []byte
+	marked  []byte
+	markBuf []byte
+	// inflated holds the data decompressed under -decompress.
+	inflated []byte
+	// port is the listen port the packet was received on.
+	port int
+	// bufs holds the data as changed for the current target. Fan-out
+	// helpers, with -fanout-concurrency, use their own.
+	bufs forwardBufs
+	// addr and ip hold the source address that src points to.
+	addr net.UDPAddr
+	ip   [16]byte
+}
+
+// setSrc sets the packet's source address to ap, stored in the packet
+// itself. IPv4 addresses are kept in their 16-byte form, as a dual-stack
+// socket reports them.
+func (p *packet) setSrc(ap netip.AddrPort) {
+	p.ip = ap.Addr().As16()
+	p.addr = net.UDPAddr{IP: p.ip[:], Port: int(ap.Port()), Zone: ap.Addr().Zone()}
+	p.src = &p.addr
+}
+
+// payload returns what to send to target: the data with the loop-guard
+// header, if there is one, except for broadcast addresses, whose receivers
+// are not relays.
+func (p *packet) payload(target *targetConn) []byte {
+	if p.marked != nil && !target.opts.broadcast {
+		return p.marked
+	}
+	return p.data
+}
+
+func (r *Relay) getPacket() *packet {
+	return r.packetPool.Get().(*packet)
+}
+
+func (r *Relay) putPacket(pkt *packet) {
+	pkt.data = nil
+	pkt.rewritten = false
+	pkt.hops = nil
+	pkt.marked = nil
+	r.packetPool.Put(pkt)
+}
+
+// forwardResult is the outcome of forwarding a packet to one target.
+type forwardResult int
+
+const (
+	forwardOK forwardResult = iota
+	// forwardSkipped means the target was not tried: it is the packet's
+	// source, its -sample ratio left the packet out, or it was removed
+	// while the packet was in flight.
+	forwardSkipped
+	forwardDropped
+	forwardFailed
+)
+
+// targetConn is a forwarding destination together with the connected UDP
+// socket used to reach it, or the TCP connection for a tcp:// target. The
+// socket is dialed once and reused for every packet; after a write error it
+// is discarded and re-dialed on the next use.
+// A target with a rate limit has a limiter; packets over the limit are
+// dropped.
+type targetConn struct {
+	name string
+	// target is the address as configured, which -dns-refresh resolves
+	// again. dnsFailing is set while that fails; only the refresher uses
+	// it.
+	target     string
+	dnsFailing bool
+	network    string
+	addr       *net.UDPAddr
+	tcp        bool
+	// unix is the socket of a unixgram: target, which has no addr.
+	unix    *net.UnixAddr
+	opts    socketOptions
+	health  targetHealth
+	breaker circuitBreaker
+	// local is the local address of the current socket, used to recognize
+	// packets the relay sent itself.
+	local   atomic.Pointer[net.UDPAddr]
+	limiter atomic.Pointer[tokenBucket]
+	weight  atomic.Int32
+	// sample is the target's Sample ratio, and sampleSeq counts the
+	// packets offered to it.
+	sample    atomic.Uint64
+	sampleSeq atomic.Uint64
+	// compress is the target's -compress format.
+	compress atomic.Uint32
+	// ports are the listen ports whose packets the target is sent under
+	// -target-port-map, nil for those not in it, and group is the target
+	// as target groups name it.
+	ports atomic.Pointer[[]int]
+	group atomic.Pointer[string]
+	// lastSent is when a packet or heartbeat was last sent to the target,
+	// in Unix nanoseconds, for -keepalive-interval.
+	lastSent atomic.Int64
+	// seq is the last -timestamp sequence number sent to the target.
+	seq    atomic.Uint64
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+	// tls is set for a tls:// target, which is also tcp; frame holds the
+	// frame being written, so that it goes out as one TLS record.
+	tls   *tls.Config
+	frame []byte
+	// coalesce batches the datagrams under -coalesce; it is nil for TCP
+	// targets and broadcast addresses.
+	coalesce *coalescer
+}
+
+var (
+	errTargetClosed   = errors.New("target connection closed")
+	errTargetNotFound = errors.New("target not found")
+)
+
+// newTargetConn resolves target and dials its forwarding socket. A TCP or
+// Unix socket target that does not accept the connection yet, or a proxy
+// that is not reachable, is connected to on first use instead.
+func newTargetConn(target string, opts socketOptions, settings targetSettings) (*targetConn, error) {
+	name, addr, tcp, err := resolveTarget(target)
+	if err != nil {
+		return nil, classify(ErrConfig, &TargetError{Target: target, Err: err})
+	}
+	tc := &targetConn{
+		name:   name,
+		target: target,
+		addr:   addr,
+		tcp:    tcp,
+	}
+	if unix, ok, _ := unixTarget(target); ok {
+		tc.unix = unix
+	} else {
+		tc.network = targetNetwork(addr.String())
+		if strings.HasPrefix(target, tlsScheme) {
+			tc.tls = tlsTargetConfig(opts.tls, target)
+		} else if !tcp {
+			opts.broadcast = isBroadcastAddr(addr.IP)
+		}
+	}
+	tc.opts = opts
+	if opts.coalesceBytes > 0 && !tcp && !opts.broadcast {
+		tc.coalesce = &coalescer{maxBytes: opts.coalesceBytes, maxDelay: opts.coalesceDelay}
+	}
+
+	conn, err := tc.dial()
+	switch {
+	case err == nil:
+		tc.conn = conn
+		tc.setLocal(conn)
+	case tcp || tc.unix != nil || opts.proxy != nil:
+		slog.Warn("Failed to connect to target, will retry", "target", name, "error", err)
+	default:
+		return nil, &TargetError{Target: target, Err: fmt.Errorf("failed to connect to target %s: %v", target, err)}
+	}
+	tc.configure(target, settings)
+	return tc, nil
+}
+
+// configure applies the settings for target, as written in the
+// configuration.
+func (t *targetConn) configure(target string, settings targetSettings) {
+	t.setLimit(settings.limit(target))
+	t.weight.Store(int32(settings.weight(target)))
+	t.sample.Store(settings.sample(target).every)
+	if ports, ok := settings.ports[target]; ok {
+		t.ports.Store(&ports)
+	} else {
+		t.ports.Store(nil)
+	}
+	group := settings.configured(target)
+	t.group.Store(&group)
+	if !t.opts.broadcast {
+		// Broadcast receivers are not relays.
+		t.compress.Store(settings.compression(target))
+	}
+}
+
+// udp reports whether the target is sent UDP datagrams, rather than TCP
+// frames or Unix socket datagrams.
+func (t *targetConn) udp() bool {
+	return !t.tcp && t.unix == nil
+}
+
+func (t *targetConn) dial() (net.Conn, error) {
+	if t.unix != nil {
+		// Local sockets are never reached through the proxy.
+		return dialUnixTarget(t.unix)
+	}
+	if t.opts.proxy != nil {
+		if t.tcp {
+			return t.secure(dialProxyTCP(t.opts.proxy, t.addr, t.opts))
+		}
+		return dialProxyUDP(t.opts.proxy, t.addr, t.opts)
+	}
+	if t.tcp {
+		return t.secure(dialTCPTarget(t.addr, t.opts))
+	}
+	return dialTarget(t.network, t.addr, t.opts)
+}
+
+// secure wraps a new connection to a tls:// target in TLS.
+func (t *targetConn) secure(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil || t.tls == nil {
+		return conn, err
+	}
+	return handshakeTLS(conn, t.tls)
+}
+
+// setLocal records the local address of a UDP socket; TCP connections
+// cannot be the source of received packets.
+func (t *targetConn) setLocal(conn net.Conn) {
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		t.local.Store(local)
+	}
+}
+
+// setLimit changes the target's rate limit. An unchanged limit keeps the
+// current bucket and its tokens.
+func (t *targetConn) setLimit(limit RateLimit) {
+	current := t.limiter.Load()
+	switch {
+	case limit.rate == 0:
+		t.limiter.Store(nil)
+	case current == nil || current.limit != limit:
+		t.limiter.Store(newTokenBucket(limit))
+	}
+}
+
+// allow reports whether a packet of size bytes is within the target's rate
+// limit.
+func (t *targetConn) allow(size int) bool {
+	limiter := t.limiter.Load()
+	return limiter == nil || limiter.allow(size)
+}
+
+func (t *targetConn) write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, errTargetClosed
+	}
+	if t.coalesce != nil {
+		return t.coalesced(data)
+	}
+	return t.writeLocked(data)
+}
+
+// writeLocked writes data to the target, connecting first if needed. t.mu
+// is held.
+func (t *targetConn) writeLocked(data []byte) (int, error) {
+	if t.conn == nil {
+		conn, err := t.dial()
+		if err != nil {
+			return 0, fmt.Errorf("failed to connect: %w", err)
+		}
+		t.conn = conn
+		t.setLocal(conn)
+	}
+
+	if timeout := t.writeTimeout(); timeout > 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	var n int
+	var err error
+	switch {
+	case t.tls != nil:
+		t.frame = appendFrame(t.frame[:0], data)
+		if _, err = t.conn.Write(t.frame); err == nil {
+			n = len(data)
+		}
+	case t.tcp:
+		n, err = writeFrame(t.conn, data)
+	default:
+		n, err = writeDatagram(t.conn, data)
+		if errors.Is(err, io.ErrShortWrite) {
+			// The datagram went out truncated; the socket itself is fine.
+			return n, err
+		}
+	}
+	if err != nil && !errors.Is(err, errnoMsgSize) {
+		// A datagram too big for the path leaves the socket usable, and
+		// keeps the path MTU it learned.
+		t.conn.Close()
+		t.conn = nil
+	}
+	return n, err
+}
+
+// writeDatagram writes data to w as one datagram. A write that reports
+// fewer bytes sent than data holds fails with io.ErrShortWrite.
+func writeDatagram(w io.Writer, data []byte) (int, error) {
+	n, err := w.Write(data)
+	if err == nil && n < len(data) {
+		return n, fmt.Errorf("%w: sent %d of %d bytes", io.ErrShortWrite, n, len(data))
+	}
+	return n, err
+}
+
+// writeTimeout is how long a write to the target may block before it fails,
+// or 0 for no limit.
+func (t *targetConn) writeTimeout() time.Duration {
+	if t.opts.writeTimeout == 0 && t.tcp {
+		return tcpTimeout
+	}
+	return t.opts.writeTimeout
+}
+
+func (t *targetConn) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.coalesce != nil && !t.closed {
+		// Send what is batched; nobody is left to hear of an error.
+		t.flush()
+	}
+	t.closed = true
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// Stats holds the relay's counters. Its methods are safe for concurrent
+// use; the fields are only safe to read through them.
+type Stats struct {
+	PacketsReceived  uint64
+	PacketsForwarded uint64
+	BytesReceived    uint64
+	BytesForwarded   uint64
+	PacketsFiltered  uint64
+	PacketsDuplicate uint64
+	PacketsRewritten uint64
+	// PacketsDenied counts packets not forwarded because of their source
+	// address, under -allow-src and -deny-src.
+	PacketsDenied uint64
+	// PacketsSampled counts packets not forwarded to a target because of
+	// its -sample ratio.
+	PacketsSampled uint64
+	// PacketsDropped counts packets dropped by a rate limit: per-target
+	// drops, and received packets over -max-receive-rate, which are also
+	// counted in ReceiveDropped.
+	PacketsDropped uint64
+	ReceiveDropped uint64
+	// LoopDropped counts received packets dropped by -loop-guard.
+	LoopDropped uint64
+	// Truncated counts received packets that filled the read buffer, and
+	// so were probably longer than -buffer and cut short.
+	Truncated uint64
+	// ChaosDropped counts forwards dropped on purpose by -chaos-drop.
+	ChaosDropped uint64
+	// NoTargets counts received packets not forwarded because every target
+	// had been removed.
+	NoTargets uint64
+	// TooBig counts forwards that failed because the packet was larger
+	// than the path MTU allows without fragmenting it, under -no-fragment.
+	TooBig uint64
+	// QueueDropped counts received packets dropped because -max-queue
+	// packets were already waiting for a worker.
+	QueueDropped uint64
+	// KernelDropped counts packets the kernel dropped before the relay
+	// read them because a listen socket's receive buffer was full (Linux).
+	KernelDropped uint64
+	Errors        uint64
+	Targets       map[string]*TargetStats
+	// Ports holds the receive counters per listen port, keyed by port,
+	// when the relay listens on more than one.
+	Ports map[string]*PortStats
+	// Rates is the throughput over the last stats interval, filled in by
+	// the stats reporter.
+	Rates Rates
+	mu    sync.RWMutex
+}
+
+// TargetStats holds the counters for a single forwarding target.
+type TargetStats struct {
+	PacketsForwarded uint64 `json:"packets_forwarded"`
+	BytesForwarded   uint64 `json:"bytes_forwarded"`
+	PacketsDropped   uint64 `json:"packets_dropped"`
+	PacketsSampled   uint64 `json:"packets_sampled"`
+	ChaosDropped     uint64 `json:"packets_chaos_dropped"`
+	Errors           uint64 `json:"errors"`
+	// TooBig counts the errors that were packets too big for the path.
+	TooBig uint64 `json:"packets_too_big,omitempty"`
+	// Keepalives counts the -keepalive-interval heartbeats sent, which
+	// are not counted as forwarded.
+	Keepalives uint64 `json:"keepalives,omitempty"`
+	// BytesUncompressed and BytesCompressed count what was forwarded
+	// under -compress before and after compression.
+	BytesUncompressed uint64 `json:"bytes_uncompressed,omitempty"`
+	BytesCompressed   uint64 `json:"bytes_compressed,omitempty"`
+	// Down is set while the target refuses packets (ICMP port unreachable).
+	Down bool `json:"down"`
+	// Breaker is the state of the target's circuit breaker, omitted while
+	// it is closed.
+	Breaker string `json:"breaker,omitempty"`
+	// Active is set for the target packets go to in failover mode, filled
+	// in by Relay.Snapshot.
+	Active bool `json:"active,omitempty"`
+}
+
+// PortStats holds the receive counters for a single listen port.
+type PortStats struct {
+	PacketsReceived uint64 `json:"packets_received"`
+	BytesReceived   uint64 `json:"bytes_received"`
+}
+
+// AddReceived counts a received packet, and also counts it for port unless
+// port is empty.
+func (s *Stats) AddReceived(port string, bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsReceived++
+	s.BytesReceived += uint64(bytes)
+
+	if port != "" {
+		ps := s.Ports[port]
+		if ps == nil {
+			ps = &PortStats{}
+			if s.Ports == nil {
+				s.Ports = make(map[string]*PortStats)
+			}
+			s.Ports[port] = ps
+		}
+		ps.PacketsReceived++
+		ps.BytesReceived += uint64(bytes)
+	}
+}
+
+// AddForwarded records a packet of bytes forwarded to target.
+func (s *Stats) AddForwarded(target string, bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsForwarded++
+	s.BytesForwarded += uint64(bytes)
+
+	ts := s.target(target)
+	ts.PacketsForwarded++
+	ts.BytesForwarded += uint64(bytes)
+}
+
+// target returns the counters for target, creating them on first use.
+// The caller must hold s.mu for writing.
+func (s *Stats) target(target string) *TargetStats {
+	if s.Targets == nil {
+		s.Targets = make(map[string]*TargetStats)
+	}
+	ts, ok := s.Targets[target]
+	if !ok {
+		ts = &TargetStats{}
+		s.Targets[target] = ts
+	}
+	return ts
+}
+
+// AddFiltered records a received packet that was not forwarded because of
+// its size or content.
+func (s *Stats) AddFiltered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsFiltered++
+}
+
+// AddDuplicate records a received packet suppressed by -dedup-window.
+func (s *Stats) AddDuplicate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsDuplicate++
+}
+
+// AddRewritten records a packet changed by -rewrite.
+func (s *Stats) AddRewritten() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsRewritten++
+}
+
+// AddDropped records a packet to target dropped by its rate limit.
+func (s *Stats) AddDropped(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsDropped++
+	s.target(target).PacketsDropped++
+}
+
+// AddSampled records a packet to target left out by its -sample ratio.
+func (s *Stats) AddSampled(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsSampled++
+	s.target(target).PacketsSampled++
+}
+
+// AddCompressed records a packet of raw bytes forwarded to target as
+// compressed bytes.
+func (s *Stats) AddCompressed(target string, raw, compressed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.target(target)
+	ts.BytesUncompressed += uint64(raw)
+	ts.BytesCompressed += uint64(compressed)
+}
+
+// AddChaosDropped records a forward to target dropped by -chaos-drop.
+func (s *Stats) AddChaosDropped(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ChaosDropped++
+	s.target(target).ChaosDropped++
+}
+
+// AddTooBig records a failed forward to target of a packet larger than the
+// path MTU, which is also counted as an error.
+func (s *Stats) AddTooBig(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.TooBig++
+	s.target(target).TooBig++
+}
+
+// AddReceiveDropped records a received packet dropped by -max-receive-rate.
+func (s *Stats) AddReceiveDropped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsDropped++
+	s.ReceiveDropped++
+}
+
+// AddDenied records a packet not forwarded because of its source address.
+func (s *Stats) AddDenied() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PacketsDenied++
+}
+
+// AddLoopDropped records a received packet dropped by -loop-guard.
+func (s *Stats) AddLoopDropped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LoopDropped++
+}
+
+// AddTruncated records a received packet that filled the read buffer.
+func (s *Stats) AddTruncated() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Truncated++
+}
+
+// AddNoTargets records a received packet not forwarded because there were
+// no targets.
+func (s *Stats) AddNoTargets() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.NoTargets++
+}
+
+// AddKeepalive records a heartbeat sent to target.
+func (s *Stats) AddKeepalive(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target(target).Keepalives++
+}
+
+// AddKernelDropped records n packets the kernel dropped on a full receive
+// buffer.
+func (s *Stats) AddKernelDropped(n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.KernelDropped += n
+}
+
+// AddQueueDropped records a received packet dropped because the forward
+// queue was full.
+func (s *Stats) AddQueueDropped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.QueueDropped++
+}
+
+// AddError records an error. Forwarding errors name the target they
+// occurred for; receive errors pass an empty target and only count toward
+// the total.
+func (s *Stats) AddError(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Errors++
+	if target != "" {
+		s.target(target).Errors++
+	}
+}
+
+// Rates is packet and byte throughput per second.
+type Rates struct {
+	ReceivedPPS  float64 `json:"received_pps"`
+	ReceivedBPS  float64 `json:"received_bps"`
+	ForwardedPPS float64 `json:"forwarded_pps"`
+	ForwardedBPS float64 `json:"forwarded_bps"`
+}
+
+// updateRates computes Rates from the change between two snapshots taken
+// elapsed apart.
+func (s *Stats) updateRates(prev, cur StatsSnapshot, elapsed time.Duration) {
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		return
+	}
+	rates := Rates{
+		ReceivedPPS:  float64(cur.PacketsReceived-prev.PacketsReceived) / secs,
+		ReceivedBPS:  float64(cur.BytesReceived-prev.BytesReceived) / secs,
+		ForwardedPPS: float64(cur.PacketsForwarded-prev.PacketsForwarded) / secs,
+		ForwardedBPS: float64(cur.BytesForwarded-prev.BytesForwarded) / secs,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Rates = rates
+}
+
+// SetDown records whether target is down.
+func (s *Stats) SetDown(target string, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target(target).Down = down
+}
+
+// setBreaker records the state of target's circuit breaker.
+func (s *Stats) setBreaker(target string, state breakerState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == breakerClosed {
+		s.target(target).Breaker = ""
+	} else {
+		s.target(target).Breaker = state.String()
+	}
+}
+
+// addTarget registers target so that it is reported even before any packet
+// has been forwarded to it.
+func (s *Stats) addTarget(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target(target)
+}
+
+func (s *Stats) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: %d packets (%d bytes), Forwarded: %d packets (%d bytes), Filtered: %d, Duplicates: %d, Rewritten: %d, Denied: %d, Sampled out: %d, Dropped: %d (%d on receive), Loops: %d, Truncated: %d, Chaos dropped: %d, No targets: %d, Queue full: %d, Kernel dropped: %d, Errors: %d (%d too big)",
+		s.PacketsReceived, s.BytesReceived, s.PacketsForwarded, s.BytesForwarded,
+		s.PacketsFiltered, s.PacketsDuplicate, s.PacketsRewritten, s.PacketsDenied, s.PacketsSampled, s.PacketsDropped, s.ReceiveDropped, s.LoopDropped, s.Truncated, s.ChaosDropped, s.NoTargets, s.QueueDropped, s.KernelDropped, s.Errors, s.TooBig)
+	fmt.Fprintf(&b, ", Rate: in %.1f pkt/s (%.0f B/s), out %.1f pkt/s (%.0f B/s)",
+		s.Rates.ReceivedPPS, s.Rates.ReceivedBPS, s.Rates.ForwardedPPS, s.Rates.ForwardedBPS)
+	for _, name := range sortedKeys(s.Targets) {
+		ts := s.Targets[name]
+		fmt.Fprintf(&b, "; %s: %d packets (%d bytes), %d sampled out, %d dropped, %d errors",
+			name, ts.PacketsForwarded, ts.BytesForwarded, ts.PacketsSampled, ts.PacketsDropped, ts.Errors)
+		if ts.ChaosDropped > 0 {
+			fmt.Fprintf(&b, " (%d chaos dropped)", ts.ChaosDropped)
+		}
+		if ts.TooBig > 0 {
+			fmt.Fprintf(&b, " (%d too big)", ts.TooBig)
+		}
+		if ts.Keepalives > 0 {
+			fmt.Fprintf(&b, " (%d keepalives)", ts.Keepalives)
+		}
+		if ts.BytesUncompressed > 0 {
+			fmt.Fprintf(&b, " (compressed from %d bytes)", ts.BytesUncompressed)
+		}
+		if ts.Down {
+			b.WriteString(" (down)")
+		}
+		if ts.Breaker != "" {
+			fmt.Fprintf(&b, " (breaker %s)", ts.Breaker)
+		}
+	}
+	for _, port := range sortedKeys(s.Ports) {
+		ps := s.Ports[port]
+		fmt.Fprintf(&b, "; port %s: %d packets (%d bytes) received", port, ps.PacketsReceived, ps.BytesReceived)
+	}
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// StatsSnapshot is a point-in-time copy of Stats. It shares no memory with
+// them, and may be kept and read freely.
+type StatsSnapshot struct {
+	PacketsReceived  uint64 `json:"packets_received"`
+	PacketsForwarded uint64 `json:"packets_forwarded"`
+	BytesReceived    uint64 `json:"bytes_received"`
+	BytesForwarded   uint64 `json:"bytes_forwarded"`
+	PacketsFiltered  uint64 `json:"packets_filtered"`
+	PacketsDuplicate uint64 `json:"packets_duplicate"`
+	PacketsRewritten uint64 `json:"packets_rewritten"`
+	PacketsDenied    uint64 `json:"packets_denied"`
+	PacketsSampled   uint64 `json:"packets_sampled"`
+	PacketsDropped   uint64 `json:"packets_dropped"`
+	ReceiveDropped   uint64 `json:"packets_receive_dropped"`
+	LoopDropped      uint64 `json:"packets_loop_dropped"`
+	Truncated        uint64 `json:"packets_truncated"`
+	ChaosDropped     uint64 `json:"packets_chaos_dropped"`
+	NoTargets        uint64 `json:"packets_no_targets"`
+	QueueDropped     uint64 `json:"packets_queue_dropped"`
+	KernelDropped    uint64 `json:"packets_kernel_dropped"`
+	TooBig           uint64 `json:"packets_too_big"`
+	// QueueDepth is the number of packets waiting for a worker, filled in
+	// by Relay.Snapshot.
+	QueueDepth int                    `json:"queue_depth"`
+	Errors     uint64                 `json:"errors"`
+	Targets    map[string]TargetStats `json:"targets"`
+	Ports      map[string]PortStats   `json:"ports,omitempty"`
+	Rates      Rates                  `json:"rates"`
+}
+
+// Snapshot returns a copy of the counters, all taken at once.
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := StatsSnapshot{
+		PacketsReceived:  s.PacketsReceived,
+		PacketsForwarded: s.PacketsForwarded,
+		BytesReceived:    s.BytesReceived,
+		BytesForwarded:   s.BytesForwarded,
+		PacketsFiltered:  s.PacketsFiltered,
+		PacketsDuplicate: s.PacketsDuplicate,
+		PacketsRewritten: s.PacketsRewritten,
+		PacketsDenied:    s.PacketsDenied,
+		PacketsSampled:   s.PacketsSampled,
+		PacketsDropped:   s.PacketsDropped,
+		ReceiveDropped:   s.ReceiveDropped,
+		LoopDropped:      s.LoopDropped,
+		Truncated:        s.Truncated,
+		ChaosDropped:     s.ChaosDropped,
+		NoTargets:        s.NoTargets,
+		QueueDropped:     s.QueueDropped,
+		KernelDropped:    s.KernelDropped,
+		TooBig:           s.TooBig,
+		Errors:           s.Errors,
+		Targets:          make(map[string]TargetStats, len(s.Targets)),
+		Rates:            s.Rates,
+	}
+	for name, ts := range s.Targets {
+		snap.Targets[name] = *ts
+	}
+	if len(s.Ports) > 0 {
+		snap.Ports = make(map[string]PortStats, len(s.Ports))
+		for port, ps := range s.Ports {
+			snap.Ports[port] = *ps
+		}
+	}
+	return snap
+}
+
+// listFlag is a comma-separated list flag. Empty items are dropped.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// ErrNoTargets is reported when neither the flags nor the config file name
+// any target.
+var ErrNoTargets = errors.New("-targets is required (or set targets in the config file)")
+
+// FlagError is a command-line parse error. The flag package has already
+// printed it along with the usage text.
+type FlagError struct{ err error }
+
+func (e *FlagError) Error() string { return e.err.Error() }
+func (e *FlagError) Unwrap() error { return e.err }
+
+// newFlagSet defines the command-line flags, binding them to config. The
+// -targets value is stored in targets for parsing after the fact.
+func newFlagSet(config *Config, targets *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.StringVar(&config.ConfigFile, "config", "", "Path to a YAML or JSON config file (flags override values from the file)")
+	fs.Var(&config.ListenPorts, "port", "UDP port to listen for broadcast packets, or a comma-separated list of `ports` to listen on each")
+	fs.Var(&config.TargetPortMap, "target-port-map", "Send the packets received on a listen port to another port at every target but Unix sockets, as comma-separated `listen=target` ports, e.g., 9999=8888,10000=10001; targets keep their own port for the other listen ports")
+	fs.StringVar(&config.ListenAddr, "listen", config.ListenAddr, "Address to listen on (use 0.0.0.0 or :: for all interfaces, :: also accepts IPv6)")
+	fs.StringVar(targets, "targets", "", "Comma-separated list of target addresses (ip:port, tcp://ip:port to forward over TCP, tls://host:port to forward over TLS, unixgram:/path for a Unix datagram socket, or srv://name for the targets listed by its DNS SRV records), e.g., 192.168.1.100:9999,[fe80::1%eth0]:8888")
+	fs.StringVar(&config.TargetsFile, "targets-file", "", "File listing more targets, one per line as in -targets, with # comments; it is re-read whenever it changes")
+	fs.BoolVar(&config.ReusePort, "reuseport", false, "Set SO_REUSEPORT on the listen socket so several relays can share the port (Linux load-balances between them)")
+	fs.BoolVar(&config.DryRun, "dry-run", false, "Receive, filter and log packets without forwarding them to the targets")
+	fs.BoolVar(&config.Once, "once", false, "Exit after forwarding the first packet that passes the filters; the exit status is 1 if no target got it (combine with -idle-timeout to give up waiting)")
+	fs.BoolVar(&config.LoopGuard, "loop-guard", false, "Mark forwarded packets with this relay's ID and drop received packets it already marked, to stop loops between relays that all use -loop-guard")
+	fs.UintVar(&config.RelayID, "relay-id", 0, "ID (1-4294967295) this relay marks packets with under -loop-guard (random if 0)")
+	fs.BoolVar(&config.AllowLoopback, "allow-loopback", false, "Also forward a packet to a target with the same address and port as its source, which is skipped by default to avoid loops")
+	fs.BoolVar(&config.HostLoopGuard, "host-loop-guard", false, "Treat every IP address of this host as the relay's own: drop packets from its forwarding ports and skip UDP targets on its listen ports at any of them")
+	fs.BoolVar(&config.Timestamp, "timestamp", false, "Prefix forwarded packets with a 16-byte header: a per-target 8-byte sequence number and the 8-byte send time in nanoseconds, both big-endian")
+	fs.StringVar(&config.Compress, "compress", "", "Compress forwarded packets for relays with -decompress: `gzip`, lz4 or none")
+	fs.BoolVar(&config.Decompress, "decompress", false, "Restore received packets compressed by a relay with -compress; others are forwarded as they are")
+	fs.BoolVar(&config.PrependSource, "prepend-source", false, "Prefix forwarded packets with their source address: the IP (4 bytes when listening on IPv4, else 16) and the 2-byte big-endian port")
+	fs.StringVar(&config.Interface, "interface", "", "Only relay packets arriving on this network interface, e.g., eth1 (Linux and macOS)")
+	fs.BoolVar(&config.SkipBadTargets, "skip-bad-targets", false, "Skip targets that cannot be resolved instead of exiting")
+	fs.DurationVar(&config.DNSRefresh, "dns-refresh", 0, "How often to resolve targets given by hostname and srv:// targets again and follow changes, e.g., 1m (0 to resolve only at startup)")
+	fs.BoolVar(&config.Preflight, "preflight", false, "At startup, send an empty datagram to each UDP target (or connect to each TCP and unixgram target) and log which are reachable and which refuse")
+	fs.DurationVar(&config.PreflightTimeout, "preflight-timeout", config.PreflightTimeout, "How long -preflight waits for refusals before startup continues")
+	fs.Var((*listFlag)(&config.MulticastGroups), "multicast-groups", "Comma-separated list of multicast groups to join on the listen socket, e.g., 239.255.255.250,ff02::c")
+	fs.StringVar(&config.MulticastInterface, "multicast-interface", "", "Network interface to join multicast groups on (defaults to -interface, or the system default)")
+	fs.BoolVar(&config.Transparent, "transparent", false, "Forward with the original sender's source address (Linux, IPv4 only, requires root or CAP_NET_RAW)")
+	fs.StringVar(&config.InputMode, "input", config.InputMode, "Input mode: broadcast, or multicast to require -multicast-groups")
+	fs.StringVar(&config.OutputMode, "output", config.OutputMode, "Output mode: unicast to the targets, or broadcast to also re-broadcast on the local subnets at the listen port")
+	fs.IntVar(&config.MinSize, "min-size", 0, "Do not forward packets smaller than this many bytes (0 for no minimum)")
+	fs.IntVar(&config.MaxSize, "max-size", 0, "Do not forward packets larger than this many bytes (0 for no maximum)")
+	fs.IntVar(&config.DSCP, "dscp", 0, "DSCP value (0-63) to mark forwarded packets with, e.g., 46 for EF (0 leaves the default)")
+	fs.IntVar(&config.BufferSize, "buffer", config.BufferSize, "Socket receive buffer size in bytes, also the longest packet read in full, up to 65535")
+	fs.IntVar(&config.TTL, "ttl", 0, "TTL (IPv4) or hop limit (IPv6), 1-255, of forwarded packets, including multicast (0 leaves the default)")
+	fs.BoolVar(&config.NoFragment, "no-fragment", false, "Set Don't Fragment on packets to UDP targets and count those too big for the path MTU instead of letting them be fragmented (Linux, macOS and Windows)")
+	fs.IntVar(&config.SourcePort, "source-port", 0, "Local UDP `port` to forward packets from, shared by all UDP targets (0 lets the system pick)")
+	fs.StringVar(&config.EgressAddr, "egress-addr", "", "Local IP `address` to forward packets from, selecting the outgoing interface on a multi-homed host; it must be assigned to this host (system default if empty)")
+	fs.StringVar(&config.Proxy, "proxy", "", "Forward through the SOCKS5 proxy at `url`, socks5://[user:password@]host:port, using UDP ASSOCIATE for UDP targets (direct if empty)")
+	fs.StringVar(&config.TLSCA, "tls-ca", "", "PEM `file` of CA certificates to verify tls:// targets against instead of the system roots")
+	fs.BoolVar(&config.TLSInsecure, "tls-insecure", false, "Do not verify the certificates of tls:// targets (for testing only)")
+	fs.BoolVar(&config.Coalesce, "coalesce", false, "Batch the packets for each UDP and Unix socket target into larger datagrams of length-prefixed frames, sent once -coalesce-bytes is reached or -coalesce-delay has passed")
+	fs.IntVar(&config.CoalesceBytes, "coalesce-bytes", config.CoalesceBytes, "Maximum size of a -coalesce datagram in bytes; a longer packet is sent alone")
+	fs.DurationVar(&config.CoalesceDelay, "coalesce-delay", config.CoalesceDelay, "Maximum time a packet waits in a -coalesce batch")
+	fs.DurationVar(&config.WriteTimeout, "write-timeout", 0, "Fail a write to a target that blocks for longer than this, counting it as an error, e.g., 100ms (0 for no limit, except 2s for TCP targets)")
+	fs.StringVar(&config.Mode, "mode", config.Mode, "Forwarding mode: fanout to every target, balance to send each packet to one target by weighted round-robin, or failover to send it to the first target in order that is up")
+	fs.DurationVar(&config.FailbackDelay, "failback-delay", config.FailbackDelay, "In failover mode, how long a target before the active one must stay up after coming back before it takes over again (0 at once)")
+	fs.Var(&config.MatchPrefixes, "match-prefix", "Only forward packets whose payload starts with one of these comma-separated `hex` prefixes, e.g., 4d5a,cafe")
+	fs.Var(&config.DropPrefixes, "drop-prefix", "Do not forward packets whose payload starts with one of these comma-separated `hex` prefixes")
+	fs.Var(&config.MatchRegexp, "match-regexp", "Only forward packets whose payload matches this regular `expression` (Go RE2 syntax, unanchored), e.g., ^(M-SEARCH|NOTIFY)")
+	fs.Var(&config.AllowSrc, "allow-src", "Only forward packets from these comma-separated source `networks`, in CIDR notation or as IP addresses, e.g., 192.168.1.0/24,10.0.0.5 (all sources if empty)")
+	fs.Var(&config.DenySrc, "deny-src", "Do not forward packets from these comma-separated source `networks`, even if -allow-src includes them")
+	fs.Var(&config.Rewrites, "rewrite", "Replace every occurrence of a byte sequence in forwarded payloads, as `from=to` in hex, e.g., 6f6c64=6e6577 (repeat for several rules, applied in order)")
+	fs.Float64Var(&config.ChaosDrop, "chaos-drop", 0, "For testing: fraction of forwards to drop at random, e.g., 0.05 for 5% (0 to disable)")
+	fs.DurationVar(&config.ChaosDelay, "chaos-delay", 0, "For testing: delay every forward by a random time up to this, e.g., 50ms (0 to disable)")
+	fs.Var(&config.Sample, "sample", "Forward only one of every N packets to each target, as `1/N`, e.g., 1/10 (every packet if empty)")
+	fs.Var(&config.RateLimit, "rate-limit", "Maximum forwarding `rate` per target, in packets (200p/s) or bytes (1MB/s) per second; excess packets are dropped (unlimited if empty)")
+	fs.DurationVar(&config.DedupWindow, "dedup-window", 0, "Suppress packets identical to one from the same source seen within this window, e.g., 200ms (0 to disable)")
+	fs.Var(&config.MaxReceiveRate, "max-receive-rate", "Maximum total `rate` of received packets to process, in packets (5000p/s) or bytes (10MB/s) per second; excess packets are dropped on arrival (unlimited if empty)")
+	fs.IntVar(&config.Workers, "workers", config.Workers, "Number of forwarding workers (defaults to the number of CPUs)")
+	fs.IntVar(&config.FanoutConcurrency, "fanout-concurrency", config.FanoutConcurrency, "Number of targets each worker forwards a packet to in parallel (1 forwards to them one after another)")
+	fs.IntVar(&config.MaxQueue, "max-queue", config.MaxQueue, "Maximum number of received packets waiting for a forwarding worker; further packets are dropped and counted")
+	fs.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "Maximum time to wait for in-flight forwards on shutdown (0 to skip waiting)")
+	fs.DurationVar(&config.StatsInterval, "stats-interval", config.StatsInterval, "How often to log stats (0 to disable); stats are logged with -verbose or when this is set")
+	fs.DurationVar(&config.ErrorLogInterval, "error-log-interval", config.ErrorLogInterval, "Log a repeated error, of the same target and error, at most once per interval, with a count of the repeats at its end (0 logs every error)")
+	fs.BoolVar(&config.TUI, "tui", false, "Show a live dashboard of the rates, totals and targets on standard output, redrawn every second, with the latest log lines (needs an ANSI terminal)")
+	fs.DurationVar(&config.KeepaliveInterval, "keepalive-interval", 0, "Send a heartbeat to every target that has been sent nothing for this long, to keep NAT mappings and connections open, e.g., 30s (0 to disable)")
+	fs.Var(&config.KeepalivePayload, "keepalive-payload", "Heartbeat payload for -keepalive-interval, in `hex` (an empty datagram, or an empty frame for TCP targets, if empty)")
+	fs.DurationVar(&config.IdleTimeout, "idle-timeout", 0, "Stop and exit with status 3 when no packet is received for this long, e.g., 10m (0 to run until stopped)")
+	fs.DurationVar(&config.MaxLifetime, "max-lifetime", 0, "Restart the relay by re-executing it with the same arguments after it has run this long, e.g., 24h (0 to disable; not supported on Windows)")
+	fs.StringVar(&config.MetricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g., :9100 (disabled if empty)")
+	fs.IntVar(&config.ForwardRetries, "forward-retries", 0, "Number of times to retry a failed forward before counting an error")
+	fs.DurationVar(&config.RetryDelay, "retry-delay", config.RetryDelay, "Delay before the first retry of a failed forward, doubled for each further retry")
+	fs.IntVar(&config.BreakerFailures, "breaker-failures", 0, "Skip a target after this many consecutive forwarding errors within -breaker-window (0 disables the circuit breaker)")
+	fs.DurationVar(&config.BreakerWindow, "breaker-window", config.BreakerWindow, "Time within which -breaker-failures consecutive errors open a target's circuit breaker")
+	fs.DurationVar(&config.BreakerCooldown, "breaker-cooldown", config.BreakerCooldown, "How long a target with an open circuit breaker is skipped before a packet is sent as a probe")
+	fs.StringVar(&config.ControlAddr, "control-addr", "", "Address to serve the target control API on at /targets, e.g., 127.0.0.1:9101 (disabled if empty)")
+	fs.StringVar(&config.OTLPEndpoint, "otlp-endpoint", "", "OpenTelemetry collector URL to push metrics to over OTLP, e.g., http://localhost:4318 (overrides OTEL_EXPORTER_OTLP_ENDPOINT; disabled if both are empty)")
+	fs.DurationVar(&config.OTLPInterval, "otlp-interval", config.OTLPInterval, "How often to push metrics to the -otlp-endpoint")
+	fs.StringVar(&config.StatsAddr, "stats-addr", "", "Address to serve JSON stats on at /stats, e.g., :8080 (disabled if empty)")
+	fs.StringVar(&config.StatsFile, "stats-file", "", "JSON `file` to save the stats counters to, which they are added to on start, for totals over restarts (disabled if empty)")
+	fs.DurationVar(&config.StatsFileInterval, "stats-file-interval", config.StatsFileInterval, "How often to save the stats to the -stats-file; they are also saved on stop and on SIGUSR1")
+	fs.BoolVar(&config.TrackSources, "track-sources", false, "Count received packets and bytes per source IP, shown at /stats and, for the busiest sources, in the stats log")
+	fs.IntVar(&config.TrackSourcesMax, "track-sources-max", config.TrackSourcesMax, "Maximum number of source IPs -track-sources counts; when full, the least active are evicted")
+	fs.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Log output format: text or json")
+	fs.StringVar(&config.HealthAddr, "health-addr", "", "Address to serve liveness and readiness probes on at /healthz and /readyz, e.g., :8081 (disabled if empty)")
+	fs.StringVar(&config.DebugAddr, "debug-addr", "", "Address to serve build, runtime and config information on at /debug/info, and profiles at /debug/pprof/, e.g., 127.0.0.1:6060 (disabled if empty)")
+	fs.StringVar(&config.GRPCAddr, "grpc-addr", "", "Address to serve the gRPC Subscribe stream of received packets on, e.g., 127.0.0.1:9102 (disabled if empty)")
+	fs.TextVar(&config.LogLevel, "log-level", config.LogLevel, "Minimum log `level`: debug, info, warn or error")
+	fs.BoolVar(&config.Verbose, "verbose", false, "Enable verbose logging (same as -log-level debug)")
+	fs.StringVar(&config.AccessLog, "access-log", "", "File to append a JSON line to for every received packet, with its source, size and targets")
+	fs.BoolVar(&config.ShowVersion, "version", false, "Show version information")
+	fs.BoolVar(&config.ListInterfaces, "list-interfaces", false, "List the network interfaces with their flags, addresses and broadcast addresses, then exit")
+	fs.StringVar(&config.Service, "service", "", "Install the relay as a Windows service that runs with the other flags given, or uninstall it (`install` or uninstall)")
+	fs.BoolVar(&config.JSONErrors, "json-errors", false, "Print a fatal error to stderr as one JSON object with its message, class (usage, config, bind or runtime) and exit status")
+	fs.StringVar(&config.PcapFile, "pcap", "", "File to write received packets to in pcap format, with synthesized IP and UDP headers, for Wireshark")
+	fs.BoolVar(&config.PcapForwarded, "pcap-forwarded", false, "Also write forwarded packets to the -pcap file")
+	fs.StringVar(&config.DumpRaw, "dump-raw", "", "File to write the payload of every received packet to, each prefixed with its length as 4 bytes big-endian, as -replay reads")
+	fs.StringVar(&config.Replay, "replay", "", "Forward the UDP packets of a pcap or pcapng `file`, or of length-framed records as sent to tcp:// targets, instead of listening (\"-\" reads standard input)")
+	fs.Float64Var(&config.ReplaySpeed, "replay-speed", config.ReplaySpeed, "Speed of -replay relative to the capture's timing, e.g., 2 for twice as fast (0 replays as fast as possible)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Broadcast Relay - Forward local broadcast packets to specified IP:Port\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEvery option can also be set with an environment variable named after it,\n")
+		fmt.Fprintf(os.Stderr, "e.g. %s for -port or %s for -log-format. Flags take precedence.\n", envName("port"), envName("log-format"))
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s -port 9999 -targets 192.168.1.100:9999\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -port 9999 -targets 192.168.1.100:9999,10.0.0.50:8888 -verbose\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -listen 0.0.0.0 -port 12345 -targets 192.168.2.1:12345\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -port 9999,12345 -targets 192.168.1.100:9999\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -listen :: -port 9999 -targets [2001:db8::10]:9999,192.168.1.100:9999\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -config relay.yaml -verbose\n", os.Args[0])
+	}
+
+	return fs
+}
+
+// Usage prints the command-line usage to standard error.
+func Usage() {
+	newFlagSet(DefaultConfig(), new(string)).Usage()
+}
+
+// LoadConfig builds the configuration from command-line arguments and the
+// config file they name, if any. It has no side effects, so it can be run
+// again to reload the configuration.
+func LoadConfig(args []string) (*Config, error) {
+	config, err := loadConfig(args)
+	var flagErr *FlagError
+	if err != nil && !errors.As(err, &flagErr) && !errors.Is(err, flag.ErrHelp) {
+		return nil, classify(ErrConfig, err)
+	}
+	return config, err
+}
+
+func loadConfig(args []string) (*Config, error) {
+	config := DefaultConfig()
+	var targets string
+	fs := newFlagSet(config, &targets)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, &FlagError{err}
+	}
+	// Environment variables count as flags, so they override the config
+	// file too.
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case config.Service != "" && config.Service != "install" && config.Service != "uninstall":
+		return nil, fmt.Errorf("-service must be install or uninstall, not %q", config.Service)
+	case config.Service != "" && runtime.GOOS != "windows":
+		return nil, errors.New("-service is only supported on Windows")
+	}
+	// Uninstalling needs no targets.
+	if config.ShowVersion || config.ListInterfaces || config.Service == "uninstall" {
+		return config, nil
+	}
+
+	// Parse target addresses
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if target != "" {
+			config.TargetAddrs = append(config.TargetAddrs, target)
+		}
+	}
+
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	config.statsIntervalSet = setFlags["stats-interval"]
+
+	if config.ConfigFile != "" {
+		fileConfig, err := LoadConfigFile(config.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfigFile(config, fileConfig, setFlags)
+	}
+
+	if _, err := NewLogger(io.Discard, config.LogFormat, config.LogLevel); err != nil {
+		return nil, err
+	}
+	if config.Verbose && config.LogLevel > slog.LevelDebug {
+		config.LogLevel = slog.LevelDebug
+	}
+
+	if len(config.TargetAddrs) == 0 && targets != "" && config.OutputMode != OutputBroadcast {
+		return nil, fmt.Errorf("%w: at least one valid target address is required", ErrNoTargets)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// validate checks the settings NewRelay depends on. Errors name the
+// command-line flag of the offending setting.
+func (config *Config) validate() error {
+	if len(config.ListenPorts) == 0 {
+		return errors.New("-port is required")
+	}
+	if err := config.TargetPortMap.validate(config); err != nil {
+		return err
+	}
+	if config.Workers < 1 {
+		return errors.New("-workers must be at least 1")
+	}
+	if config.FanoutConcurrency < 1 {
+		return errors.New("-fanout-concurrency must be at least 1")
+	}
+	if config.MaxQueue < 1 {
+		return errors.New("-max-queue must be at least 1")
+	}
+	if config.BufferSize < 1 || config.BufferSize > maxBufferSize {
+		return fmt.Errorf("-buffer %d is out of range 1-%d", config.BufferSize, maxBufferSize)
+	}
+
+	if config.ForwardRetries < 0 {
+		return errors.New("-forward-retries must not be negative")
+	}
+	if config.RetryDelay < 0 {
+		return errors.New("-retry-delay must not be negative")
+	}
+	if config.BreakerFailures < 0 {
+		return errors.New("-breaker-failures must not be negative")
+	}
+	if config.BreakerWindow <= 0 || config.BreakerCooldown <= 0 {
+		return errors.New("-breaker-window and -breaker-cooldown must be positive")
+	}
+
+	if config.DSCP < 0 || config.DSCP > 63 {
+		return fmt.Errorf("-dscp %d is out of range 0-63", config.DSCP)
+	}
+
+	if config.TTL < 0 || config.TTL > 255 {
+		return fmt.Errorf("-ttl %d is out of range 1-255", config.TTL)
+	}
+	if config.NoFragment && config.Transparent {
+		return errors.New("-no-fragment cannot be used with -transparent, whose raw socket builds the IP header itself")
+	}
+
+	if config.RelayID > math.MaxUint32 {
+		return fmt.Errorf("-relay-id %d is out of range 1-4294967295", config.RelayID)
+	}
+
+	if config.SourcePort < 0 || config.SourcePort > 65535 {
+		return fmt.Errorf("-source-port %d is out of range 1-65535", config.SourcePort)
+	}
+	if config.SourcePort > 0 && slices.Contains(config.ListenPorts, config.SourcePort) && !config.ReusePort {
+		return fmt.Errorf("-source-port %d is also a listen port, which requires -reuseport", config.SourcePort)
+	}
+
+	if config.Proxy != "" {
+		if _, err := parseProxy(config.Proxy); err != nil {
+			return err
+		}
+		if config.Transparent {
+			return errors.New("-transparent cannot be used with -proxy")
+		}
+	}
+
+	if config.EgressAddr != "" {
+		if _, err := parseEgressAddr(config.EgressAddr); err != nil {
+			return err
+		}
+		if config.Transparent {
+			return errors.New("-egress-addr cannot be used with -transparent, which sends from the original sender's address")
+		}
+	}
+
+	if config.CoalesceBytes < 5 || config.CoalesceBytes > maxUDPPayload {
+		return fmt.Errorf("-coalesce-bytes %d is out of range 5-%d", config.CoalesceBytes, maxUDPPayload)
+	}
+	if config.CoalesceDelay <= 0 {
+		return errors.New("-coalesce-delay must be positive")
+	}
+	if config.OTLPEndpoint != "" {
+		if _, err := parseOTLPEndpoint(config.OTLPEndpoint); err != nil {
+			return err
+		}
+	}
+	if config.OTLPInterval <= 0 {
+		return errors.New("-otlp-interval must be positive")
+	}
+	if !(config.ChaosDrop >= 0 && config.ChaosDrop <= 1) {
+		return fmt.Errorf("-chaos-drop %v is out of range 0-1", config.ChaosDrop)
+	}
+	if config.ChaosDelay < 0 {
+		return errors.New("-chaos-delay must not be negative")
+	}
+	if config.Coalesce && config.Transparent {
+		return errors.New("-coalesce cannot be used with -transparent, which sends every packet from its own sender's address")
+	}
+
+	if config.TLSCA != "" && config.TLSInsecure {
+		return errors.New("-tls-ca cannot be used with -tls-insecure, which skips verification")
+	}
+
+	if config.DedupWindow < 0 {
+		return errors.New("-dedup-window must not be negative")
+	}
+
+	if config.IdleTimeout < 0 {
+		return errors.New("-idle-timeout must not be negative")
+	}
+
+	if _, err := compressFormat(config.Compress); err != nil {
+		return fmt.Errorf("-compress: %v", err)
+	}
+	for target, compress := range config.TargetCompress {
+		if _, err := compressFormat(compress); err != nil {
+			return fmt.Errorf("target %s: %v", target, err)
+		}
+	}
+
+	switch {
+	case config.MaxLifetime < 0:
+		return errors.New("-max-lifetime must not be negative")
+	case config.MaxLifetime > 0 && runtime.GOOS == "windows":
+		return errors.New("-max-lifetime is not supported on Windows")
+	}
+
+	if config.DNSRefresh < 0 {
+		return errors.New("-dns-refresh must not be negative")
+	}
+
+	if config.WriteTimeout < 0 {
+		return errors.New("-write-timeout must not be negative")
+	}
+
+	if config.ReplaySpeed < 0 {
+		return errors.New("-replay-speed must not be negative")
+	}
+
+	if config.Preflight && config.PreflightTimeout <= 0 {
+		return errors.New("-preflight-timeout must be positive")
+	}
+
+	if config.TrackSources && config.TrackSourcesMax < 1 {
+		return errors.New("-track-sources-max must be at least 1")
+	}
+
+	if config.StatsInterval < 0 {
+		return errors.New("-stats-interval must not be negative")
+	}
+	if config.ErrorLogInterval < 0 {
+		return errors.New("-error-log-interval must not be negative")
+	}
+	if config.StatsFile != "" && config.StatsFileInterval <= 0 {
+		return errors.New("-stats-file-interval must be positive")
+	}
+	if config.FailbackDelay < 0 {
+		return errors.New("-failback-delay must not be negative")
+	}
+	if config.KeepaliveInterval < 0 {
+		return errors.New("-keepalive-interval must not be negative")
+	}
+	if config.KeepaliveInterval > 0 && config.Transparent {
+		return errors.New("-keepalive-interval cannot be used with -transparent: heartbeats are not sent from the senders' addresses")
+	}
+
+	if config.MinSize < 0 || config.MaxSize < 0 {
+		return errors.New("-min-size and -max-size must not be negative")
+	}
+	if config.MaxSize > 0 && config.MinSize > config.MaxSize {
+		return fmt.Errorf("-min-size %d is larger than -max-size %d", config.MinSize, config.MaxSize)
+	}
+
+	if err := validateModes(config); err != nil {
+		return err
+	}
+	if err := validateRoutes(config); err != nil {
+		return err
+	}
+
+	if len(config.TargetAddrs) == 0 && config.TargetsFile == "" && config.OutputMode != OutputBroadcast {
+		return ErrNoTargets
+	}
+	return nil
+}
+
+// udpNetwork picks the UDP network for a host: "udp4" or "udp6" for IP
+// literals of that family, and "udp" for hostnames and the IPv6 wildcard so
+// that the resolver (or the dual-stack socket) can handle either family.
+// The IPv4 wildcard 0.0.0.0 stays IPv4-only, which IPv4 multicast
+// membership requires on some platforms.
+func udpNetwork(host string) string {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil, ip.Equal(net.IPv6unspecified):
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
+// targetNetwork returns the UDP network for a host:port target address.
+func targetNetwork(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return "udp"
+	}
+	return udpNetwork(host)
+}
+
+// resolveTarget resolves a target as written in the configuration, a UDP
+// host:port, tcp://host:port or tls://host:port, and returns the name the
+// relay knows it by: the resolved address, with the scheme kept for TCP
+// and TLS targets. A unixgram:path target has no address and keeps its
+// name.
+func resolveTarget(target string) (name string, addr *net.UDPAddr, tcp bool, err error) {
+	if _, ok, err := unixTarget(target); ok {
+		return target, nil, false, err
+	}
+	if isSRVTarget(target) {
+		// NewRelay, Reload and the -targets-file watcher expand them.
+		return "", nil, false, fmt.Errorf("target %s: srv:// targets can only be configured, with -targets, the config file or -targets-file", target)
+	}
+	hostPort, scheme := targetHostPort(target)
+	addr, err = net.ResolveUDPAddr(targetNetwork(hostPort), hostPort)
+	if err != nil {
+		return "", nil, false, classify(ErrTargetResolve, fmt.Errorf("failed to resolve target address %s: %v", target, err))
+	}
+	return scheme + addr.String(), addr, scheme != "", nil
+}
+
+// targetHostPort splits the tcp:// or tls:// scheme, if any, off target.
+func targetHostPort(target string) (hostPort, scheme string) {
+	for _, scheme := range []string{tcpScheme, tlsScheme} {
+		if hostPort, ok := strings.CutPrefix(target, scheme); ok {
+			return hostPort, scheme
+		}
+	}
+	return target, ""
+}
+
+// sameUDPAddr reports whether a and b are the same IP and port. Both IPs are
+// normalized to their 16-byte form so that an IPv4 address and its
+// IPv4-mapped IPv6 form (as seen on a dual-stack socket) compare equal.
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && bytes.Equal(a.IP.To16(), b.IP.To16())
+}
+
+func listenHostPort(config *Config, port int) string {
+	return net.JoinHostPort(strings.Trim(config.ListenAddr, "[]"), strconv.Itoa(port))
+}
+
+// NewRelay checks config, opens the listen sockets and connects to the
+// targets. Nothing is received until the relay is started.
+func NewRelay(config *Config) (_ *Relay, err error) {
+	if err := config.validate(); err != nil {
+		return nil, classify(ErrConfig, err)
+	}
+
+	relay := &Relay{
+		config:   config,
+		sockOpts: socketOptions{dscp: config.DSCP, ttl: config.TTL, sourcePort: config.SourcePort, writeTimeout: config.WriteTimeout, noFragment: config.NoFragment},
+		breaker: breakerConfig{
+			failures: config.BreakerFailures,
+			window:   config.BreakerWindow,
+			cooldown: config.BreakerCooldown,
+		},
+		stats:    &Stats{},
+		errorLog: newErrorLog(config.ErrorLogInterval),
+		queue:    make(chan *packet, config.MaxQueue),
+		idle:     make(chan struct{}),
+		onceDone: make(chan struct{}),
+		debug:    config.LogLevel <= slog.LevelDebug,
+	}
+	relay.sourceLen = sourceHeaderLen(config)
+	if config.StatsFile != "" {
+		relay.loadStatsFile()
+	}
+	if config.Proxy != "" {
+		// validate has parsed it already.
+		relay.sockOpts.proxy, _ = parseProxy(config.Proxy)
+	}
+	if config.EgressAddr != "" {
+		relay.sockOpts.egress, _ = parseEgressAddr(config.EgressAddr)
+	}
+	tlsConfig, err := newTLSConfig(config.TLSCA, config.TLSInsecure)
+	if err != nil {
+		return nil, classify(ErrConfig, err)
+	}
+	relay.sockOpts.tls = tlsConfig
+	if config.Coalesce {
+		relay.sockOpts.coalesceBytes = config.CoalesceBytes
+		relay.sockOpts.coalesceDelay = config.CoalesceDelay
+	}
+	if config.TLSInsecure {
+		slog.Warn("Not verifying the certificates of TLS targets (-tls-insecure)")
+	}
+	if config.ChaosDrop > 0 || config.ChaosDelay > 0 {
+		slog.Warn("Chaos mode: dropping and delaying forwards on purpose", "drop", config.ChaosDrop, "max_delay", config.ChaosDelay)
+	}
+	relay.routes.Store(newRouteTable(config))
+	if config.TrackSources {
+		relay.sources = newSourceTracker(config.TrackSourcesMax)
+	}
+	if otlpEndpoint(config) != "" {
+		if _, err := otlpProtocol(); err != nil {
+			return nil, classify(ErrConfig, err)
+		}
+	}
+	relay.ctx, relay.cancel = context.WithCancel(context.Background())
+	// On error, close what has been opened so far, as stop does.
+	defer func() {
+		if err == nil {
+			return
+		}
+		relay.cancel()
+		if relay.dump != nil {
+			relay.dump.close()
+		}
+		if relay.pcap != nil {
+			relay.pcap.close()
+		}
+		if relay.access != nil {
+			relay.access.close()
+		}
+		if relay.raw != nil {
+			relay.raw.close()
+		}
+		relay.closeListeners()
+		relay.closeTargets()
+	}()
+	relay.packetPool.New = func() any {
+		return &packet{buf: make([]byte, min(config.BufferSize, maxDatagram))}
+	}
+	if config.MaxReceiveRate.rate > 0 {
+		relay.receiveLimit = newTokenBucket(config.MaxReceiveRate)
+	}
+	if config.LoopGuard {
+		id := uint32(config.RelayID)
+		if id == 0 {
+			id = newRelayID()
+		}
+		relay.loopGuard = &loopGuard{id: id}
+	}
+	if config.HostLoopGuard {
+		addrs, err := localHostAddrs()
+		if err != nil {
+			return nil, err
+		}
+		relay.hostAddrs.Store(&addrs)
+	}
+
+	relay.lastConfig.Store(config)
+	targets, settings, err := resolveConfigTargets(context.Background(), config)
+	relay.settings = settings
+	if err != nil {
+		return nil, classify(ErrConfig, err)
+	}
+
+	// Resolve target addresses
+	for _, target := range targets {
+		tc, err := newTargetConn(target, relay.sockOpts, relay.settings)
+		if err != nil {
+			if config.SkipBadTargets {
+				slog.Warn("Skipping target", "target", target, "error", err)
+				continue
+			}
+			return nil, err
+		}
+		if relay.hasTarget(tc.name) {
+			slog.Warn("Ignoring duplicate target", "target", target, "addr", tc.name)
+			tc.close()
+			continue
+		}
+		relay.targetConns = append(relay.targetConns, tc)
+		relay.stats.addTarget(tc.name)
+	}
+	if len(relay.targetConns) == 0 {
+		return nil, classify(ErrConfig, errors.New("none of the targets could be resolved"))
+	}
+	slog.Info("Resolved targets", "resolved", len(relay.targetConns), "configured", len(targets))
+
+	if config.Transparent {
+		for _, tc := range relay.targetConns {
+			if tc.udp() && tc.addr.IP.To4() == nil {
+				return nil, classify(ErrConfig, &TargetError{Target: tc.target, Err: fmt.Errorf("target %s: %v", tc.name, errTransparentFamily)})
+			}
+		}
+		raw, err := newRawSender(relay.sockOpts)
+		if err != nil {
+			return nil, err
+		}
+		relay.raw = raw
+	}
+
+	if config.Replay != "" {
+		replay, err := openReplay(config.Replay)
+		if err != nil {
+			return nil, err
+		}
+		relay.replay = replay
+		relay.replayDone = make(chan struct{})
+	}
+	if relay.replay == nil {
+		checkBufferSize(config.BufferSize, config.Interface)
+	}
+	for _, port := range config.ListenPorts {
+		l := &listener{port: port}
+		if relay.replay == nil {
+			var err error
+			if l, err = openListener(config, port); err != nil {
+				return nil, err
+			}
+		}
+		if len(config.ListenPorts) > 1 {
+			l.tag = strconv.Itoa(port)
+		}
+		relay.listeners = append(relay.listeners, l)
+	}
+	closeInherited()
+
+	if config.MetricsAddr != "" {
+		relay.handle(config.MetricsAddr, "/metrics", relay.handleMetrics)
+	}
+	if config.StatsAddr != "" {
+		relay.handle(config.StatsAddr, "/stats", relay.handleStats)
+	}
+	if config.HealthAddr != "" {
+		relay.handle(config.HealthAddr, "/healthz", relay.handleHealthz)
+		relay.handle(config.HealthAddr, "/readyz", relay.handleReadyz)
+	}
+	if config.ControlAddr != "" {
+		relay.handle(config.ControlAddr, "/targets", relay.handleTargets)
+	}
+	if config.DebugAddr != "" {
+		relay.handleDebug(config.DebugAddr)
+	}
+	if config.GRPCAddr != "" {
+		relay.stream = &packetStream{}
+		relay.handle(config.GRPCAddr, grpcSubscribePath, relay.handleSubscribe).h2c = true
+	}
+	if config.AccessLog != "" {
+		access, err := openAccessLog(config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		relay.access = access
+	}
+	if config.PcapFile != "" {
+		pcap, err := openPcap(config.PcapFile)
+		if err != nil {
+			return nil, err
+		}
+		relay.pcap = pcap
+	}
+	if config.DumpRaw != "" {
+		dump, err := openRawDump(config.DumpRaw)
+		if err != nil {
+			return nil, err
+		}
+		relay.dump = dump
+	}
+
+	if err := relay.listenHTTP(); err != nil {
+		return nil, err
+	}
+
+	return relay, nil
+}
+
+// openListener creates the listen socket for port, or takes the one for it
+// inherited from the parent process. The IPv6 wildcard uses "udp" so the
+// socket is dual-stack and receives both IPv4 and IPv6 packets.
+func openListener(config *Config, port int) (*listener, error) {
+	conn := takeInherited(port)
+	if conn != nil {
+		slog.Info("Using inherited listen socket", "addr", conn.LocalAddr())
+	} else {
+		network := udpNetwork(strings.Trim(config.ListenAddr, "[]"))
+		addr, err := net.ResolveUDPAddr(network, listenHostPort(config, port))
+		if err != nil {
+			return nil, classify(ErrConfig, fmt.Errorf("failed to resolve listen address: %v", err))
+		}
+
+		conn, err = listenUDP(network, addr, config.ReusePort)
+		if errors.Is(err, errnoAddrInUse) {
+			return nil, &BindError{Addr: listenHostPort(config, port), Err: portInUseError(port, config.ReusePort)}
+		}
+		if err != nil {
+			return nil, &BindError{Addr: listenHostPort(config, port), Err: fmt.Errorf("failed to create UDP socket: %v", err)}
+		}
+	}
+
+	if config.Interface != "" {
+		if err := bindToInterface(conn, config.Interface); err != nil {
+			conn.Close()
+			return nil, &BindError{Addr: listenHostPort(config, port), Err: fmt.Errorf("failed to bind listen socket to interface %s: %v", config.Interface, err)}
+		}
+	}
+
+	// Set socket options for receiving broadcast
+	if err := conn.SetReadBuffer(max(config.BufferSize, minReadBuffer)); err != nil {
+		slog.Warn("Failed to set read buffer size", "size", config.BufferSize, "error", err)
+	}
+
+	l := &listener{conn: conn, port: port}
+	// Not supported everywhere; without it kernel drops go uncounted.
+	l.countDrops = enableDropCount(conn) == nil
+	if len(config.MulticastGroups) > 0 {
+		iface := config.MulticastInterface
+		if iface == "" {
+			iface = config.Interface
+		}
+		groups, err := joinMulticastGroups(conn, config.MulticastGroups, iface)
+		if err != nil {
+			conn.Close()
+			return nil, &BindError{Addr: listenHostPort(config, port), Err: err}
+		}
+		l.groups = groups
+	}
+	return l, nil
+}
+
+// checkBufferSize warns about a -buffer that will not have the intended
+// effect: one too small for common datagrams or for a full frame on the
+// -interface, or one the kernel caps.
+func checkBufferSize(size int, iface string) {
+	switch {
+	case size < minReadBuffer:
+		slog.Warn("Buffer size is smaller than an Ethernet frame, longer packets will be truncated", "size", size)
+	case iface != "":
+		if ifi, err := net.InterfaceByName(iface); err == nil && size < ifi.MTU-udpHeaders {
+			slog.Warn("Buffer size is smaller than a full frame on the interface, longer packets will be truncated", "size", size, "interface", iface, "mtu", ifi.MTU, "max_payload", ifi.MTU-udpHeaders)
+		}
+	}
+	if limit, ok := maxReadBuffer(); ok && size > limit {
+		slog.Warn("Buffer size is above the kernel limit net.core.rmem_max, the receive buffer will be capped", "size", size, "rmem_max", limit)
+	}
+}
+
+func (r *Relay) closeListeners() {
+	for _, l := range r.listeners {
+		l.close()
+	}
+	if r.replay != nil {
+		r.replay.close()
+	}
+}
+
+// Start starts the relay's goroutines and returns. They run until ctx is
+// cancelled or Stop is called; Stop must be called either way to close the
+// sockets.
+func (r *Relay) Start(ctx context.Context) {
+	r.cancel()
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.started.Store(time.Now().UnixNano())
+	slog.Info("Starting Broadcast Relay", "version", Version)
+	for _, l := range r.listeners {
+		if r.replay != nil {
+			break
+		}
+		if r.config.Interface != "" {
+			slog.Info("Listening", "addr", listenHostPort(r.config, l.port), "interface", r.config.Interface)
+		} else {
+			slog.Info("Listening", "addr", listenHostPort(r.config, l.port))
+		}
+	}
+	if r.replay != nil {
+		slog.Info("Replaying", "file", r.config.Replay, "format", r.replay.format(), "speed", r.config.ReplaySpeed)
+	}
+	if r.config.DryRun {
+		slog.Info("Dry run, not forwarding", "targets", r.Targets())
+	} else {
+		slog.Info("Forwarding", "targets", r.Targets())
+	}
+	if r.loopGuard != nil {
+		slog.Info("Loop guard enabled", "relay_id", r.loopGuard.id)
+	}
+	if addrs := r.hostAddrs.Load(); addrs != nil {
+		slog.Info("Host loop guard enabled", "host_addrs", len(*addrs))
+		for _, target := range r.targets() {
+			if target.udp() && r.isHostPort(target.addr) {
+				slog.Warn("Target is this relay's own listen port, not forwarding to it", "target", target.name)
+			}
+		}
+		r.wg.Add(1)
+		go r.hostAddrsWatcher()
+	}
+	// Every listen socket joins the same groups.
+	for _, g := range r.listeners[0].groups {
+		slog.Info("Joined multicast group", "group", g.String())
+	}
+
+	if r.config.Preflight && !r.config.DryRun {
+		r.preflight()
+	}
+
+	for i := 0; i < r.config.Workers; i++ {
+		r.forwardWg.Add(1)
+		go r.forwardWorker()
+	}
+
+	if r.replay != nil {
+		r.recvWg.Add(1)
+		go r.replayLoop()
+		// The replay is over once everything it queued was forwarded.
+		go func() {
+			r.forwardWg.Wait()
+			close(r.replayDone)
+		}()
+	} else {
+		for _, l := range r.listeners {
+			r.recvWg.Add(1)
+			go r.receiveLoop(l)
+		}
+	}
+	// The receive loops are the only senders; closing the queue once they
+	// are done lets the workers finish what is left in it and exit.
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.recvWg.Wait()
+		close(r.queue)
+	}()
+
+	// Closing the listen sockets is what ends the receive loops.
+	context.AfterFunc(r.ctx, r.closeListeners)
+
+	r.running.Store(true)
+	r.startHTTP()
+
+	if r.config.IdleTimeout > 0 {
+		r.lastReceived.Store(r.started.Load())
+		r.wg.Add(1)
+		go r.idleWatcher()
+	}
+
+	if r.config.DNSRefresh > 0 {
+		r.wg.Add(1)
+		go r.dnsRefresher()
+	}
+	if r.errorLog.interval > 0 {
+		r.wg.Add(1)
+		go r.errorLogFlusher()
+	}
+	if r.config.StatsFile != "" {
+		r.wg.Add(1)
+		go r.statsFileWriter()
+	}
+	if r.config.KeepaliveInterval > 0 && !r.config.DryRun {
+		r.wg.Add(1)
+		go r.keepaliveLoop()
+	}
+	if r.config.TargetsFile != "" {
+		r.wg.Add(1)
+		go r.targetsFileWatcher()
+	}
+	if endpoint := otlpEndpoint(r.config); endpoint != "" {
+		if otlp, err := r.startOTLP(endpoint); err != nil {
+			slog.Error("Failed to start exporting metrics over OTLP", "endpoint", endpoint, "error", err)
+		} else {
+			r.otlp = otlp
+		}
+	}
+
+	// Periodic stats are part of the debug output unless an interval was
+	// asked for explicitly.
+	if r.config.StatsInterval > 0 && (r.debug || r.config.statsIntervalSet) {
+		r.wg.Add(1)
+		go r.statsReporter()
+	}
+	if r.config.TUI {
+		r.wg.Add(1)
+		go r.dashboard()
+	}
+}
+
+func (r *Relay) receiveLoop(l *listener) {
+	defer r.recvWg.Done()
+
+	// The capture shows received packets addressed to the listen address.
+	local, _ := l.conn.LocalAddr().(*net.UDPAddr)
+
+	// pkt is read into; it is only handed to the workers, and replaced,
+	// when the packet is to be forwarded.
+	pkt := r.getPacket()
+	defer func() {
+		if pkt != nil {
+			r.putPacket(pkt)
+		}
+	}()
+
+	var failing, truncated bool
+	var dedup *dedupCache
+	if r.config.DedupWindow > 0 {
+		dedup = newDedupCache(r.config.DedupWindow)
+	}
+	// drops is the kernel's drop count for the socket as last reported.
+	var drops uint32
+	var oob []byte
+	if l.countDrops {
+		oob = make([]byte, dropCountSpace)
+	}
+
+	for {
+		// Reads block until a packet arrives; stopping closes the socket
+		// to end them.
+		var n, oobn int
+		var ap netip.AddrPort
+		var err error
+		if l.countDrops {
+			n, oobn, _, ap, err = l.conn.ReadMsgUDPAddrPort(pkt.buf, oob)
+		} else {
+			n, ap, err = l.conn.ReadFromUDPAddrPort(pkt.buf)
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		// Track read errors for /readyz, touching the lock only when the
+		// state changes.
+		if (err != nil) != failing {
+			r.setListenError(l, err)
+			failing = err != nil
+		}
+		if err != nil {
+			select {
+			case <-r.ctx.Done():
+				return
+			default:
+				r.logError("Error reading UDP packet", "", err, "port", l.port)
+				r.stats.AddError("")
+				continue
+			}
+		}
+
+		received := time.Now()
+		pkt.setSrc(ap)
+		if count, ok := dropCount(oob[:oobn]); ok && count != drops {
+			// The count only grows, and wraps around.
+			if drops == 0 {
+				slog.Warn("The kernel dropped packets on a full receive buffer; raise -buffer, and net.core.rmem_max, to absorb bursts", "port", l.port, "dropped", count)
+			}
+			r.stats.AddKernelDropped(uint64(count - drops))
+			drops = count
+		}
+		if n == len(pkt.buf) && n < maxDatagram {
+			// The kernel drops the rest of a datagram longer than the
+			// buffer without an error, so one that fills it may have been
+			// cut short. It is forwarded as read.
+			r.stats.AddTruncated()
+			if !truncated {
+				slog.Warn("Received a packet as long as -buffer, it was probably truncated; raise -buffer to read longer packets", "size", n, "src", pkt.src.String(), "port", l.port)
+				truncated = true
+			}
+		}
+		accepted, stop := r.admit(l, pkt, n, received, local, dedup)
+		if !accepted {
+			if stop {
+				return
+			}
+			continue
+		}
+
+		select {
+		case r.queue <- pkt:
+			pkt = r.getPacket()
+			// Half empty again, so that a queue hovering at the limit does
+			// not log every packet.
+			if r.queueFull.Load() && len(r.queue) < cap(r.queue)/2 && r.queueFull.CompareAndSwap(true, false) {
+				slog.Info("Forward queue has room again")
+			}
+		default:
+			r.stats.AddQueueDropped()
+			if r.queueFull.CompareAndSwap(false, true) {
+				slog.Warn("Forward queue full, dropping packets until the workers catch up", "max_queue", cap(r.queue))
+			}
+			if r.debug {
+				slog.Debug("Dropped packet: forward queue full", "size", n, "src", pkt.src.String())
+			}
+			r.logFiltered(received, pkt.src, n, "forward queue full")
+			continue
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// admit runs a packet of n bytes, read into pkt.buf from pkt.src, through
+// the receive-side checks and filters, counting and logging it. It reports
+// whether pkt is to be queued for the workers, with pkt.data set, and
+// whether the receive loop is to stop afterwards, as for -once. local is the
+// address the packet was received on, for the capture.
+func (r *Relay) admit(l *listener, pkt *packet, n int, received time.Time, local *net.UDPAddr, dedup *dedupCache) (accepted, stop bool) {
+	srcAddr, buffer := pkt.src, pkt.buf
+	if r.config.IdleTimeout > 0 {
+		r.lastReceived.Store(received.UnixNano())
+	}
+	r.stats.AddReceived(l.tag, n)
+	if r.sources != nil {
+		r.sources.add(netip.AddrFrom16(pkt.ip).Unmap(), n)
+	}
+	if r.pcap != nil {
+		r.pcap.add(received, srcAddr, local, buffer[:n])
+	}
+	if r.dump != nil {
+		r.dump.add(buffer[:n])
+	}
+
+	if r.debug {
+		slog.Debug("Received packet", "size", n, "src", srcAddr.String(), "port", l.port)
+	}
+
+	if reason := r.denyReason(srcAddr); reason != "" {
+		r.stats.AddDenied()
+		if r.debug {
+			slog.Debug("Denied packet", "size", n, "src", srcAddr.String(), "reason", reason)
+		}
+		r.logFiltered(received, srcAddr, n, reason)
+		return false, false
+	}
+
+	if r.receiveLimit != nil && !r.receiveLimit.allow(n) {
+		r.stats.AddReceiveDropped()
+		if r.debug {
+			slog.Debug("Dropped packet: receive rate exceeded", "size", n, "src", srcAddr.String())
+		}
+		r.logFiltered(received, srcAddr, n, "over -max-receive-rate")
+		return false, false
+	}
+
+	data := buffer[:n]
+	if r.config.Decompress {
+		if cap(pkt.inflated) < maxDatagram {
+			pkt.inflated = make([]byte, maxDatagram)
+		}
+		var err error
+		if data, err = decompress(pkt.inflated[:maxDatagram], data); err != nil {
+			r.stats.AddFiltered()
+			if r.debug {
+				slog.Debug("Filtered packet", "size", n, "src", srcAddr.String(), "reason", err.Error())
+			}
+			r.logFiltered(received, srcAddr, n, err.Error())
+			return false, false
+		}
+	}
+	if r.loopGuard != nil {
+		var reason string
+		data, pkt.hops, reason = r.loopGuard.strip(data)
+		if reason != "" {
+			r.stats.AddLoopDropped()
+			if r.debug {
+				slog.Debug("Dropped packet", "size", n, "src", srcAddr.String(), "reason", reason)
+			}
+			r.logFiltered(received, srcAddr, n, reason)
+			return false, false
+		}
+	}
+
+	if reason := r.filterReason(srcAddr, data); reason != "" {
+		r.stats.AddFiltered()
+		if r.debug {
+			slog.Debug("Filtered packet", "size", n, "src", srcAddr.String(), "reason", reason)
+		}
+		r.logFiltered(received, srcAddr, n, reason)
+		return false, false
+	}
+
+	if dedup != nil && dedup.duplicate(srcAddr, data, received) {
+		r.stats.AddDuplicate()
+		if r.debug {
+			slog.Debug("Suppressed duplicate packet", "size", n, "src", srcAddr.String())
+		}
+		r.logFiltered(received, srcAddr, n, "duplicate")
+		return false, false
+	}
+
+	if r.config.Once && !r.takeOnce() {
+		// Another listen port received the packet first.
+		return false, true
+	}
+
+	pkt.data = data
+	pkt.received = received
+	pkt.port = l.port
+	if r.config.DryRun {
+		slog.Info("Would forward packet", "size", n, "src", srcAddr.String(), "port", l.port)
+		r.logFiltered(received, srcAddr, n, "-dry-run")
+		if r.config.Once {
+			r.finishOnce(pkt, 0)
+			return false, true
+		}
+		return false, false
+	}
+	return true, r.config.Once
+}
+
+// forwardWorker forwards queued packets until the queue is closed.
+func (r *Relay) forwardWorker() {
+	defer r.forwardWg.Done()
+
+	for pkt := range r.queue {
+		forwarded := r.dispatch(pkt)
+		if r.config.Once {
+			r.finishOnce(pkt, forwarded)
+		}
+		r.putPacket(pkt)
+	}
+}
+
+// dispatch forwards pkt to every target except its own source and returns
+// the number of targets it was forwarded to.
+func (r *Relay) dispatch(pkt *packet) int {
+	if r.stream != nil {
+		r.stream.publish(pkt)
+	}
+	targets := r.targets()
+	if len(targets) == 0 {
+		// Every target has been removed; checkNoTargets has warned.
+		r.stats.AddNoTargets()
+		return 0
+	}
+	// Routes match the payload as received, like the prefix filters.
+	routeData := pkt.data
+	// The rewrite rules are the same for every target, so the payload is
+	// rewritten once, into a new slice, rather than per forward.
+	if data, ok := r.config.Rewrites.apply(pkt.data); ok {
+		if r.debug {
+			slog.Debug("Rewrote packet", "size", len(pkt.data), "new_size", len(data), "src", pkt.src.String())
+		}
+		pkt.data = data
+		pkt.rewritten = true
+		r.stats.AddRewritten()
+	}
+	if r.OnPacket != nil {
+		src := &net.UDPAddr{IP: slices.Clone(pkt.src.IP), Port: pkt.src.Port, Zone: pkt.src.Zone}
+		data := r.OnPacket(src, slices.Clone(pkt.data))
+		if data == nil {
+			r.stats.AddFiltered()
+			if r.debug {
+				slog.Debug("Filtered packet", "size", len(pkt.data), "src", pkt.src.String(), "reason", "dropped by OnPacket")
+			}
+			r.logFiltered(pkt.received, pkt.src, len(pkt.data), "dropped by OnPacket")
+			return 0
+		}
+		if !bytes.Equal(data, pkt.data) {
+			pkt.data = data
+			pkt.rewritten = true
+		}
+	}
+	if r.loopGuard != nil {
+		pkt.markBuf = r.loopGuard.mark(pkt.markBuf[:0], pkt.hops, pkt.data)
+		pkt.marked = pkt.markBuf
+	}
+
+	if portMap := r.lastConfig.Load().TargetPortMap; len(portMap) > 0 {
+		targets = portTargets(targets, pkt.port, portMap)
+	}
+	balancer, failover := &r.balancer, &r.failover
+	if route := r.routes.Load().match(pkt.src, routeData); route != nil {
+		targets = route.filter(targets)
+		balancer, failover = &route.balancer, &route.failover
+		if r.debug {
+			slog.Debug("Routing packet", "size", len(pkt.data), "src", pkt.src.String(), "group", route.Group)
+		}
+	}
+	var results []forwardResult
+	if r.access != nil {
+		results = make([]forwardResult, len(targets))
+	}
+
+	// In balance and failover mode, the packet goes to the chosen targets
+	// only. They are chosen among the same targets fan-out would send it
+	// to: never this relay's own listen ports, nor its source unless
+	// -allow-loopback.
+	single := r.config.Mode != ModeFanout
+	var chosen []*targetConn
+	if single {
+		src := pkt.src
+		if r.config.AllowLoopback {
+			src = nil
+		}
+		candidates := r.withoutHostPorts(targets)
+		switch r.config.Mode {
+		case ModeBalance:
+			if target := balancer.pick(src, candidates, time.Now()); target != nil {
+				chosen = []*targetConn{target}
+			}
+		case ModeFailover:
+			chosen = failover.pick(src, candidates, time.Now(), r.config.FailbackDelay)
+		}
+	}
+
+	forward := func(i int, bufs *forwardBufs) forwardResult {
+		target := targets[i]
+		result := forwardSkipped
+		switch {
+		case single:
+			if slices.Contains(chosen, target) {
+				result = r.forwardPacket(pkt, target, bufs)
+			}
+		case !r.config.AllowLoopback && target.udp() && sameUDPAddr(pkt.src, target.addr):
+			// Skip if target is the source (avoid loops)
+			if r.debug {
+				slog.Debug("Skipping forward to source", "target", target.name)
+			}
+		case target.udp() && r.isHostPort(target.addr):
+			if r.debug {
+				slog.Debug("Skipping forward to this relay's own listen port", "target", target.name)
+			}
+		default:
+			result = r.forwardPacket(pkt, target, bufs)
+		}
+		if results != nil {
+			results[i] = result
+		}
+		return result
+	}
+
+	forwarded := 0
+	if n := min(r.config.FanoutConcurrency, len(targets)); n > 1 && !single {
+		forwarded = fanout(n, len(targets), &pkt.bufs, forward)
+	} else {
+		for i := range targets {
+			if forward(i, &pkt.bufs) == forwardOK {
+				forwarded++
+			}
+		}
+	}
+
+	if results != nil {
+		r.logDispatched(pkt, targets, results)
+	}
+	return forwarded
+}
+
+// fanout calls forward for targets 0 to count-1 from n goroutines at once,
+// the calling worker and n-1 helpers, each taking the next target not yet
+// forwarded to, and returns the number forwarded to. A slow target then
+// holds up one goroutine rather than every target after it, at the cost of
+// starting the helpers for every packet. The worker uses bufs, each helper
+// buffers of its own.
+func fanout(n, count int, bufs *forwardBufs, forward func(i int, bufs *forwardBufs) forwardResult) int {
+	var next, forwarded atomic.Int64
+	run := func(bufs *forwardBufs) {
+		for {
+			i := int(next.Add(1) - 1)
+			if i >= count {
+				return
+			}
+			if forward(i, bufs) == forwardOK {
+				forwarded.Add(1)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n - 1)
+	for j := 1; j < n; j++ {
+		go func() {
+			defer wg.Done()
+			var own forwardBufs
+			run(&own)
+		}()
+	}
+	run(bufs)
+	wg.Wait()
+	return int(forwarded.Load())
+}
+
+// forwardBufs holds a packet's data as changed for one target: with the
+// -timestamp and -prepend-source headers, and compressed under -compress.
+type forwardBufs struct {
+	stamp      []byte
+	compressed []byte
+}
+
+// forwardPacket forwards pkt to target, stamping and compressing it into
+// bufs for it.
+func (r *Relay) forwardPacket(pkt *packet, target *targetConn, bufs *forwardBufs) forwardResult {
+	data := pkt.payload(target)
+	if !target.sampled() {
+		r.stats.AddSampled(target.name)
+		return forwardSkipped
+	}
+	if !target.allow(len(data)) {
+		r.stats.AddDropped(target.name)
+		if r.debug {
+			slog.Debug("Dropped packet: rate limit exceeded", "size", len(data), "target", target.name)
+		}
+		return forwardDropped
+	}
+
+	now := time.Now()
+	if !target.health.allow(now) {
+		// Down and not due for a probe; refusals are counted, not logged.
+		r.stats.AddError(target.name)
+		return forwardFailed
+	}
+	breaker := r.breaker.failures > 0
+	if breaker && !target.breaker.allow(now) {
+		// Skipped until the cool-down ends; counted, not logged.
+		r.stats.AddError(target.name)
+		return forwardFailed
+	}
+
+	if r.config.Timestamp || r.sourceLen > 0 {
+		// Retries resend the same stamp: it is one packet.
+		bufs.stamp = r.stamp(bufs.stamp[:0], pkt, target, now)
+		data = bufs.stamp
+	}
+	raw := len(data)
+	format := target.compress.Load()
+	if format != formatStored {
+		bufs.compressed = compress(bufs.compressed[:0], data, format)
+		data = bufs.compressed
+	}
+	if (r.config.ChaosDrop > 0 || r.config.ChaosDelay > 0) && !r.chaos(target) {
+		if breaker {
+			target.breaker.cancelProbe()
+		}
+		return forwardDropped
+	}
+	n, err := r.send(pkt, target, data)
+	for attempt := 0; err != nil && !errors.Is(err, errTargetClosed) && !errors.Is(err, errnoMsgSize) && attempt < r.config.ForwardRetries; attempt++ {
+		if !r.sleep(r.config.RetryDelay << attempt) {
+			break
+		}
+		if r.debug {
+			slog.Debug("Retrying forward", "size", len(data), "target", target.name, "attempt", attempt+1, "error", err)
+		}
+		n, err = r.send(pkt, target, data)
+	}
+	if errors.Is(err, errTargetClosed) {
+		// The target was removed while this packet was in flight.
+		if breaker {
+			target.breaker.cancelProbe()
+		}
+		return forwardSkipped
+	}
+
+	if breaker {
+		// Neither a refusal nor a packet too big for the path is a fault
+		// of the target.
+		failed := err != nil && !isRefused(err) && !errors.Is(err, errnoMsgSize)
+		if state, changed := target.breaker.record(r.breaker, failed, now); changed {
+			if state == breakerOpen {
+				slog.Warn("Target keeps failing, opening its circuit breaker", "target", target.name, "cooldown", r.breaker.cooldown, "error", err)
+			} else {
+				slog.Info("Target circuit breaker closed", "target", target.name)
+			}
+			r.stats.setBreaker(target.name, state)
+		}
+	}
+
+	r.recordHealth(target, err, now)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, io.ErrShortWrite):
+			r.logError("Short write forwarding packet, the target got it truncated", target.name, nil, "size", len(data), "sent", n)
+		case errors.Is(err, errnoMsgSize):
+			r.tooBig(target, len(data))
+		case !errors.Is(err, syscall.ECONNREFUSED):
+			r.logError("Error forwarding packet", target.name, err, "size", len(data))
+		}
+		r.stats.AddError(target.name)
+		return forwardFailed
+	}
+
+	target.lastSent.Store(now.UnixNano())
+	r.stats.AddForwarded(target.name, n)
+	if format != formatStored {
+		r.stats.AddCompressed(target.name, raw, n)
+	}
+	if r.pcap != nil && r.config.PcapForwarded && target.udp() {
+		// Transparent forwards carry the sender's address.
+		src := pkt.src
+		if r.raw == nil {
+			src = target.local.Load()
+		}
+		if src != nil {
+			r.pcap.add(time.Now(), src, target.addr, data)
+		}
+	}
+
+	if r.debug {
+		slog.Debug("Forwarded packet", "size", n, "src", pkt.src.String(), "target", target.name)
+	}
+	return forwardOK
+}
+
+// send writes data, pkt's payload for target, to target once. In
+// transparent mode UDP targets are sent to with the sender's address; TCP
+// targets always use the relay's own.
+func (r *Relay) send(pkt *packet, target *targetConn, data []byte) (int, error) {
+	if r.raw != nil && target.udp() {
+		return r.raw.send(pkt.src, target.addr, data)
+	}
+	return target.write(data)
+}
+
+// recordHealth updates target's health with the result of a write at now,
+// logging when it goes down or comes back up.
+func (r *Relay) recordHealth(target *targetConn, err error, now time.Time) {
+	switch wentDown, cameUp := target.health.record(err, now); {
+	case wentDown:
+		slog.Warn("Target refused packets, marking it down", "target", target.name, "error", err)
+		r.stats.SetDown(target.name, true)
+	case cameUp:
+		slog.Info("Target is back up", "target", target.name)
+		r.stats.SetDown(target.name, false)
+	}
+}
+
+// tooBig reports a packet of size that target's socket refused as larger
+// than the path MTU, with the MTU where the system tells it.
+func (r *Relay) tooBig(target *targetConn, size int) {
+	r.stats.AddTooBig(target.name)
+	target.mu.Lock()
+	mtu, ok := 0, false
+	if target.conn != nil {
+		mtu, ok = pathMTU(target.conn)
+	}
+	target.mu.Unlock()
+	attrs := []any{"size", size}
+	if ok {
+		attrs = append(attrs, "path_mtu", mtu)
+	}
+	r.logError("Packet too big for the path MTU, not forwarded", target.name, nil, attrs...)
+}
+
+// sleep waits for d and reports whether it did so without the relay being
+// stopped in the meantime.
+func (r *Relay) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+func (r *Relay) statsReporter() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.StatsInterval)
+	defer ticker.Stop()
+
+	prev, prevTime := r.stats.Snapshot(), time.Now()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-ticker.C:
+			cur := r.stats.Snapshot()
+			r.stats.updateRates(prev, cur, now.Sub(prevTime))
+			prev, prevTime = cur, now
+			r.LogStats()
+		}
+	}
+}
+
+// targets returns the current target list. The slice is never modified in
+// place, so callers may iterate it without holding targetsMu.
+func (r *Relay) targets() []*targetConn {
+	r.targetsMu.RLock()
+	defer r.targetsMu.RUnlock()
+	return r.targetConns
+}
+
+// startTime returns when the relay was started, or the zero time before.
+func (r *Relay) startTime() time.Time {
+	if started := r.started.Load(); started != 0 {
+		return time.Unix(0, started)
+	}
+	return time.Time{}
+}
+
+// Targets returns the addresses of the current forwarding targets.
+func (r *Relay) Targets() []string {
+	targets := r.targets()
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.name
+	}
+	return names
+}
+
+// AddTarget resolves target and starts forwarding to it.
+func (r *Relay) AddTarget(target string) error {
+	r.targetsMu.RLock()
+	settings := r.settings
+	r.targetsMu.RUnlock()
+
+	tc, err := newTargetConn(target, r.sockOpts, settings)
+	if err != nil {
+		return err
+	}
+
+	r.targetsMu.Lock()
+	defer r.targetsMu.Unlock()
+
+	for _, existing := range r.targetConns {
+		if existing.name == tc.name {
+			tc.close()
+			return fmt.Errorf("target %s is already configured", tc.name)
+		}
+	}
+
+	targets := make([]*targetConn, len(r.targetConns), len(r.targetConns)+1)
+	copy(targets, r.targetConns)
+	r.targetConns = append(targets, tc)
+	r.stats.addTarget(tc.name)
+	slog.Info("Added target", "target", tc.name)
+	r.checkNoTargets()
+	return nil
+}
+
+// RemoveTarget stops forwarding to target. Forwards to it that are already in
+// flight are abandoned.
+func (r *Relay) RemoveTarget(target string) error {
+	name, _, _, err := resolveTarget(target)
+	if err != nil {
+		return err
+	}
+
+	r.targetsMu.Lock()
+	defer r.targetsMu.Unlock()
+
+	for i, existing := range r.targetConns {
+		if existing.name != name {
+			continue
+		}
+		targets := make([]*targetConn, 0, len(r.targetConns)-1)
+		targets = append(targets, r.targetConns[:i]...)
+		targets = append(targets, r.targetConns[i+1:]...)
+		r.targetConns = targets
+		existing.close()
+		slog.Info("Removed target", "target", existing.name)
+		r.checkNoTargets()
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errTargetNotFound, target)
+}
+
+// SetTargets replaces the target list. Every address is resolved before
+// anything changes, so on error the current targets are left untouched.
+// Connections to targets present in both lists are kept.
+func (r *Relay) SetTargets(addrs []string) error {
+	r.targetsMu.RLock()
+	settings := r.settings
+	r.targetsMu.RUnlock()
+
+	return r.setTargets(addrs, settings)
+}
+
+// setTargets is SetTargets with new target settings, which apply to kept
+// targets as well as new ones.
+// Unresolvable targets are skipped instead with -skip-bad-targets, as long
+// as at least one remains.
+func (r *Relay) setTargets(addrs []string, settings targetSettings) error {
+	r.targetsMu.Lock()
+	defer r.targetsMu.Unlock()
+
+	current := make(map[string]*targetConn, len(r.targetConns))
+	for _, tc := range r.targetConns {
+		current[tc.name] = tc
+	}
+
+	var targets, added []*targetConn
+	kept := make(map[string]bool)
+	// keptAs maps kept targets to their address as now configured.
+	keptAs := make(map[*targetConn]string)
+	closeAdded := func() {
+		for _, tc := range added {
+			tc.close()
+		}
+	}
+	for _, target := range addrs {
+		name, _, _, err := resolveTarget(target)
+		if err != nil {
+			if r.config.SkipBadTargets {
+				slog.Warn("Skipping target", "target", target, "error", err)
+				continue
+			}
+			closeAdded()
+			return &TargetError{Target: target, Err: err}
+		}
+		if kept[name] {
+			slog.Warn("Ignoring duplicate target", "target", target, "addr", name)
+			continue
+		}
+		if tc, ok := current[name]; ok {
+			kept[tc.name] = true
+			keptAs[tc] = target
+			targets = append(targets, tc)
+			continue
+		}
+
+		tc, err := newTargetConn(target, r.sockOpts, settings)
+		if err != nil {
+			if r.config.SkipBadTargets {
+				slog.Warn("Skipping target", "target", target, "error", err)
+				continue
+			}
+			closeAdded()
+			return err
+		}
+		kept[tc.name] = true
+		added = append(added, tc)
+		targets = append(targets, tc)
+	}
+	if len(targets) == 0 && len(addrs) > 0 {
+		return errors.New("none of the targets could be resolved")
+	}
+
+	r.targetConns = targets
+	r.settings = settings
+	for tc, target := range keptAs {
+		tc.configure(target, settings)
+	}
+	for _, tc := range added {
+		r.stats.addTarget(tc.name)
+		slog.Info("Added target", "target", tc.name)
+	}
+	for name, tc := range current {
+		if !kept[name] {
+			tc.close()
+			slog.Info("Removed target", "target", name)
+		}
+	}
+	r.checkNoTargets()
+	return nil
+}
+
+// checkNoTargets warns when the last target has been removed, after which
+// packets are still received and counted but not forwarded, and notes when
+// there are targets again. r.targetsMu is held.
+func (r *Relay) checkNoTargets() {
+	if len(r.targetConns) == 0 {
+		if r.noTargets.CompareAndSwap(false, true) {
+			slog.Warn("No targets left, received packets are not forwarded until one is added")
+		}
+		return
+	}
+	if r.noTargets.CompareAndSwap(true, false) {
+		slog.Info("Forwarding again", "targets", len(r.targetConns))
+	}
+}
+
+// isOwnPacket reports whether src is one of the relay's own forwarding
+// sockets. Relays that re-broadcast, or whose peers forward back to them,
+// receive their own packets; forwarding those again would loop.
+func (r *Relay) isOwnPacket(src *net.UDPAddr) bool {
+	host := r.hostAddrs.Load()
+	for _, target := range r.targets() {
+		local := target.local.Load()
+		switch {
+		case local == nil:
+		case sameUDPAddr(local, src):
+			return true
+		// A socket bound to the wildcard address sends from whichever of
+		// the host's addresses the route picks, which no other socket can
+		// send from with the same port.
+		case host != nil && local.Port == src.Port && host.has(src.IP):
+			return true
+		}
+	}
+	return false
+}
+
+// hasTarget reports whether a target with the resolved address name is
+// configured.
+func (r *Relay) hasTarget(name string) bool {
+	for _, target := range r.targets() {
+		if target.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Relay) closeTargets() {
+	for _, target := range r.targets() {
+		target.close()
+	}
+}
+
+// drainForwards waits for in-flight forwards to finish, for at most the
+// configured drain timeout.
+func (r *Relay) drainForwards() {
+	if r.config.DrainTimeout <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.forwardWg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(r.config.DrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		slog.Warn("Gave up waiting for in-flight forwards", "timeout", r.config.DrainTimeout)
+	}
+}
+
+// Run starts the relay and blocks until ctx is cancelled, Stop is called,
+// the idle timeout or -max-lifetime passes or the -replay file has been
+// forwarded, then stops it. It returns ErrIdleTimeout if the relay went
+// idle, ErrMaxLifetime if it reached its maximum lifetime, the error
+// reading the replay file if there was one, and nil otherwise.
+func (r *Relay) Run(ctx context.Context) error {
+	r.Start(ctx)
+
+	var expired <-chan time.Time
+	if r.config.MaxLifetime > 0 {
+		timer := time.NewTimer(r.config.MaxLifetime)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case <-r.ctx.Done():
+	case <-r.idle:
+		err = ErrIdleTimeout
+	case <-expired:
+		slog.Info("Maximum lifetime reached", "max_lifetime", r.config.MaxLifetime)
+		err = ErrMaxLifetime
+	case <-r.onceDone:
+		err = r.onceErr
+	case <-r.replayDone:
+		err = r.replayErr
+	}
+	r.Stop()
+	return err
+}
+
+// Stop stops the relay, waits for in-flight forwards to finish and closes
+// its sockets. Calling it again has no effect.
+func (r *Relay) Stop() {
+	r.stopOnce.Do(r.stop)
+}
+
+func (r *Relay) stop() {
+	slog.Info("Stopping relay...")
+	r.running.Store(false)
+	r.cancel()
+	r.closeListeners()
+	r.stopHTTP()
+	r.wg.Wait()
+	r.drainForwards()
+	r.closeTargets()
+	if r.raw != nil {
+		r.raw.close()
+	}
+	if r.access != nil {
+		r.access.close()
+	}
+	if r.pcap != nil {
+		if err := r.pcap.close(); err != nil {
+			slog.Error("Failed to close pcap file", "error", err)
+		}
+	}
+	if r.dump != nil {
+		if err := r.dump.close(); err != nil {
+			slog.Error("Failed to close raw dump file", "error", err)
+		}
+	}
+	// Forwards drained after the flusher stopped may have been suppressed.
+	r.errorLog.flush(time.Now())
+	slog.Info("Final stats", r.snapshot().logAttrs()...)
+	if r.config.StatsFile != "" {
+		if err := r.SaveStats(); err != nil {
+			slog.Error("Failed to save stats", "file", r.config.StatsFile, "error", err)
+		}
+	}
+	if r.otlp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+		if err := r.otlp.Shutdown(ctx); err != nil {
+			slog.Error("Failed to export the final metrics over OTLP", "error", err)
+		}
+		cancel()
+	}
+	if r.sources != nil {
+		r.logTopSources()
+	}
+	slog.Info("Relay stopped")
+}
+
+// LogStats logs the current stats.
+func (r *Relay) LogStats() {
+	slog.Info("Stats", r.snapshot().logAttrs()...)
+	if r.sources != nil {
+		r.logTopSources()
+	}
+}
+
+// snapshot returns the stats together with the relay's own gauges.
+func (r *Relay) snapshot() StatsSnapshot {
+	snap := r.stats.Snapshot()
+	snap.QueueDepth = len(r.queue)
+	if r.config.Mode == ModeFailover {
+		r.markActive(&snap)
+	}
+	return snap
+}
+
+// Reload applies the targets and per-target settings of config, such as a
+// configuration re-read from the same command line and file. The listen
+// sockets and stats are kept; on error nothing changes.
+func (r *Relay) Reload(config *Config) error {
+	targets, settings, err := resolveConfigTargets(r.ctx, config)
+	if err != nil {
+		return err
+	}
+	if err := r.setTargets(targets, settings); err != nil {
+		return err
+	}
+	r.routes.Store(newRouteTable(config))
+	r.lastConfig.Store(config)
+	if r.config.HostLoopGuard {
+		r.refreshHostAddrs()
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenTarget opens a UDP socket on addr for a test relay to forward to,
+// skipping the test where the network is not available.
+func listenTarget(t testing.TB, network, addr string) *net.UDPConn {
+	t.Helper()
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		t.Skipf("%s %s not available: %v", network, addr, err)
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		t.Skipf("%s %s not available: %v", network, addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startRelay starts a relay with config, listening on an ephemeral port of
+// 127.0.0.1, and returns it and a socket connected to its listen address.
+func startRelay(t testing.TB, config *Config) (*Relay, *net.UDPConn) {
+	t.Helper()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	relay, err := NewRelay(config)
+	if err != nil {
+		t.Fatalf("NewRelay: %v", err)
+	}
+	relay.Start(context.Background())
+	t.Cleanup(relay.Stop)
+
+	src, err := net.DialUDP("udp4", nil, relay.listeners[0].conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Close() })
+	return relay, src
+}
+
+func TestSameUDPAddr(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"192.0.2.1:9999", "192.0.2.1:9999", true},
+		{"192.0.2.1:9999", "192.0.2.1:9998", false},
+		{"192.0.2.1:9999", "192.0.2.2:9999", false},
+		{"192.0.2.1:9999", "[::ffff:192.0.2.1]:9999", true},
+		{"[::ffff:192.0.2.1]:9999", "192.0.2.1:9999", true},
+		{"127.0.0.1:9999", "[::1]:9999", false},
+		{"[::1]:9999", "[::1]:9999", true},
+		{"[2001:db8::1]:9999", "[2001:db8::2]:9999", false},
+	}
+	for _, tt := range tests {
+		a, err := net.ResolveUDPAddr("udp", tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := net.ResolveUDPAddr("udp", tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The forms a packet's source comes in, 4 and 16 bytes long.
+		for _, ip := range [][]byte{a.IP.To4(), a.IP.To16()} {
+			if ip == nil {
+				continue
+			}
+			a := &net.UDPAddr{IP: ip, Port: a.Port}
+			if got := sameUDPAddr(a, b); got != tt.want {
+				t.Errorf("sameUDPAddr(%v (%d bytes), %v) = %v, want %v", a, len(ip), b, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestForwardIPv4ToIPv6(t *testing.T) {
+	target := listenTarget(t, "udp6", "[::1]:0")
+	config := DefaultConfig()
+	config.TargetAddrs = []string{target.LocalAddr().String()}
+	_, src := startRelay(t, config)
+
+	payload := []byte("from v4 to v6")
+	if _, err := src.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := target.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("reading at the [::1] target: %v", err)
+	}
+	if !bytes.Equal(buf[:n], payload) {
+		t.Errorf("target got %q, want %q", buf[:n], payload)
+	}
+	if !from.IP.Equal(net.IPv6loopback) {
+		t.Errorf("packet came from %v, want [::1]", from)
+	}
+}
+
+// TestForwardIntegrity floods a relay with packets of different lengths and
+// contents, for the forward workers to reuse pooled buffers at a fast pace,
+// and checks that no packet arrives at the target with another's bytes.
+// Run with -race.
+func TestForwardIntegrity(t *testing.T) {
+	const count = 5000
+	target := listenTarget(t, "udp4", "127.0.0.1:0")
+	target.SetReadBuffer(4 << 20)
+	config := DefaultConfig()
+	config.Workers = 4
+	config.BufferSize = 4 << 20
+	config.TargetAddrs = []string{target.LocalAddr().String()}
+	_, src := startRelay(t, config)
+
+	received := make(chan int)
+	go func() {
+		buf := make([]byte, 2048)
+		n := 0
+		defer func() { received <- n }()
+		for {
+			target.SetReadDeadline(time.Now().Add(time.Second))
+			size, err := target.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := checkTestPayload(buf[:size]); err != nil {
+				t.Error(err)
+			}
+			n++
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		if _, err := src.Write(testPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+		// Bursts of a hundred, for fewer of them to be lost to full
+		// socket buffers under -race.
+		if i%100 == 99 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if n := <-received; n == 0 {
+		t.Fatal("target received no packets")
+	} else {
+		t.Logf("target received %d of %d packets", n, count)
+	}
+}
+
+// testPayload returns packet i of a flood: its number, then a length and
+// fill byte that follow from it.
+func testPayload(i int) []byte {
+	b := make([]byte, 4+i%1200)
+	binary.BigEndian.PutUint32(b, uint32(i))
+	for j := 4; j < len(b); j++ {
+		b[j] = byte(i)
+	}
+	return b
+}
+
+func checkTestPayload(b []byte) error {
+	if len(b) < 4 {
+		return fmt.Errorf("packet of %d bytes, too short to be numbered", len(b))
+	}
+	i := int(binary.BigEndian.Uint32(b))
+	if want := testPayload(i); !bytes.Equal(b, want) {
+		return fmt.Errorf("packet %d is corrupt: %d bytes, want %d", i, len(b), len(want))
+	}
+	return nil
+}
+
+// BenchmarkReceiveForward measures a packet's way through a relay on the
+// loopback, from the listen socket to the target, one packet at a time.
+// The allocations are those of the relay's goroutines as well.
+func BenchmarkReceiveForward(b *testing.B) {
+	target := listenTarget(b, "udp4", "127.0.0.1:0")
+	config := DefaultConfig()
+	config.TargetAddrs = []string{target.LocalAddr().String()}
+	_, src := startRelay(b, config)
+
+	payload := testPayload(1000)
+	buf := make([]byte, 2048)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := src.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+		target.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := target.Read(buf); err != nil {
+			b.Fatalf("packet %d not forwarded: %v", i, err)
+		}
+	}
+}
+
+// BenchmarkPacketPool measures taking a packet buffer from the pool and
+// putting it back, as the receive loop and forward workers do for each
+// packet; it should not allocate.
+func BenchmarkPacketPool(b *testing.B) {
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.TargetAddrs = []string{"127.0.0.1:9"}
+	r, err := NewRelay(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(r.Stop)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pkt := r.getPacket()
+			pkt.data = pkt.buf[:1000]
+			r.putPacket(pkt)
+		}
+	})
+}
+
+// shortConn is a target socket that sends at most n bytes of a datagram.
+type shortConn struct {
+	net.Conn
+	n int
+}
+
+func (c *shortConn) Write(b []byte) (int, error) {
+	return min(len(b), c.n), nil
+}
+
+func TestWriteDatagram(t *testing.T) {
+	data := []byte("0123456789")
+	if n, err := writeDatagram(&shortConn{n: 100}, data); n != len(data) || err != nil {
+		t.Errorf("whole write = %d, %v, want %d, nil", n, err, len(data))
+	}
+	n, err := writeDatagram(&shortConn{n: 4}, data)
+	if n != 4 || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("short write = %d, %v, want 4, io.ErrShortWrite", n, err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "sent 4 of 10 bytes") {
+		t.Errorf("short write error = %q, want the bytes sent", err)
+	}
+}
+
+func TestForwardShortWrite(t *testing.T) {
+	target := listenTarget(t, "udp4", "127.0.0.1:0")
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.TargetAddrs = []string{target.LocalAddr().String()}
+	r, err := NewRelay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	tc := r.targets()[0]
+	conn, err := tc.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc.conn = &shortConn{Conn: conn, n: 4}
+
+	pkt := r.getPacket()
+	pkt.data = append(pkt.buf[:0], "0123456789"...)
+	if result := r.forwardPacket(pkt, tc, &pkt.bufs); result != forwardFailed {
+		t.Errorf("forwardPacket of a short write = %v, want forwardFailed", result)
+	}
+	if tc.conn == nil {
+		t.Error("short write closed the target socket, want it kept")
+	}
+
+	snap := r.snapshot()
+	if ts := snap.Targets[tc.name]; ts.Errors != 1 || ts.PacketsForwarded != 0 {
+		t.Errorf("target stats = %d errors, %d forwarded, want 1, 0", ts.Errors, ts.PacketsForwarded)
+	}
+	if snap.Errors != 1 {
+		t.Errorf("errors = %d, want 1", snap.Errors)
+	}
+	if got := logs.String(); !strings.Contains(got, "Short write forwarding packet") || !strings.Contains(got, "size=10 sent=4") {
+		t.Errorf("log = %q, want the short write with its size and bytes sent", got)
+	}
+}
+
+// TestAllowLoopbackSingleTarget checks that under -allow-loopback balance
+// and failover mode, like fan-out, send a packet back to its source.
+func TestAllowLoopbackSingleTarget(t *testing.T) {
+	for _, mode := range []string{ModeFanout, ModeBalance, ModeFailover} {
+		t.Run(mode, func(t *testing.T) {
+			peer := listenTarget(t, "udp4", "127.0.0.1:0")
+			config := DefaultConfig()
+			config.Mode = mode
+			config.AllowLoopback = true
+			config.TargetAddrs = []string{peer.LocalAddr().String()}
+			r, _ := startRelay(t, config)
+
+			if _, err := peer.WriteToUDP([]byte("echo"), r.listeners[0].conn.LocalAddr().(*net.UDPAddr)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := peer.Read(buf)
+			if err != nil {
+				t.Fatalf("source did not get its packet back: %v", err)
+			}
+			if string(buf[:n]) != "echo" {
+				t.Errorf("source got %q back, want %q", buf[:n], "echo")
+			}
+		})
+	}
+}
+
+// TestNewRelayErrorCloses makes NewRelay fail at its last step, listening
+// on a busy HTTP address, and checks that it leaves no file descriptor of
+// the raw socket, listen socket, target sockets and output files open.
+func TestNewRelayErrorCloses(t *testing.T) {
+	if _, err := os.ReadDir("/proc/self/fd"); err != nil {
+		t.Skipf("open file descriptors cannot be counted: %v", err)
+	}
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	openFDs := func() int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(fds)
+	}
+
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.TargetAddrs = []string{"127.0.0.1:9", "127.0.0.1:10"}
+	config.AccessLog = filepath.Join(dir, "access.log")
+	config.PcapFile = filepath.Join(dir, "packets.pcap")
+	config.DumpRaw = filepath.Join(dir, "packets.raw")
+	config.MetricsAddr = busy.Addr().String()
+	if os.Geteuid() == 0 && runtime.GOOS == "linux" {
+		config.Transparent = true
+	}
+	before := openFDs()
+	r, err := NewRelay(config)
+	if err == nil {
+		r.Stop()
+		t.Fatalf("NewRelay with -metrics-addr %s in use: no error", config.MetricsAddr)
+	}
+	var bindErr *BindError
+	if !errors.As(err, &bindErr) {
+		t.Skipf("NewRelay failed before listening on HTTP: %v", err)
+	}
+	if after := openFDs(); after != before {
+		t.Errorf("%d file descriptors open after NewRelay failed, want the %d before", after, before)
+	}
+}
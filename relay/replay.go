@@ -0,0 +1,258 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// maxFramedRecord bounds the length field of a length-framed replay record:
+// no datagram is longer, so anything larger means the file is not one.
+const maxFramedRecord = 65535
+
+// replaySource reads the packets of a -replay file: a pcap or pcapng
+// capture, whose UDP packets are replayed with their addresses and timing,
+// or a sequence of length-framed datagrams as sent to TCP targets, which
+// carry neither.
+type replaySource struct {
+	file *os.File
+	// pcap is set for captures, framed otherwise.
+	pcap interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+		LinkType() layers.LinkType
+	}
+	framed *bufio.Reader
+	// skipped counts the packets of a capture that are not UDP.
+	skipped int
+}
+
+// replayRecord is one packet to replay. A packet from a framed file has no
+// time, source or destination.
+type replayRecord struct {
+	time    time.Time
+	src     netip.AddrPort
+	dst     *net.UDPAddr
+	payload []byte
+}
+
+// pcap and pcapng files start with one of these, in either byte order.
+var replayMagics = [][]byte{
+	{0xa1, 0xb2, 0xc3, 0xd4}, {0xd4, 0xc3, 0xb2, 0xa1}, // microseconds
+	{0xa1, 0xb2, 0x3c, 0x4d}, {0x4d, 0x3c, 0xb2, 0xa1}, // nanoseconds
+}
+
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// openReplay opens the -replay file, or standard input for "-", and tells
+// its format from the first bytes.
+func openReplay(path string) (*replaySource, error) {
+	file := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open replay file: %v", err)
+		}
+		file = f
+	}
+	s := &replaySource{file: file}
+
+	buf := bufio.NewReader(file)
+	magic, err := buf.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		file.Close()
+		return nil, fmt.Errorf("failed to read replay file: %v", err)
+	}
+	switch {
+	case bytes.Equal(magic, pcapngMagic):
+		r, err := pcapgo.NewNgReader(buf, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid pcapng replay file: %v", err)
+		}
+		s.pcap = r
+	case isPcapMagic(magic):
+		r, err := pcapgo.NewReader(buf)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid pcap replay file: %v", err)
+		}
+		s.pcap = r
+	default:
+		s.framed = buf
+	}
+	return s, nil
+}
+
+func isPcapMagic(b []byte) bool {
+	for _, magic := range replayMagics {
+		if bytes.Equal(b, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// format names the file format for the log.
+func (s *replaySource) format() string {
+	switch s.pcap.(type) {
+	case *pcapgo.NgReader:
+		return "pcapng"
+	case *pcapgo.Reader:
+		return "pcap"
+	}
+	return "length-framed"
+}
+
+// next returns the next packet, or io.EOF after the last one.
+func (s *replaySource) next() (replayRecord, error) {
+	if s.framed != nil {
+		return s.nextFramed()
+	}
+	for {
+		data, ci, err := s.pcap.ReadPacketData()
+		if err != nil {
+			return replayRecord{}, err
+		}
+		packet := gopacket.NewPacket(data, s.pcap.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		var srcIP, dstIP net.IP
+		switch ip := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			srcIP, dstIP = ip.SrcIP, ip.DstIP
+		case *layers.IPv6:
+			srcIP, dstIP = ip.SrcIP, ip.DstIP
+		}
+		src, ok := netip.AddrFromSlice(srcIP)
+		if udp == nil || !ok {
+			s.skipped++
+			continue
+		}
+		return replayRecord{
+			time:    ci.Timestamp,
+			src:     netip.AddrPortFrom(src.Unmap(), uint16(udp.SrcPort)),
+			dst:     &net.UDPAddr{IP: dstIP, Port: int(udp.DstPort)},
+			payload: udp.Payload,
+		}, nil
+	}
+}
+
+func (s *replaySource) nextFramed() (replayRecord, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(s.framed, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.New("truncated record length")
+		}
+		return replayRecord{}, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFramedRecord {
+		return replayRecord{}, fmt.Errorf("record of %d bytes is too large; the file is neither a capture nor length-framed", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(s.framed, payload); err != nil {
+		return replayRecord{}, errors.New("truncated record")
+	}
+	return replayRecord{src: netip.AddrPortFrom(netip.IPv4Unspecified(), 0), payload: payload}, nil
+}
+
+func (s *replaySource) close() {
+	s.file.Close()
+}
+
+// replayLoop feeds the packets of the -replay file through the same checks
+// as received ones, in place of the receive loops. Captured packets keep
+// their spacing, divided by -replay-speed, and are replayed on the listen
+// port they were sent to, if it is one of -port; others are skipped. Unlike
+// a socket, the file can wait for a full forward queue.
+func (r *Relay) replayLoop() {
+	defer r.recvWg.Done()
+
+	pkt := r.getPacket()
+	defer func() {
+		if pkt != nil {
+			r.putPacket(pkt)
+		}
+	}()
+
+	var dedup *dedupCache
+	if r.config.DedupWindow > 0 {
+		dedup = newDedupCache(r.config.DedupWindow)
+	}
+	ports := make(map[int]*listener, len(r.listeners))
+	for _, l := range r.listeners {
+		ports[l.port] = l
+	}
+
+	var replayed, otherPorts int
+	var first time.Time
+	start := time.Now()
+	for {
+		rec, err := r.replay.next()
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			if !errors.Is(err, io.EOF) {
+				slog.Error("Failed to read replay file", "file", r.config.Replay, "error", err)
+				r.replayErr = fmt.Errorf("replay file %s: %v", r.config.Replay, err)
+			}
+			slog.Info("Replay finished", "packets", replayed, "skipped", r.replay.skipped+otherPorts)
+			return
+		}
+
+		l := r.listeners[0]
+		local := &net.UDPAddr{IP: net.IPv4zero, Port: l.port}
+		if rec.dst != nil {
+			if l = ports[rec.dst.Port]; l == nil {
+				otherPorts++
+				continue
+			}
+			local = rec.dst
+		}
+
+		if speed := r.config.ReplaySpeed; speed > 0 && !rec.time.IsZero() {
+			if first.IsZero() {
+				first = rec.time
+			}
+			due := start.Add(time.Duration(float64(rec.time.Sub(first)) / speed))
+			if wait := time.Until(due); wait > 0 && !r.sleep(wait) {
+				return
+			}
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		n := copy(pkt.buf, rec.payload)
+		pkt.setSrc(rec.src)
+		accepted, stop := r.admit(l, pkt, n, time.Now(), local, dedup)
+		if !accepted {
+			if stop {
+				return
+			}
+			continue
+		}
+		select {
+		case r.queue <- pkt:
+			pkt = r.getPacket()
+			replayed++
+		case <-r.ctx.Done():
+			return
+		}
+		if stop {
+			return
+		}
+	}
+}
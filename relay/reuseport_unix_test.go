@@ -0,0 +1,43 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package relay
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	newConfig := func(port int) *Config {
+		config := DefaultConfig()
+		config.ListenAddr = "127.0.0.1"
+		config.ListenPorts = PortList{port}
+		config.TargetAddrs = []string{"127.0.0.1:9"}
+		config.ReusePort = true
+		return config
+	}
+
+	first, err := NewRelay(newConfig(0))
+	if err != nil {
+		t.Fatalf("first relay: %v", err)
+	}
+	defer first.Stop()
+	port := first.listeners[0].conn.LocalAddr().(*net.UDPAddr).Port
+
+	second, err := NewRelay(newConfig(port))
+	if err != nil {
+		t.Fatalf("second relay on port %d with -reuseport: %v", port, err)
+	}
+	second.Stop()
+
+	// Without -reuseport the port cannot be shared, and the error says why.
+	config := newConfig(port)
+	config.ReusePort = false
+	if third, err := NewRelay(config); err == nil {
+		third.Stop()
+		t.Errorf("relay on port %d without -reuseport: no error", port)
+	} else if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("relay on port %d without -reuseport: error %q is not ErrPortInUse", port, err)
+	}
+}
@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// rewriteRule replaces every occurrence of from in a payload with to.
+type rewriteRule struct {
+	from []byte
+	to   []byte
+}
+
+// RewriteRules is the -rewrite flag, which may be repeated. Each rule is
+// written as from=to with both sides hex-encoded; an empty to deletes from.
+// The rules are applied in order, each to the output of the one before.
+type RewriteRules []rewriteRule
+
+func parseRewriteRule(s string) (rewriteRule, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok {
+		return rewriteRule{}, fmt.Errorf("invalid rewrite rule %q: must be from=to in hex", s)
+	}
+	var rule rewriteRule
+	var err error
+	if rule.from, err = decodeHex(from); err != nil {
+		return rewriteRule{}, fmt.Errorf("invalid rewrite rule %q: %v", s, err)
+	}
+	if len(rule.from) == 0 {
+		return rewriteRule{}, fmt.Errorf("invalid rewrite rule %q: nothing to replace", s)
+	}
+	if rule.to, err = decodeHex(to); err != nil {
+		return rewriteRule{}, fmt.Errorf("invalid rewrite rule %q: %v", s, err)
+	}
+	return rule, nil
+}
+
+func parseRewriteRules(items []string) (RewriteRules, error) {
+	var rules RewriteRules
+	for _, item := range items {
+		rule, err := parseRewriteRule(item)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (l *RewriteRules) String() string {
+	items := make([]string, len(*l))
+	for i, rule := range *l {
+		items[i] = hex.EncodeToString(rule.from) + "=" + hex.EncodeToString(rule.to)
+	}
+	return strings.Join(items, " ")
+}
+
+// Set implements flag.Value. Every use of the flag adds a rule.
+func (l *RewriteRules) Set(value string) error {
+	rule, err := parseRewriteRule(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, rule)
+	return nil
+}
+
+// apply returns data with the rules applied and whether any of them
+// matched. data itself is never modified: a changed payload is a new slice,
+// which may be longer or shorter than data.
+func (l RewriteRules) apply(data []byte) ([]byte, bool) {
+	changed := false
+	for _, rule := range l {
+		if bytes.Contains(data, rule.from) {
+			data = bytes.ReplaceAll(data, rule.from, rule.to)
+			changed = true
+		}
+	}
+	return data, changed
+}
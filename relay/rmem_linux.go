@@ -0,0 +1,19 @@
+package relay
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxReadBuffer returns net.core.rmem_max, the largest socket receive
+// buffer the kernel grants an unprivileged process; larger requests are
+// silently capped.
+func maxReadBuffer() (int, bool) {
+	data, err := os.ReadFile("/proc/sys/net/core/rmem_max")
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n, err == nil
+}
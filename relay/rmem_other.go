@@ -0,0 +1,8 @@
+//go:build !linux
+
+package relay
+
+// maxReadBuffer reports that the receive buffer limit is not known.
+func maxReadBuffer() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+)
+
+// Defaults for packets that match none of the Routes.
+const (
+	// RouteAll forwards them to every target, as without routes.
+	RouteAll = "all"
+	// RouteDrop filters them out.
+	RouteDrop = "drop"
+)
+
+// Route sends packets whose payload starts with one of Prefixes, and whose
+// source is in one of Sources, to the targets of a target group only; an
+// empty list matches every packet. Routes come from the config file, where
+// groups are defined by name under target-groups.
+type Route struct {
+	Prefixes HexList
+	Sources  CIDRList
+	// Group names the target group, whose Targets are given by address as
+	// written in the target list.
+	Group   string
+	Targets []string
+}
+
+// routeTable is the compiled form of Config.Routes. A nil routeTable routes
+// every packet to every target.
+type routeTable struct {
+	routes []*route
+	drop   bool
+}
+
+type route struct {
+	Route
+	targets map[string]bool
+	// balancer picks among the group's targets in balance mode, and
+	// failover in failover mode. Each route has its own, as a balancer
+	// forgets the state of targets it is not shown.
+	balancer balancer
+	failover failover
+}
+
+// newRouteTable compiles the routes of config, returning nil if there are
+// none.
+func newRouteTable(config *Config) *routeTable {
+	if len(config.Routes) == 0 {
+		return nil
+	}
+	table := &routeTable{drop: config.RouteDefault == RouteDrop}
+	for _, r := range config.Routes {
+		rt := &route{Route: r, targets: make(map[string]bool, len(r.Targets))}
+		for _, target := range r.Targets {
+			rt.targets[target] = true
+		}
+		table.routes = append(table.routes, rt)
+	}
+	return table
+}
+
+// match returns the first route for data from src, or nil if none
+// matches.
+func (t *routeTable) match(src *net.UDPAddr, data []byte) *route {
+	if t == nil {
+		return nil
+	}
+	for _, rt := range t.routes {
+		if len(rt.Prefixes) > 0 && !hasAnyPrefix(data, rt.Prefixes) {
+			continue
+		}
+		if len(rt.Sources) > 0 && !rt.Sources.contains(src.IP) {
+			continue
+		}
+		return rt
+	}
+	return nil
+}
+
+// unrouted reports whether data from src is to be filtered for matching no
+// route.
+func (t *routeTable) unrouted(src *net.UDPAddr, data []byte) bool {
+	return t != nil && t.drop && t.match(src, data) == nil
+}
+
+// filter returns the targets that belong to the route's group, in order.
+func (rt *route) filter(targets []*targetConn) []*targetConn {
+	routed := make([]*targetConn, 0, len(rt.targets))
+	for _, target := range targets {
+		if rt.targets[*target.group.Load()] {
+			routed = append(routed, target)
+		}
+	}
+	return routed
+}
+
+// validateRoutes checks the route-default. The routes' targets are checked
+// by checkRoutes once the targets are known.
+func validateRoutes(config *Config) error {
+	switch config.RouteDefault {
+	case RouteAll, RouteDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid route-default %q: must be %s or %s", config.RouteDefault, RouteAll, RouteDrop)
+	}
+}
+
+// checkRoutes checks that every route's targets are among targets, as
+// written in the target list: from -targets, the config file or the
+// -targets-file, with srv:// targets by their name, which filter matches
+// them by.
+func checkRoutes(routes []Route, targets []string, settings targetSettings) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	configured := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		configured[settings.configured(target)] = true
+	}
+	for _, r := range routes {
+		for _, target := range r.Targets {
+			if !configured[target] {
+				return fmt.Errorf("target group %s: %s is not one of the targets", r.Group, target)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckRoutes(t *testing.T) {
+	routes := []Route{{Group: "video", Targets: []string{"10.0.0.1:9999", "srv://_video._udp.example.com"}}}
+	settings := targetSettings{origins: map[string]srvOrigin{
+		"10.0.0.2:9999": {srv: "srv://_video._udp.example.com"},
+	}}
+
+	if err := checkRoutes(routes, []string{"10.0.0.1:9999", "10.0.0.2:9999"}, settings); err != nil {
+		t.Errorf("routes to a target and a srv:// target its records list: %v", err)
+	}
+	err := checkRoutes(routes, []string{"10.0.0.1:9999"}, settings)
+	if want := "target group video: srv://_video._udp.example.com is not one of the targets"; err == nil || err.Error() != want {
+		t.Errorf("route to a srv:// target listing none: error %v, want %q", err, want)
+	}
+	if err := checkRoutes(nil, nil, targetSettings{}); err != nil {
+		t.Errorf("no routes: %v", err)
+	}
+}
+
+func routesConfig(t *testing.T, targetsFile string) *Config {
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.TargetAddrs = []string{"127.0.0.1:9"}
+	config.TargetsFile = targetsFile
+	config.Routes = []Route{{Prefixes: HexList{{0x01}}, Group: "video", Targets: []string{"127.0.0.1:10"}}}
+	return config
+}
+
+// TestRoutesToTargetsFile checks that a route may name a target of the
+// -targets-file, and that the relay keeps its targets when the file drops
+// one a route names.
+func TestRoutesToTargetsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "targets.txt")
+	if err := os.WriteFile(file, []byte("127.0.0.1:10\n127.0.0.1:11\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRelay(routesConfig(t, file))
+	if err != nil {
+		t.Fatalf("NewRelay with a route to a -targets-file target: %v", err)
+	}
+	r.Start(context.Background())
+	defer r.Stop()
+	want := r.Targets()
+
+	// The watcher takes the file as it finds it on start.
+	time.Sleep(targetsFilePoll / 2)
+	if err := os.WriteFile(file, []byte("127.0.0.1:11\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(targetsFilePoll * 5 / 2)
+	if got := r.Targets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("targets after the file dropped a routed one = %v, want them kept as %v", got, want)
+	}
+}
+
+func TestRoutesToUnknownTarget(t *testing.T) {
+	_, err := NewRelay(routesConfig(t, ""))
+	if err == nil {
+		t.Fatal("NewRelay with a route to a target not listed: no error")
+	}
+	if !errors.Is(err, ErrConfig) || !strings.Contains(err.Error(), "127.0.0.1:10 is not one of the targets") {
+		t.Errorf("error = %q, want an ErrConfig naming the target", err)
+	}
+}
@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropCountSpace is the room for the SO_RXQ_OVFL control message.
+var dropCountSpace = unix.CmsgSpace(4)
+
+// enableDropCount sets SO_RXQ_OVFL on conn, for every received packet to
+// carry the number of packets the kernel has dropped on the socket so far.
+func enableDropCount(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// dropCount returns the drop count in the control messages oob, read with
+// a packet. It is absent until the kernel first drops a packet.
+func dropCount(oob []byte) (uint32, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SO_RXQ_OVFL && len(msg.Data) >= 4 {
+			return binary.NativeEndian.Uint32(msg.Data), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// dropCountSpace is zero: only Linux reports drops with packets.
+var dropCountSpace = 0
+
+func enableDropCount(conn *net.UDPConn) error {
+	return errors.New("SO_RXQ_OVFL is only supported on Linux")
+}
+
+func dropCount(oob []byte) (uint32, bool) {
+	return 0, false
+}
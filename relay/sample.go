@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sample is a sampling ratio written as "1/10": one of every ten packets
+// is forwarded. The zero value, like "1/1", forwards every packet.
+type Sample struct {
+	every uint64
+}
+
+func parseSample(s string) (Sample, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Sample{}, nil
+	}
+	num, den, ok := strings.Cut(s, "/")
+	if !ok || strings.TrimSpace(num) != "1" {
+		return Sample{}, fmt.Errorf("invalid sample %q: must be 1/N, e.g. 1/10", s)
+	}
+	every, err := strconv.ParseUint(strings.TrimSpace(den), 10, 64)
+	if err != nil || every == 0 {
+		return Sample{}, fmt.Errorf("invalid sample %q: N must be a positive integer", s)
+	}
+	if every == 1 {
+		return Sample{}, nil
+	}
+	return Sample{every: every}, nil
+}
+
+func (s Sample) String() string {
+	if s.every == 0 {
+		return ""
+	}
+	return "1/" + strconv.FormatUint(s.every, 10)
+}
+
+// Set implements flag.Value.
+func (s *Sample) Set(value string) error {
+	v, err := parseSample(value)
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+func (s *Sample) UnmarshalYAML(value *yaml.Node) error {
+	var str string
+	if err := value.Decode(&str); err != nil {
+		return err
+	}
+	return s.Set(str)
+}
+
+func (s *Sample) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("sample must be a string such as \"1/10\"")
+	}
+	return s.Set(str)
+}
+
+// sampled reports whether the target is to be sent the next packet offered
+// to it: the first of every Sample, counting the packets it was offered.
+func (t *targetConn) sampled() bool {
+	every := t.sample.Load()
+	if every <= 1 {
+		return true
+	}
+	return (t.sampleSeq.Add(1)-1)%every == 0
+}
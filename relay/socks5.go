@@ -0,0 +1,239 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5 protocol values (RFC 1928, and RFC 1929 for authentication).
+const (
+	socksVersion      = 5
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+	socksAuthRejected = 0xff
+	socksCmdAssociate = 3
+	socksAtypIPv4     = 1
+	socksAtypIPv6     = 4
+	socksPasswordVer  = 1
+)
+
+var errProxyClosed = errors.New("SOCKS5 proxy closed the UDP association")
+
+// parseProxy parses the -proxy URL, socks5://[user:password@]host:port.
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -proxy %q: %v", s, err)
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("invalid -proxy %q: only socks5:// proxies are supported, since forwarding needs UDP", s)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid -proxy %q: %v", s, err)
+	}
+	return u, nil
+}
+
+// dialProxyTCP connects to a TCP target through the proxy. The connection
+// to the proxy gets the socket options.
+func dialProxyTCP(proxyURL *url.URL, addr *net.UDPAddr, opts socketOptions) (net.Conn, error) {
+	d, err := proxy.FromURL(proxyURL, proxyForward{opts})
+	if err != nil {
+		return nil, err
+	}
+	// The SOCKS5 dialer bounds the handshake by the context deadline only.
+	ctx, cancel := context.WithTimeout(context.Background(), tcpTimeout)
+	defer cancel()
+	conn, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", proxyURL.Host, err)
+	}
+	return conn, nil
+}
+
+// proxyForward dials the proxy itself for dialProxyTCP.
+type proxyForward struct {
+	opts socketOptions
+}
+
+func (f proxyForward) Dial(network, address string) (net.Conn, error) {
+	tcpAddr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return dialTCPTarget(&net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}, f.opts)
+}
+
+// socksUDPConn sends datagrams to one target through a SOCKS5 UDP
+// association. The association lasts as long as the TCP control connection
+// that set it up, so that connection is held open and watched.
+type socksUDPConn struct {
+	*net.UDPConn
+	ctrl net.Conn
+	// header is the SOCKS5 UDP request header for the target, and buf
+	// holds a datagram being built. Writes are serialized by targetConn.
+	header []byte
+	buf    []byte
+	closed atomic.Bool
+}
+
+// dialProxyUDP sets up a UDP association for addr with the proxy and
+// returns a connection whose writes reach addr through it.
+func dialProxyUDP(proxyURL *url.URL, addr *net.UDPAddr, opts socketOptions) (net.Conn, error) {
+	ctrl, err := opts.tcpDialer().Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(tcpTimeout))
+
+	relayAddr, err := socksAssociate(ctrl, proxyURL.User)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", proxyURL.Host, err)
+	}
+	ctrl.SetDeadline(time.Time{})
+	if relayAddr.IP.IsUnspecified() {
+		// The relay is on the proxy host.
+		relayAddr.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	opts.broadcast = false
+	udp, err := dialTarget(targetNetwork(relayAddr.String()), relayAddr, opts)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	c := &socksUDPConn{UDPConn: udp, ctrl: ctrl, header: socksUDPHeader(addr)}
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		c.closed.Store(true)
+	}()
+	return c, nil
+}
+
+func (c *socksUDPConn) Write(data []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, errProxyClosed
+	}
+	c.buf = append(append(c.buf[:0], c.header...), data...)
+	n, err := c.UDPConn.Write(c.buf)
+	// Report the payload bytes, so that a short write shows as one.
+	return max(n-len(c.header), 0), err
+}
+
+func (c *socksUDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// socksUDPHeader returns the header of datagrams to addr: two reserved
+// bytes, the fragment number (always 0) and the address.
+func socksUDPHeader(addr *net.UDPAddr) []byte {
+	header := []byte{0, 0, 0}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		header = append(header, socksAtypIPv4)
+		header = append(header, ip4...)
+	} else {
+		header = append(header, socksAtypIPv6)
+		header = append(header, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(header, uint16(addr.Port))
+}
+
+// socksAssociate authenticates on the control connection and asks for a
+// UDP association, returning the address datagrams are to be sent to.
+func socksAssociate(conn net.Conn, user *url.Userinfo) (*net.UDPAddr, error) {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	hello := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return nil, err
+	}
+	if choice[0] != socksVersion {
+		return nil, fmt.Errorf("unexpected protocol version %d", choice[0])
+	}
+	switch choice[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return nil, errors.New("proxy requires a username and password")
+		}
+		if err := socksAuthenticate(conn, user); err != nil {
+			return nil, err
+		}
+	case socksAuthRejected:
+		return nil, errors.New("no acceptable authentication method")
+	default:
+		return nil, fmt.Errorf("unsupported authentication method %d", choice[1])
+	}
+
+	// The client address is not known in advance; all zeros lets the proxy
+	// accept datagrams from wherever the relay sends them.
+	request := []byte{socksVersion, socksCmdAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0 {
+		return nil, fmt.Errorf("UDP associate failed with reply code %d", reply[1])
+	}
+	var ip []byte
+	switch reply[3] {
+	case socksAtypIPv4:
+		ip = make([]byte, net.IPv4len)
+	case socksAtypIPv6:
+		ip = make([]byte, net.IPv6len)
+	default:
+		return nil, fmt.Errorf("unsupported relay address type %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, ip); err != nil {
+		return nil, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
+
+// socksAuthenticate performs username/password authentication.
+func socksAuthenticate(conn net.Conn, user *url.Userinfo) error {
+	password, _ := user.Password()
+	if len(user.Username()) > 255 || len(password) > 255 {
+		return errors.New("username or password too long")
+	}
+	msg := []byte{socksPasswordVer, byte(len(user.Username()))}
+	msg = append(msg, user.Username()...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return err
+	}
+	if status[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"log/slog"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// topSourcesLogged is how many of the busiest sources the stats log shows.
+const topSourcesLogged = 10
+
+// SourceStats holds the receive counters for one source IP under
+// -track-sources.
+type SourceStats struct {
+	Source  string `json:"source"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// sourceTracker counts received packets per source IP, for at most max
+// sources. Counting a known source only takes the read lock; a new source
+// takes the write lock, and when the map is full first evicts the quarter
+// of the sources with the fewest packets, so that a flood of spoofed
+// addresses cannot grow it or push out the busy sources.
+type sourceTracker struct {
+	max     int
+	mu      sync.RWMutex
+	sources map[netip.Addr]*sourceCounts
+	// evicted counts the sources evicted so far, guarded by mu.
+	evicted uint64
+}
+
+type sourceCounts struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+func newSourceTracker(max int) *sourceTracker {
+	return &sourceTracker{max: max, sources: make(map[netip.Addr]*sourceCounts)}
+}
+
+// add counts a packet of size bytes from ip.
+func (t *sourceTracker) add(ip netip.Addr, size int) {
+	t.mu.RLock()
+	c := t.sources[ip]
+	t.mu.RUnlock()
+	if c == nil {
+		t.mu.Lock()
+		if c = t.sources[ip]; c == nil {
+			if len(t.sources) >= t.max {
+				t.evict()
+			}
+			c = &sourceCounts{}
+			t.sources[ip] = c
+		}
+		t.mu.Unlock()
+	}
+	c.packets.Add(1)
+	c.bytes.Add(uint64(size))
+}
+
+// evict removes the least active quarter of the sources, at least one. The
+// caller must hold mu for writing.
+func (t *sourceTracker) evict() {
+	type entry struct {
+		ip      netip.Addr
+		packets uint64
+	}
+	entries := make([]entry, 0, len(t.sources))
+	for ip, c := range t.sources {
+		entries = append(entries, entry{ip, c.packets.Load()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].packets < entries[j].packets })
+	for _, e := range entries[:max(len(entries)/4, 1)] {
+		delete(t.sources, e.ip)
+		t.evicted++
+	}
+}
+
+// top returns the n sources with the most packets, or all of them if n is
+// 0, busiest first, and the number of sources evicted so far.
+func (t *sourceTracker) top(n int) ([]SourceStats, uint64) {
+	t.mu.RLock()
+	stats := make([]SourceStats, 0, len(t.sources))
+	for ip, c := range t.sources {
+		stats = append(stats, SourceStats{Source: ip.String(), Packets: c.packets.Load(), Bytes: c.bytes.Load()})
+	}
+	evicted := t.evicted
+	t.mu.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Packets != stats[j].Packets {
+			return stats[i].Packets > stats[j].Packets
+		}
+		return stats[i].Source < stats[j].Source
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats, evicted
+}
+
+// logTopSources logs the busiest sources.
+func (r *Relay) logTopSources() {
+	top, evicted := r.sources.top(topSourcesLogged)
+	attrs := make([]any, 0, len(top)+1)
+	for _, s := range top {
+		attrs = append(attrs, slog.Group(s.Source, "packets", s.Packets, "bytes", s.Bytes))
+	}
+	attrs = append(attrs, "evicted", evicted)
+	slog.Info("Top sources", attrs...)
+}
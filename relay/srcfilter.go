@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// CIDRList is a comma-separated list of IP networks, such as the source
+// addresses given to -allow-src and -deny-src. A bare IP address stands for
+// itself alone.
+type CIDRList []netip.Prefix
+
+func parseCIDRList(items []string) (CIDRList, error) {
+	var list CIDRList
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid network %q: must be a CIDR such as 192.168.1.0/24 or an IP address", item)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		list = append(list, prefix.Masked())
+	}
+	return list, nil
+}
+
+func (l *CIDRList) String() string {
+	items := make([]string, len(*l))
+	for i, prefix := range *l {
+		items[i] = prefix.String()
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *CIDRList) Set(value string) error {
+	list, err := parseCIDRList(strings.Split(value, ","))
+	if err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// contains reports whether ip is in one of the networks. IPv4 addresses
+// match in their IPv4-mapped IPv6 form too, as a dual-stack socket reports
+// them.
+func (l CIDRList) contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyReason reports why packets from src are not accepted, or "" if they
+// are. -deny-src takes precedence over -allow-src, and an empty -allow-src
+// allows every source.
+func (r *Relay) denyReason(src *net.UDPAddr) string {
+	switch {
+	case r.config.DenySrc.contains(src.IP):
+		return "source matches -deny-src"
+	case len(r.config.AllowSrc) > 0 && !r.config.AllowSrc.contains(src.IP):
+		return "source not in -allow-src"
+	}
+	return ""
+}
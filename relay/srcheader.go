@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// With -prepend-source, every packet forwarded to a target starts with the
+// address of the host that sent it to the relay:
+//
+//	address  4 or 16 bytes  the source IP
+//	port     2 bytes        big-endian source port
+//	payload  the original packet
+//
+// The header has a fixed length per relay: 6 bytes when it listens on IPv4,
+// as with the default -listen 0.0.0.0, and 18 bytes otherwise, with IPv4
+// sources as IPv4-mapped IPv6 addresses. It follows the loop-guard and
+// -timestamp headers, so ParseStamp returns it as the start of the payload.
+
+// Lengths of the -prepend-source header.
+const (
+	SourceLen4 = 6
+	SourceLen6 = 18
+)
+
+// ParseSource splits a packet forwarded with -prepend-source into the
+// original source address, with IPv4-mapped addresses unmapped, and the
+// payload, skipping a loop-guard header in front. length is the relay's
+// header length, SourceLen4 or SourceLen6. ok is false if data is too short
+// to carry the header.
+func ParseSource(data []byte, length int) (src netip.AddrPort, payload []byte, ok bool) {
+	if bytes.HasPrefix(data, []byte(loopGuardMagic)) {
+		if end, ok := loopHeaderEnd(data); ok {
+			data = data[end:]
+		}
+	}
+	if (length != SourceLen4 && length != SourceLen6) || len(data) < length {
+		return netip.AddrPort{}, nil, false
+	}
+	ip, _ := netip.AddrFromSlice(data[:length-2])
+	port := binary.BigEndian.Uint16(data[length-2:])
+	return netip.AddrPortFrom(ip.Unmap(), port), data[length:], true
+}
+
+// sourceHeaderLen returns the -prepend-source header length for config, or
+// 0 without it.
+func sourceHeaderLen(config *Config) int {
+	switch {
+	case !config.PrependSource:
+		return 0
+	case udpNetwork(strings.Trim(config.ListenAddr, "[]")) == "udp4":
+		return SourceLen4
+	default:
+		return SourceLen6
+	}
+}
+
+// appendSource appends the -prepend-source header of length for src to dst.
+// An IPv6 source in a 6-byte header, which only -replay can produce, is
+// written as 0.0.0.0.
+func appendSource(dst []byte, src *net.UDPAddr, length int) []byte {
+	if length == SourceLen4 {
+		ip := src.IP.To4()
+		if ip == nil {
+			ip = net.IPv4zero.To4()
+		}
+		dst = append(dst, ip...)
+	} else {
+		dst = append(dst, src.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(dst, uint16(src.Port))
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// srvScheme marks a target that stands for the targets listed by the DNS
+// SRV records of a name, e.g. srv://_relay._udp.example.com: each record's
+// host and port becomes a UDP target. The records are read again every
+// -dns-refresh.
+const srvScheme = "srv://"
+
+// srvOrigin is the srv:// target, as configured, that a target was read
+// from, and the weight of its record.
+type srvOrigin struct {
+	srv    string
+	weight int
+}
+
+// lookupSRV returns the targets listed by the SRV records of the name in
+// the srv:// target srv, as host:port, with their records' weights.
+func lookupSRV(ctx context.Context, srv string) ([]string, []int, error) {
+	name := strings.TrimPrefix(srv, srvScheme)
+	if name == "" {
+		return nil, nil, fmt.Errorf("target %s: missing SRV name", srv)
+	}
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, nil, classify(ErrTargetResolve, fmt.Errorf("failed to look up SRV records of target %s: %v", srv, err))
+	}
+	var targets []string
+	var weights []int
+	for _, rec := range records {
+		if rec.Target == "." {
+			// The service is decidedly not available at this name.
+			continue
+		}
+		host := strings.TrimSuffix(rec.Target, ".")
+		targets = append(targets, net.JoinHostPort(host, strconv.Itoa(int(rec.Port))))
+		weights = append(weights, int(rec.Weight))
+	}
+	if len(targets) == 0 {
+		return nil, nil, fmt.Errorf("target %s: the SRV records list no targets", srv)
+	}
+	return targets, weights, nil
+}
+
+// expandSRV replaces the srv:// targets among targets by the targets their
+// records list, recording in settings where each came from. With skipBad,
+// an srv:// target whose records cannot be read is skipped instead.
+func expandSRV(ctx context.Context, targets []string, settings *targetSettings, skipBad bool) ([]string, error) {
+	if !slices.ContainsFunc(targets, isSRVTarget) {
+		return targets, nil
+	}
+	var expanded []string
+	settings.origins = make(map[string]srvOrigin)
+	for _, target := range targets {
+		if !isSRVTarget(target) {
+			expanded = append(expanded, target)
+			continue
+		}
+		listed, weights, err := lookupSRV(ctx, target)
+		if err != nil {
+			if skipBad {
+				slog.Warn("Skipping target", "target", target, "error", err)
+				continue
+			}
+			return nil, &TargetError{Target: target, Err: err}
+		}
+		for i, t := range listed {
+			if _, ok := settings.origins[t]; !ok {
+				settings.origins[t] = srvOrigin{srv: target, weight: weights[i]}
+			}
+		}
+		expanded = append(expanded, listed...)
+	}
+	return expanded, nil
+}
+
+func isSRVTarget(target string) bool {
+	return strings.HasPrefix(target, srvScheme)
+}
+
+// resolveConfigTargets returns the targets to forward to under config, as
+// configTargets does but with srv:// targets replaced by the ones their
+// records list and -target-port-map applied, and the settings for them.
+// The routes must name only targets among them.
+func resolveConfigTargets(ctx context.Context, config *Config) ([]string, targetSettings, error) {
+	settings := configTargetSettings(config)
+	targets, err := configTargets(config)
+	if err == nil {
+		targets, err = expandSRV(ctx, targets, &settings, config.SkipBadTargets)
+	}
+	if err == nil {
+		targets = shiftTargets(targets, &settings, config)
+		err = checkRoutes(config.Routes, targets, settings)
+	}
+	return targets, settings, err
+}
+
+// srvRefresh is what refreshSRV keeps between calls: the targets the
+// records listed, with their srv:// targets and weights, and whether
+// reading them is failing.
+type srvRefresh struct {
+	origins map[string]srvOrigin
+	failing bool
+}
+
+// refreshSRV reads the records of the srv:// targets again and applies the
+// changes. When the records cannot be read, which is logged once until they
+// can again, the targets are kept.
+func (r *Relay) refreshSRV(state *srvRefresh) {
+	config := r.lastConfig.Load()
+	targets, err := configTargets(config)
+	if err != nil || !slices.ContainsFunc(targets, isSRVTarget) {
+		return
+	}
+	settings := configTargetSettings(config)
+	// Records that cannot be read now leave every target as it is, even
+	// with -skip-bad-targets.
+	expanded, err := expandSRV(r.ctx, targets, &settings, false)
+	switch {
+	case err != nil && !state.failing:
+		slog.Warn("Failed to read SRV records, keeping the current targets", "error", err)
+		state.failing = true
+	case err == nil && state.failing:
+		slog.Info("SRV records can be read again")
+		state.failing = false
+	}
+	if err != nil {
+		return
+	}
+	// A record whose weight alone changed changes the targets' weights.
+	if state.origins != nil && maps.Equal(settings.origins, state.origins) {
+		return
+	}
+	expanded = shiftTargets(expanded, &settings, config)
+	err = checkRoutes(config.Routes, expanded, settings)
+	if err == nil {
+		err = r.setTargets(expanded, settings)
+	}
+	if err != nil {
+		slog.Warn("Failed to apply changed SRV records, keeping the current targets", "error", err)
+		return
+	}
+	if state.origins != nil {
+		slog.Info("SRV records changed", "targets", r.Targets())
+	}
+	state.origins = settings.origins
+}
@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// srvServer answers the SRV queries of the Go resolver with records that
+// point at localhost, with the weight in weight.
+type srvServer struct {
+	conn   net.PacketConn
+	mu     sync.Mutex
+	weight uint16
+}
+
+func startSRVServer(t *testing.T) *srvServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &srvServer{conn: conn, weight: 1}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	resolver := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "udp4", conn.LocalAddr().String())
+	}}
+	t.Cleanup(func() { net.DefaultResolver = resolver })
+	return s
+}
+
+func (s *srvServer) setWeight(weight uint16) {
+	s.mu.Lock()
+	s.weight = weight
+	s.mu.Unlock()
+}
+
+func (s *srvServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		q := query.Questions[0]
+		reply := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+			Questions: query.Questions,
+		}
+		if q.Type == dnsmessage.TypeSRV {
+			s.mu.Lock()
+			weight := s.weight
+			s.mu.Unlock()
+			reply.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 1},
+				Body:   &dnsmessage.SRVResource{Weight: weight, Port: 9, Target: dnsmessage.MustNewName("localhost.")},
+			}}
+		}
+		if b, err := reply.Pack(); err == nil {
+			s.conn.WriteTo(b, from)
+		}
+	}
+}
+
+// TestRefreshSRVWeight checks that a refresh of the SRV records applies a
+// changed weight to the target, which the records list as before.
+func TestRefreshSRVWeight(t *testing.T) {
+	dns := startSRVServer(t)
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.Mode = ModeBalance
+	config.TargetAddrs = []string{"srv://_relay._udp.example.test."}
+	r, err := NewRelay(config)
+	if err != nil {
+		t.Fatalf("NewRelay: %v", err)
+	}
+	defer r.Stop()
+	weight := func() int32 { return r.targets()[0].weight.Load() }
+	if got := weight(); got != 1 {
+		t.Fatalf("weight = %d, want the record's 1", got)
+	}
+
+	var state srvRefresh
+	r.refreshSRV(&state)
+	dns.setWeight(5)
+	r.refreshSRV(&state)
+	if got := weight(); got != 5 {
+		t.Errorf("weight after the record's changed to 5 = %d, want 5", got)
+	}
+}
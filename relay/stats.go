@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// A Snapshot is the state of a relay at one time, as Snapshot returns it:
+// the stats, how long the relay has been running and with what. It shares
+// no memory with the relay, and may be kept and read freely.
+type Snapshot struct {
+	StatsSnapshot
+	Version string
+	// Started is when the relay was started, and Uptime how long ago.
+	Started time.Time
+	Uptime  time.Duration
+	// TargetAddrs are the current forwarding targets, in order; their
+	// stats are in Targets.
+	TargetAddrs []string
+	// Config has every option as it would be given on the command line,
+	// with the proxy password redacted.
+	Config map[string]string
+	// Sources are the -track-sources counters, busiest first, and
+	// SourcesEvicted the sources dropped to make room.
+	Sources        []SourceStats
+	SourcesEvicted uint64
+}
+
+// Snapshot returns the stats and a summary of the relay, for embedders
+// that show them their own way. It may be called from any goroutine while
+// the relay runs.
+func (r *Relay) Snapshot() Snapshot {
+	snap := Snapshot{
+		StatsSnapshot: r.snapshot(),
+		Version:       Version,
+		TargetAddrs:   r.Targets(),
+		Config:        configFlags(r.lastConfig.Load()),
+	}
+	if started := r.startTime(); !started.IsZero() {
+		snap.Started = started
+		snap.Uptime = time.Since(started)
+	}
+	if r.sources != nil {
+		snap.Sources, snap.SourcesEvicted = r.sources.top(0)
+	}
+	return snap
+}
+
+type statsResponse struct {
+	Uptime        string  `json:"uptime"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	StatsSnapshot
+	// Sources are the -track-sources counters, busiest first.
+	Sources        []SourceStats `json:"sources,omitempty"`
+	SourcesEvicted uint64        `json:"sources_evicted,omitempty"`
+}
+
+// handleStats writes a snapshot of the relay counters as JSON, for scripts
+// that want a quick look without a Prometheus setup.
+func (r *Relay) handleStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uptime := time.Since(r.startTime())
+	resp := statsResponse{
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: uptime.Seconds(),
+		StatsSnapshot: r.snapshot(),
+	}
+	if r.sources != nil {
+		resp.Sources, resp.SourcesEvicted = r.sources.top(0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(resp)
+}
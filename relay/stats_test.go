@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSnapshotWhileStarting takes snapshots while the relay starts and is
+// reloaded. Run with -race.
+func TestSnapshotWhileStarting(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.TargetAddrs = []string{"127.0.0.1:9"}
+	r, err := NewRelay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if snap := r.Snapshot(); !snap.Started.IsZero() || snap.Uptime != 0 {
+		t.Errorf("snapshot before Start: started %v, uptime %v, want zero", snap.Started, snap.Uptime)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.Snapshot()
+			}
+		}
+	}()
+
+	before := time.Now()
+	r.Start(context.Background())
+	reloaded := *config
+	reloaded.TargetAddrs = []string{"127.0.0.1:9", "127.0.0.1:10"}
+	if err := r.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	snap := r.Snapshot()
+	if snap.Started.Before(before.Truncate(time.Second)) || snap.Started.After(time.Now()) {
+		t.Errorf("Started = %v, want about %v", snap.Started, before)
+	}
+	if want := "127.0.0.1:9,127.0.0.1:10"; snap.Config["targets"] != want {
+		t.Errorf("Config[targets] = %q after a reload, want %q", snap.Config["targets"], want)
+	}
+}
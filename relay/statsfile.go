@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// loadStatsFile adds the counters saved in the -stats-file to the stats,
+// for totals over the relay's restarts. A missing file is a first start;
+// one that cannot be read or parsed is logged and written over later.
+func (r *Relay) loadStatsFile() {
+	path := r.config.StatsFile
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	var saved StatsSnapshot
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		slog.Warn("Failed to load stats file, counting from zero", "file", path, "error", err)
+		return
+	}
+	r.stats.add(saved)
+	slog.Info("Loaded stats file", "file", path, "packets_received", saved.PacketsReceived, "packets_forwarded", saved.PacketsForwarded)
+}
+
+// add adds the counters of saved to the stats. The states of the targets
+// and the rates are not counters, and are left as they are.
+func (s *Stats) add(saved StatsSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.PacketsReceived += saved.PacketsReceived
+	s.PacketsForwarded += saved.PacketsForwarded
+	s.BytesReceived += saved.BytesReceived
+	s.BytesForwarded += saved.BytesForwarded
+	s.PacketsFiltered += saved.PacketsFiltered
+	s.PacketsDuplicate += saved.PacketsDuplicate
+	s.PacketsRewritten += saved.PacketsRewritten
+	s.PacketsDenied += saved.PacketsDenied
+	s.PacketsSampled += saved.PacketsSampled
+	s.PacketsDropped += saved.PacketsDropped
+	s.ReceiveDropped += saved.ReceiveDropped
+	s.LoopDropped += saved.LoopDropped
+	s.Truncated += saved.Truncated
+	s.ChaosDropped += saved.ChaosDropped
+	s.NoTargets += saved.NoTargets
+	s.QueueDropped += saved.QueueDropped
+	s.KernelDropped += saved.KernelDropped
+	s.TooBig += saved.TooBig
+	s.Errors += saved.Errors
+	for name, saved := range saved.Targets {
+		ts := s.target(name)
+		ts.PacketsForwarded += saved.PacketsForwarded
+		ts.BytesForwarded += saved.BytesForwarded
+		ts.PacketsDropped += saved.PacketsDropped
+		ts.PacketsSampled += saved.PacketsSampled
+		ts.ChaosDropped += saved.ChaosDropped
+		ts.Errors += saved.Errors
+		ts.TooBig += saved.TooBig
+		ts.Keepalives += saved.Keepalives
+		ts.BytesUncompressed += saved.BytesUncompressed
+		ts.BytesCompressed += saved.BytesCompressed
+	}
+	for port, saved := range saved.Ports {
+		if s.Ports == nil {
+			s.Ports = make(map[string]*PortStats)
+		}
+		ps := s.Ports[port]
+		if ps == nil {
+			ps = &PortStats{}
+			s.Ports[port] = ps
+		}
+		ps.PacketsReceived += saved.PacketsReceived
+		ps.BytesReceived += saved.BytesReceived
+	}
+}
+
+// SaveStats writes the current stats to the -stats-file, replacing it
+// whole, so that a crash while writing leaves the last one intact.
+func (r *Relay) SaveStats() error {
+	path := r.config.StatsFile
+	if path == "" {
+		return errors.New("no -stats-file configured")
+	}
+	data, err := json.MarshalIndent(r.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write stats file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write stats file: %v", err)
+	}
+	return nil
+}
+
+// statsFileWriter saves the stats every -stats-file-interval until the
+// relay stops, which saves them a last time.
+func (r *Relay) statsFileWriter() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.StatsFileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.SaveStats(); err != nil {
+				r.logError("Failed to save stats", "", err, "file", r.config.StatsFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package relay
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// grpcSubscribePath serves the Subscribe RPC of the Relay service in
+// relay.proto.
+const grpcSubscribePath = "/broadcastrelay.v1.Relay/Subscribe"
+
+// subscriberQueue is how many packets may wait for a slow -grpc-addr
+// subscriber before further ones are dropped for it.
+const subscriberQueue = 1024
+
+// gRPC status codes sent in the grpc-status trailer.
+const (
+	grpcOK          = 0
+	grpcUnavailable = 14
+)
+
+// grpcMessage percent-encodes message for the grpc-message trailer, as
+// the gRPC over HTTP/2 spec has it: every byte of its UTF-8 outside
+// printable ASCII, and the percent sign itself, as %XX.
+func grpcMessage(message string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// streamPacket is a received packet as sent to subscribers.
+type streamPacket struct {
+	src      string
+	received time.Time
+	data     []byte
+}
+
+// appendMessage appends p as a gRPC message: an uncompressed flag, the
+// length and the Packet message of relay.proto in protobuf encoding.
+func (p *streamPacket) appendMessage(b []byte) []byte {
+	b = append(b, 0, 0, 0, 0, 0)
+	start := len(b)
+	// Each field starts with its number shifted left by three and its
+	// wire type: 0 for varints, 2 for length-prefixed bytes.
+	b = append(b, 1<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(p.src)))
+	b = append(b, p.src...)
+	b = append(b, 2<<3|0)
+	b = binary.AppendUvarint(b, uint64(p.received.UnixNano()))
+	b = append(b, 3<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(p.data)))
+	b = append(b, p.data...)
+	binary.BigEndian.PutUint32(b[start-4:start], uint32(len(b)-start))
+	return b
+}
+
+// subscriber is one client of the packet stream.
+type subscriber struct {
+	remote  string
+	packets chan *streamPacket
+	dropped atomic.Uint64
+}
+
+// packetStream hands received packets to the -grpc-addr subscribers.
+type packetStream struct {
+	mu   sync.RWMutex
+	subs map[*subscriber]struct{}
+	// count is len(subs), checked for every packet without taking mu.
+	count atomic.Int32
+}
+
+func (s *packetStream) subscribe(remote string) *subscriber {
+	sub := &subscriber{remote: remote, packets: make(chan *streamPacket, subscriberQueue)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[*subscriber]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	s.count.Store(int32(len(s.subs)))
+	return sub
+}
+
+func (s *packetStream) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, sub)
+	s.count.Store(int32(len(s.subs)))
+}
+
+// publish queues pkt for every subscriber, dropping it for those whose
+// queue is full so that a slow one does not hold up forwarding.
+func (s *packetStream) publish(pkt *packet) {
+	if s.count.Load() == 0 {
+		return
+	}
+	sp := &streamPacket{src: pkt.src.String(), received: pkt.received, data: slices.Clone(pkt.data)}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for sub := range s.subs {
+		select {
+		case sub.packets <- sp:
+		default:
+			if sub.dropped.Add(1) == 1 {
+				slog.Warn("gRPC subscriber is too slow, dropping packets for it", "remote", sub.remote)
+			}
+		}
+	}
+}
+
+// handleSubscribe serves the Subscribe RPC: it streams received packets to
+// the client until it goes away or the relay stops.
+func (r *Relay) handleSubscribe(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "only gRPC requests are served here", http.StatusUnsupportedMediaType)
+		return
+	}
+	if req.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := r.stream.subscribe(req.RemoteAddr)
+	defer r.stream.unsubscribe(sub)
+	slog.Info("gRPC subscriber connected", "remote", req.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	status, message := grpcOK, ""
+	var msg []byte
+loop:
+	for {
+		select {
+		case <-req.Context().Done():
+			break loop
+		case <-r.ctx.Done():
+			status, message = grpcUnavailable, "the relay is stopping"
+			break loop
+		case sp := <-sub.packets:
+			msg = sp.appendMessage(msg[:0])
+			if _, err := w.Write(msg); err != nil {
+				break loop
+			}
+			// Packets already waiting go out in the same flush.
+			if len(sub.packets) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(status))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcMessage(message))
+	}
+	slog.Info("gRPC subscriber disconnected", "remote", req.RemoteAddr, "dropped", sub.dropped.Load())
+}
@@ -0,0 +1,147 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestGRPCMessage(t *testing.T) {
+	tests := []struct {
+		message, want string
+	}{
+		{"the relay is stopping", "the relay is stopping"},
+		{"100% done", "100%25 done"},
+		{"line\nbreak\ttab", "line%0Abreak%09tab"},
+		{"中继", "%E4%B8%AD%E7%BB%A7"},
+		{"~ and del\x7f", "~ and del%7F"},
+	}
+	for _, tt := range tests {
+		if got := grpcMessage(tt.message); got != tt.want {
+			t.Errorf("grpcMessage(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+// rawCodec passes gRPC messages through as the bytes of their protobuf
+// encoding, so that the test needs no code generated from relay.proto.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) { return *v.(*[]byte), nil }
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+func (rawCodec) Name() string { return "proto" }
+
+// decodePacket decodes a Packet message of relay.proto.
+func decodePacket(b []byte) (source string, received int64, payload []byte, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", 0, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			source = string(v)
+		case num == 2 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			received = int64(v)
+		case num == 3 && typ == protowire.BytesType:
+			payload, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", 0, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return source, received, payload, nil
+}
+
+// TestSubscribeInterop subscribes to the packet stream with grpc-go, and
+// checks the packets it gets and the status it ends with.
+func TestSubscribeInterop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcAddr := l.Addr().String()
+	l.Close()
+
+	config := DefaultConfig()
+	config.TargetAddrs = []string{"127.0.0.1:9"}
+	config.GRPCAddr = grpcAddr
+	r, src := startRelay(t, config)
+
+	conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, grpcSubscribePath,
+		grpc.ForceCodec(rawCodec{}), grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+	request := []byte{}
+	if err := stream.SendMsg(&request); err != nil {
+		t.Fatalf("SendMsg: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	// The response headers are sent once the subscription is in place.
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("Header: %v", err)
+	}
+
+	before := time.Now()
+	const count = 3
+	for i := 0; i < count; i++ {
+		if _, err := src.Write([]byte(fmt.Sprintf("packet %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		var msg []byte
+		if err := stream.RecvMsg(&msg); err != nil {
+			t.Fatalf("RecvMsg %d: %v", i, err)
+		}
+		source, received, payload, err := decodePacket(msg)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if want := src.LocalAddr().String(); source != want {
+			t.Errorf("packet %d source = %q, want %q", i, source, want)
+		}
+		if at := time.Unix(0, received); at.Before(before.Add(-time.Second)) || at.After(time.Now()) {
+			t.Errorf("packet %d received at %v, want about %v", i, at, before)
+		}
+		if want := fmt.Sprintf("packet %d", i); string(payload) != want {
+			t.Errorf("packet %d payload = %q, want %q", i, payload, want)
+		}
+	}
+
+	r.Stop()
+	var msg []byte
+	err = stream.RecvMsg(&msg)
+	if st, ok := status.FromError(err); !ok || st.Code() != codes.Unavailable || st.Message() != "the relay is stopping" {
+		t.Errorf("stream ended with %v, want Unavailable: the relay is stopping", err)
+	}
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A connected UDP socket reports an ICMP port unreachable from the target
+// as ECONNREFUSED on a later write; a TCP target refuses or fails to accept
+// the connection. Such a target is marked down: packets
+// to it are not sent, and every probe interval one is sent as a probe. The
+// interval doubles, up to the maximum, for as long as the target refuses.
+const (
+	minProbeInterval = time.Second
+	maxProbeInterval = 30 * time.Second
+)
+
+type healthState int
+
+const (
+	healthUp healthState = iota
+	healthDown
+	// healthProbing is a down target whose probe was written without error.
+	// Since refusals arrive late, it only counts as up after the next write
+	// succeeds too.
+	healthProbing
+)
+
+// targetHealth tracks whether a target is refusing packets.
+type targetHealth struct {
+	mu        sync.Mutex
+	state     healthState
+	interval  time.Duration
+	nextProbe time.Time
+}
+
+// allow reports whether a packet should be sent to the target now: always
+// when it is up, and once per probe interval when it is down.
+func (h *targetHealth) allow(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state != healthDown || !now.Before(h.nextProbe) {
+		return true
+	}
+	return false
+}
+
+// record updates the state with the result of a write and reports whether
+// the target went down or came back up as a result.
+func (h *targetHealth) record(err error, now time.Time) (wentDown, cameUp bool) {
+	refused := isRefused(err)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case refused && h.state == healthUp:
+		h.state = healthDown
+		h.interval = minProbeInterval
+		h.nextProbe = now.Add(h.interval)
+		return true, false
+	case refused:
+		h.state = healthDown
+		h.interval = min(2*h.interval, maxProbeInterval)
+		h.nextProbe = now.Add(h.interval)
+	case err == nil && h.state == healthDown:
+		h.state = healthProbing
+	case err == nil && h.state == healthProbing:
+		h.state = healthUp
+		return false, true
+	}
+	return false, false
+}
+
+// isRefused reports whether err means the target refused the packet or the
+// connection: for TCP and Unix socket targets, failing to connect means
+// nobody is listening. A UDP socket that cannot be dialed is a local
+// problem, such as a missing route, rather than a refusal.
+func isRefused(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &opErr) && opErr.Op == "dial" && (strings.HasPrefix(opErr.Net, "tcp") || opErr.Net == "unixgram")
+}
+
+// down reports whether the target is currently considered down.
+func (h *targetHealth) down() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state != healthUp
+}
@@ -0,0 +1,189 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// targetsFilePoll is how often the -targets-file is checked for changes
+// where its directory cannot be watched.
+const targetsFilePoll = time.Second
+
+// targetsFileSettle is how long the watcher waits after a change in the
+// -targets-file's directory before it reads the file, for the burst of
+// events of one write or replace to end in a single read.
+const targetsFileSettle = 100 * time.Millisecond
+
+// readTargetsFile reads a -targets-file: one target per line, written as in
+// -targets, with blank lines and comments from # to the end of the line
+// ignored.
+func readTargetsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open targets file: %v", err)
+	}
+	defer f.Close()
+
+	var targets []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			targets = append(targets, fields[0])
+		default:
+			return nil, fmt.Errorf("targets file %s, line %d: %q is not a single target", path, n, strings.TrimSpace(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read targets file: %v", err)
+	}
+	return targets, nil
+}
+
+// stripComment cuts line at a # that starts it or follows a space or tab,
+// so that a # inside a target, as in a Unix socket path, is kept.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// configTargets returns the targets to forward to under config: those it
+// lists, then those in its -targets-file, and under -output broadcast the
+// local broadcast addresses.
+func configTargets(config *Config) ([]string, error) {
+	if config.TargetsFile == "" {
+		return outputTargets(config)
+	}
+	listed, err := readTargetsFile(config.TargetsFile)
+	if err != nil {
+		return nil, err
+	}
+	withFile := *config
+	withFile.TargetAddrs = append(slices.Clip(config.TargetAddrs), listed...)
+	targets, err := outputTargets(&withFile)
+	if err == nil && len(targets) == 0 {
+		err = fmt.Errorf("%w: the targets file %s lists none", ErrNoTargets, config.TargetsFile)
+	}
+	return targets, err
+}
+
+// targetsFileWatcher applies changes to the -targets-file. It watches the
+// file's directory rather than the file, for a file that is replaced by a
+// rename, as editors, configuration management tools and Kubernetes
+// ConfigMap volumes do, to be seen too; the file is polled instead where
+// the directory cannot be watched. Either way it is re-read, and the
+// targets replaced, only when its content changes.
+func (r *Relay) targetsFileWatcher() {
+	defer r.wg.Done()
+
+	// Without a watcher its channels stay nil, and the ticker polls.
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("Failed to watch the targets file, polling it instead", "error", err)
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+	ticker := time.NewTicker(targetsFilePoll)
+	defer ticker.Stop()
+	settle := time.NewTimer(targetsFileSettle)
+	settle.Stop()
+	defer settle.Stop()
+
+	// dir is the directory of the file, which is watched if watching.
+	dir, watching := "", false
+	var last [sha256.Size]byte
+	if data, err := os.ReadFile(r.config.TargetsFile); err == nil {
+		last = sha256.Sum256(data)
+	}
+	missing := false
+	for {
+		config := r.lastConfig.Load()
+		if d := filepath.Dir(config.TargetsFile); config.TargetsFile != "" && d != dir {
+			// Started, or reloaded with a file elsewhere.
+			if watching {
+				watcher.Remove(dir)
+			}
+			dir, watching = d, false
+			if watcher != nil {
+				if err := watcher.Add(dir); err != nil {
+					slog.Warn("Failed to watch the targets file's directory, polling the file instead", "dir", dir, "error", err)
+				} else {
+					watching = true
+				}
+			}
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-events:
+			// Any file of the directory, as the targets file may be a
+			// symbolic link to one that is replaced.
+			settle.Reset(targetsFileSettle)
+			continue
+		case err := <-errs:
+			slog.Warn("Error watching the targets file", "file", config.TargetsFile, "error", err)
+			continue
+		case <-ticker.C:
+			if watching {
+				continue
+			}
+		case <-settle.C:
+		}
+
+		if config.TargetsFile == "" {
+			// Reloaded without one.
+			continue
+		}
+		data, err := os.ReadFile(config.TargetsFile)
+		switch {
+		case err != nil:
+			if !missing {
+				slog.Warn("Failed to read targets file, keeping the current targets", "file", config.TargetsFile, "error", err)
+				missing = true
+			}
+			continue
+		case missing:
+			slog.Info("Targets file is readable again", "file", config.TargetsFile)
+			missing = false
+		}
+		sum := sha256.Sum256(data)
+		if sum == last {
+			continue
+		}
+		last = sum
+
+		before := r.Targets()
+		targets, settings, err := resolveConfigTargets(r.ctx, config)
+		if err == nil {
+			err = r.setTargets(targets, settings)
+		}
+		if err != nil {
+			slog.Error("Invalid targets file, keeping the current targets", "file", config.TargetsFile, "error", err)
+			continue
+		}
+		if after := r.Targets(); !slices.Equal(before, after) {
+			slog.Info("Targets file changed", "file", config.TargetsFile, "targets", after)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestTargetsFileReplaced replaces the -targets-file by a rename, with one
+// of the same size and modification time, and checks that the relay takes
+// its targets.
+func TestTargetsFileReplaced(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.txt")
+	if err := os.WriteFile(file, []byte("127.0.0.1:10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1"
+	config.ListenPorts = PortList{0}
+	config.TargetsFile = file
+	r, err := NewRelay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start(context.Background())
+	defer r.Stop()
+
+	// The watcher takes the file as it finds it on start.
+	time.Sleep(targetsFilePoll / 2)
+	replacement := filepath.Join(dir, "targets.txt.tmp")
+	if err := os.WriteFile(replacement, []byte("127.0.0.1:11\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(replacement, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, file); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"127.0.0.1:11"}
+	for deadline := time.Now().Add(5 * time.Second); !reflect.DeepEqual(r.Targets(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("targets after the file was replaced = %v, want %v", r.Targets(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// tcpScheme marks a target that is forwarded to over a TCP connection
+// instead of UDP, e.g. tcp://collector:5170. Each datagram is written as one
+// frame: its length as a 4-byte big-endian unsigned integer, followed by the
+// payload.
+const tcpScheme = "tcp://"
+
+// tcpTimeout bounds connecting to a TCP target and, unless -write-timeout is
+// set, writing a frame to it, so that a stalled consumer holds up a
+// forwarding worker only briefly.
+const tcpTimeout = 2 * time.Second
+
+// tcpDialer returns the dialer for TCP connections, which are made from
+// -egress-addr if it is set.
+func (o socketOptions) tcpDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: tcpTimeout}
+	if o.egress.IsValid() {
+		d.LocalAddr = &net.TCPAddr{IP: o.egress.AsSlice(), Zone: o.egress.Zone()}
+	}
+	return d
+}
+
+// dialTCPTarget connects to a TCP target.
+func dialTCPTarget(addr *net.UDPAddr, opts socketOptions) (net.Conn, error) {
+	conn, err := opts.tcpDialer().Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.dscp > 0 {
+		if err := setDSCP(conn, opts.dscp); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if opts.ttl > 0 {
+		if isIPv6Conn(conn) {
+			err = ipv6.NewConn(conn).SetHopLimit(opts.ttl)
+		} else {
+			err = ipv4.NewConn(conn).SetTTL(opts.ttl)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// appendFrame appends data to buf as one length-prefixed frame.
+func appendFrame(buf, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// writeFrame writes data to conn as one length-prefixed frame and returns
+// the number of payload bytes written. The caller sets the write deadline.
+func writeFrame(conn net.Conn, data []byte) (int, error) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+
+	bufs := net.Buffers{header[:], data}
+	if _, err := bufs.WriteTo(conn); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// With -timestamp, every packet forwarded to a target starts with:
+//
+//	sequence  8 bytes  big-endian, 1 for the first packet sent to the
+//	                   target, counting up by one per packet
+//	sent      8 bytes  big-endian send time, nanoseconds since the Unix
+//	                   epoch
+//	payload   the original packet
+//
+// Sequence numbers are kept per target, so a gap seen by a receiver is a
+// packet lost after leaving the relay. With -loop-guard the stamp follows
+// the loop-guard header, which the next relay strips as usual.
+
+// StampLen is the length of the -timestamp header.
+const StampLen = 16
+
+// ParseStamp splits a packet forwarded with -timestamp into the sequence
+// number, the time the relay sent it and the original payload, skipping a
+// loop-guard header in front. ok is false if data is too short to carry the
+// header.
+func ParseStamp(data []byte) (seq uint64, sent time.Time, payload []byte, ok bool) {
+	if bytes.HasPrefix(data, []byte(loopGuardMagic)) {
+		if end, ok := loopHeaderEnd(data); ok {
+			data = data[end:]
+		}
+	}
+	if len(data) < StampLen {
+		return 0, time.Time{}, nil, false
+	}
+	seq = binary.BigEndian.Uint64(data)
+	sent = time.Unix(0, int64(binary.BigEndian.Uint64(data[8:])))
+	return seq, sent, data[StampLen:], true
+}
+
+// appendStamp appends the -timestamp header for seq and now to dst.
+func appendStamp(dst []byte, seq uint64, now time.Time) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, seq)
+	return binary.BigEndian.AppendUint64(dst, uint64(now.UnixNano()))
+}
+
+// stamp appends to dst what to send to target with the -timestamp header
+// for the target's next sequence number and now, and the -prepend-source
+// header, inserted in front of the payload, after any loop-guard header.
+func (r *Relay) stamp(dst []byte, p *packet, target *targetConn, now time.Time) []byte {
+	data := p.payload(target)
+	dst = append(dst, data[:len(data)-len(p.data)]...)
+	if r.config.Timestamp {
+		dst = appendStamp(dst, target.seq.Add(1), now)
+	}
+	if r.sourceLen > 0 {
+		dst = appendSource(dst, p.src, r.sourceLen)
+	}
+	return append(dst, p.data...)
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// tlsScheme marks a TCP target whose connection is wrapped in TLS, e.g.
+// tls://collector.example.com:5171. Datagrams are framed as for tcp://
+// targets; each frame goes out as one TLS record.
+const tlsScheme = "tls://"
+
+// newTLSConfig returns the client configuration TLS targets start from:
+// the system roots, or those in caFile, and no verification if insecure.
+func newTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -tls-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-tls-ca %s contains no PEM certificates", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// tlsTargetConfig returns the configuration for a tls:// target, which
+// verifies the certificate against the host as written in the target, not
+// the address it resolved to.
+func tlsTargetConfig(base *tls.Config, target string) *tls.Config {
+	config := base.Clone()
+	hostPort := strings.TrimPrefix(target, tlsScheme)
+	if host, _, err := net.SplitHostPort(hostPort); err == nil {
+		config.ServerName = host
+	}
+	return config
+}
+
+// handshakeTLS runs the TLS handshake on conn, a connection to a TLS
+// target, bounded like connecting by tcpTimeout.
+func handshakeTLS(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tcpTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", config.ServerName, err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// errTransparentFamily is returned when transparent mode is asked to send
+// anything but IPv4.
+var errTransparentFamily = errors.New("transparent mode supports IPv4 only")
+
+// buildUDPv4 returns an IPv4 packet carrying payload in a UDP datagram from
+// src to dst with the given ToS and TTL. The UDP checksum is filled in; the IP header checksum is left
+// for the kernel, which always computes it for raw sockets.
+func buildUDPv4(src, dst *net.UDPAddr, tos, ttl byte, payload []byte) ([]byte, error) {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		return nil, errTransparentFamily
+	}
+
+	const ipHeaderLen, udpHeaderLen = 20, 8
+	udpLen := udpHeaderLen + len(payload)
+	pkt := make([]byte, ipHeaderLen+udpLen)
+
+	ip := pkt[:ipHeaderLen]
+	ip[0] = 0x45 // version 4, 5-word header
+	ip[1] = tos
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	ip[8] = ttl
+	ip[9] = 17 // UDP
+	copy(ip[12:16], srcIP)
+	copy(ip[16:20], dstIP)
+
+	udp := pkt[ipHeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHeaderLen:], payload)
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(srcIP, dstIP, udp))
+
+	return pkt, nil
+}
+
+// udpChecksum computes the UDP checksum of udp (with its checksum field
+// zeroed) over the IPv4 pseudo-header.
+func udpChecksum(src, dst net.IP, udp []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for len(b) >= 2 {
+			sum += uint32(b[0])<<8 | uint32(b[1])
+			b = b[2:]
+		}
+		if len(b) == 1 {
+			sum += uint32(b[0]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	sum += 17 + uint32(len(udp))
+	add(udp)
+
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	csum := ^uint16(sum)
+	if csum == 0 {
+		// An all-zero checksum means "none" in UDP; send all ones instead.
+		csum = 0xffff
+	}
+	return csum
+}
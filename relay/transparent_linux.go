@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// rawSender writes UDP datagrams with a forged source address through a raw
+// IPv4 socket. Opening it requires root or CAP_NET_RAW.
+type rawSender struct {
+	fd  int
+	tos byte
+	ttl byte
+}
+
+// newRawSender opens the raw socket. The DSCP and TTL from opts go into the
+// header of every packet.
+func newRawSender(opts socketOptions) (*rawSender, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raw socket (transparent mode requires root or CAP_NET_RAW): %v", err)
+	}
+	// Allow relaying to broadcast targets.
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to enable broadcast on raw socket: %v", err)
+	}
+	if opts.writeTimeout > 0 {
+		tv := syscall.NsecToTimeval(opts.writeTimeout.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("failed to set send timeout on raw socket: %v", err)
+		}
+	}
+	ttl := 64
+	if opts.ttl > 0 {
+		ttl = opts.ttl
+	}
+	return &rawSender{fd: fd, tos: byte(opts.dscp << 2), ttl: byte(ttl)}, nil
+}
+
+// send writes payload to dst as if it came from src and returns the number
+// of payload bytes sent.
+func (s *rawSender) send(src, dst *net.UDPAddr, payload []byte) (int, error) {
+	pkt, err := buildUDPv4(src, dst, s.tos, s.ttl, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	sa := &syscall.SockaddrInet4{Port: dst.Port}
+	copy(sa.Addr[:], dst.IP.To4())
+	if err := syscall.Sendto(s.fd, pkt, 0, sa); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+func (s *rawSender) close() error {
+	return syscall.Close(s.fd)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package relay
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+type rawSender struct{}
+
+func newRawSender(opts socketOptions) (*rawSender, error) {
+	return nil, fmt.Errorf("transparent mode is not supported on %s", runtime.GOOS)
+}
+
+func (s *rawSender) send(src, dst *net.UDPAddr, payload []byte) (int, error) {
+	return 0, errTransparentFamily
+}
+
+func (s *rawSender) close() error {
+	return nil
+}
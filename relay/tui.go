@@ -0,0 +1,206 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// tuiLogLines is how many of the latest log lines the -tui dashboard shows.
+const tuiLogLines = 10
+
+// LogTail is the log output under -tui. While the dashboard is shown it
+// keeps the latest lines for the dashboard to show instead of writing them
+// over it; they are written out when it closes. Otherwise it writes to the
+// underlying writer.
+type LogTail struct {
+	w io.Writer
+
+	mu    sync.Mutex
+	held  bool
+	lines [][]byte
+}
+
+// NewLogTail returns a LogTail writing to w.
+func NewLogTail(w io.Writer) *LogTail {
+	return &LogTail{w: w}
+}
+
+func (t *LogTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.held {
+		return t.w.Write(p)
+	}
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if len(t.lines) == tuiLogLines {
+			t.lines = append(t.lines[:0], t.lines[1:]...)
+		}
+		t.lines = append(t.lines, bytes.Clone(line))
+	}
+	return len(p), nil
+}
+
+// hold starts or stops keeping the lines. Stopping writes out the kept
+// ones.
+func (t *LogTail) hold(held bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.held = held
+	if !held {
+		for _, line := range t.lines {
+			t.w.Write(line)
+		}
+		t.lines = nil
+	}
+}
+
+// tail returns the kept lines, without their line breaks.
+func (t *LogTail) tail() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := make([]string, len(t.lines))
+	for i, line := range t.lines {
+		lines[i] = strings.TrimRight(string(line), "\n")
+	}
+	return lines
+}
+
+// Terminal control sequences for the dashboard.
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+)
+
+// dashboard shows a live view of the stats on stdout, redrawn every second,
+// until the relay stops.
+func (r *Relay) dashboard() {
+	defer r.wg.Done()
+
+	out := os.Stdout
+	if r.LogTail != nil {
+		r.LogTail.hold(true)
+		defer r.LogTail.hold(false)
+	}
+	enableANSI(out)
+	out.WriteString(ansiAltScreen)
+	defer out.WriteString(ansiMainScreen)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	prev, prevTime := r.snapshot(), time.Now()
+	out.WriteString(r.dashboardFrame(prev, prev, 0))
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-ticker.C:
+			cur := r.snapshot()
+			out.WriteString(r.dashboardFrame(prev, cur, now.Sub(prevTime)))
+			prev, prevTime = cur, now
+		}
+	}
+}
+
+// dashboardFrame renders the dashboard for the snapshot cur, with rates
+// from the change since prev, taken elapsed earlier.
+func (r *Relay) dashboardFrame(prev, cur StatsSnapshot, elapsed time.Duration) string {
+	rate := func(prev, cur uint64) float64 {
+		if elapsed <= 0 || cur < prev {
+			return 0
+		}
+		return float64(cur-prev) / elapsed.Seconds()
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiHome)
+	fmt.Fprintf(&b, "Broadcast Relay %s, up %s, listening on %s\n\n",
+		Version, time.Since(r.startTime()).Round(time.Second), r.listenDescription())
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\tpkt/s\tB/s\tpackets\tbytes\n")
+	fmt.Fprintf(w, "Received\t%.1f\t%s\t%d\t%s\n",
+		rate(prev.PacketsReceived, cur.PacketsReceived), formatBytes(rate(prev.BytesReceived, cur.BytesReceived)),
+		cur.PacketsReceived, formatBytes(float64(cur.BytesReceived)))
+	fmt.Fprintf(w, "Forwarded\t%.1f\t%s\t%d\t%s\n",
+		rate(prev.PacketsForwarded, cur.PacketsForwarded), formatBytes(rate(prev.BytesForwarded, cur.BytesForwarded)),
+		cur.PacketsForwarded, formatBytes(float64(cur.BytesForwarded)))
+	w.Flush()
+	fmt.Fprintf(&b, "\nFiltered %d, duplicates %d, denied %d, sampled out %d, dropped %d, queue full %d, kernel dropped %d, queue %d, errors %d\n\n",
+		cur.PacketsFiltered, cur.PacketsDuplicate, cur.PacketsDenied, cur.PacketsSampled, cur.PacketsDropped,
+		cur.QueueDropped, cur.KernelDropped, cur.QueueDepth, cur.Errors)
+
+	fmt.Fprintf(w, "TARGET\tSTATUS\tpkt/s\tB/s\tpackets\tbytes\tdropped\terrors\n")
+	for _, name := range r.Targets() {
+		ts, was := cur.Targets[name], prev.Targets[name]
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%s\t%d\t%s\t%d\t%d\n",
+			name, targetStatus(ts),
+			rate(was.PacketsForwarded, ts.PacketsForwarded), formatBytes(rate(was.BytesForwarded, ts.BytesForwarded)),
+			ts.PacketsForwarded, formatBytes(float64(ts.BytesForwarded)), ts.PacketsDropped, ts.Errors)
+	}
+	w.Flush()
+
+	if r.LogTail != nil {
+		b.WriteString("\n")
+		for _, line := range r.LogTail.tail() {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
+
+	// Every line is cleared past its end, and the screen below the last,
+	// for a shorter frame to leave nothing of the one before.
+	frame := strings.ReplaceAll(b.String(), "\n", ansiClearLine+"\n")
+	return frame + ansiClearBelow
+}
+
+// listenDescription returns the listen addresses, or the -replay file.
+func (r *Relay) listenDescription() string {
+	if r.replay != nil {
+		return "replay of " + r.config.Replay
+	}
+	addrs := make([]string, len(r.listeners))
+	for i, l := range r.listeners {
+		addrs[i] = listenHostPort(r.config, l.port)
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// targetStatus describes the state of a target for the dashboard.
+func targetStatus(ts TargetStats) string {
+	switch {
+	case ts.Breaker != "":
+		return "breaker " + ts.Breaker
+	case ts.Down:
+		return "down"
+	case ts.Active:
+		return "up, active"
+	}
+	return "up"
+}
+
+// formatBytes formats a byte count with a decimal unit.
+func formatBytes(n float64) string {
+	const units = "kMGT"
+	if n < 1000 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	i := -1
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", n, units[i])
+}
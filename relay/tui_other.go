@@ -0,0 +1,9 @@
+//go:build !windows
+
+package relay
+
+import "os"
+
+// enableANSI does nothing: terminals elsewhere process ANSI control
+// sequences already.
+func enableANSI(f *os.File) {}
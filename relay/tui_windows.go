@@ -0,0 +1,17 @@
+package relay
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// enableANSI turns on the processing of ANSI control sequences for the
+// console f writes to, which the Windows console leaves off by default.
+func enableANSI(f *os.File) {
+	h := windows.Handle(f.Fd())
+	var mode uint32
+	if windows.GetConsoleMode(h, &mode) == nil {
+		windows.SetConsoleMode(h, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING)
+	}
+}
@@ -0,0 +1,39 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+)
+
+// unixScheme is the prefix of targets that are Unix datagram sockets, as in
+// unixgram:/var/run/relay.sock. Each packet is written to the socket as one
+// datagram, as it would be sent to a UDP target.
+const unixScheme = "unixgram:"
+
+var errUnixUnsupported = errors.New("unixgram targets are not supported on Windows")
+
+// unixTarget returns the socket address of a unixgram: target, or false if
+// target is not one.
+func unixTarget(target string) (*net.UnixAddr, bool, error) {
+	path, ok := strings.CutPrefix(target, unixScheme)
+	if !ok {
+		return nil, false, nil
+	}
+	if path == "" {
+		return nil, true, fmt.Errorf("target %s: missing socket path", target)
+	}
+	if runtime.GOOS == "windows" {
+		return nil, true, fmt.Errorf("target %s: %v", target, errUnixUnsupported)
+	}
+	return &net.UnixAddr{Name: path, Net: "unixgram"}, true, nil
+}
+
+// dialUnixTarget connects to a Unix datagram socket. A consumer that
+// recreates its socket ends the connection to the old one, whose writes
+// then fail until the target is dialed again.
+func dialUnixTarget(addr *net.UnixAddr) (net.Conn, error) {
+	return net.DialUnix("unixgram", nil, addr)
+}
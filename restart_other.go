@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+// restart is only supported on Unix; LoadConfig rejects -max-lifetime on
+// Windows, and there is no upgrade signal.
+func restart(files []*os.File) error {
+	return errors.New("restarting is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,63 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/k0ngk0ng/broadcast-relay/relay"
+)
+
+// restart replaces the process with the executable run afresh with the same
+// arguments and environment, keeping its process ID. files, the relay's
+// listen sockets, are passed on for the new process to inherit, so that
+// they are never closed.
+func restart(files []*os.File) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %v", err)
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	if len(files) > 0 {
+		if err := passFiles(files); err != nil {
+			return fmt.Errorf("failed to pass on the listen sockets: %v", err)
+		}
+		env = append(env, "LISTEN_PID="+strconv.Itoa(os.Getpid()), "LISTEN_FDS="+strconv.Itoa(len(files)))
+	}
+	if err := syscall.Exec(exe, os.Args, env); err != nil {
+		return fmt.Errorf("failed to execute %s: %v", exe, err)
+	}
+	return nil
+}
+
+// passFiles moves files to the descriptors from relay.ListenFDsStart on,
+// without close-on-exec. They are duplicated above that range first, so
+// that moving one does not replace another yet to be moved.
+func passFiles(files []*os.File) error {
+	above := relay.ListenFDsStart + len(files)
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, above)
+		if err != nil {
+			return err
+		}
+		fds[i] = fd
+	}
+	for i, fd := range fds {
+		if err := unix.Dup2(fd, relay.ListenFDsStart+i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
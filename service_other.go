@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/k0ngk0ng/broadcast-relay/relay"
+)
+
+// logOutput returns where to log.
+func logOutput() io.Writer {
+	return os.Stderr
+}
+
+// run runs r until ctx is done.
+func run(ctx context.Context, r *relay.Relay) error {
+	return r.Run(ctx)
+}
+
+// controlService is only supported on Windows; LoadConfig rejects -service
+// elsewhere.
+func controlService(action string, args []string) error {
+	return errors.New("-service is only supported on Windows")
+}
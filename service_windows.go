@@ -0,0 +1,171 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/k0ngk0ng/broadcast-relay/relay"
+)
+
+// serviceName is the name -service install registers the relay and its
+// event log source under.
+const serviceName = "broadcast-relay"
+
+// isService reports whether the service control manager started the
+// process.
+func isService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// eventLogWriter writes every log line to the Windows event log, at the
+// level it was logged at.
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch {
+	case strings.Contains(line, "level=ERROR"), strings.Contains(line, `"level":"ERROR"`):
+		err = w.log.Error(1, line)
+	case strings.Contains(line, "level=WARN"), strings.Contains(line, `"level":"WARN"`):
+		err = w.log.Warning(1, line)
+	default:
+		err = w.log.Info(1, line)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logOutput returns where to log: the event log when running as a
+// service, which has no standard error, and standard error otherwise.
+func logOutput() io.Writer {
+	if !isService() {
+		return os.Stderr
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return os.Stderr
+	}
+	return eventLogWriter{elog}
+}
+
+// relayService runs the relay for the service control manager.
+type relayService struct {
+	ctx   context.Context
+	relay *relay.Relay
+	err   error
+}
+
+func (s *relayService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.relay.Run(s.ctx)
+	}()
+
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case s.err = <-done:
+			status <- svc.Status{State: svc.StopPending}
+			switch {
+			case errors.Is(s.err, relay.ErrIdleTimeout):
+				return true, exitIdle
+			case s.err != nil:
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				slog.Info("Service stop requested")
+				status <- svc.Status{State: svc.StopPending}
+				// Stop waits for in-flight forwards; Run returns once it
+				// is done.
+				go s.relay.Stop()
+			}
+		}
+	}
+}
+
+// run runs r until ctx is done, or under the service control manager until
+// it asks the service to stop.
+func run(ctx context.Context, r *relay.Relay) error {
+	if !isService() {
+		return r.Run(ctx)
+	}
+	s := &relayService{ctx: ctx, relay: r}
+	if err := svc.Run(serviceName, s); err != nil {
+		return fmt.Errorf("failed to run as a service: %v", err)
+	}
+	return s.err
+}
+
+// controlService installs the relay as a service that runs this executable
+// with args, or uninstalls it.
+func controlService(action string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	if action == "uninstall" {
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %v", serviceName, err)
+		}
+		defer s.Close()
+		// A running service is only removed once it stops.
+		s.Control(svc.Stop)
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to delete service %s: %v", serviceName, err)
+		}
+		eventlog.Remove(serviceName)
+		fmt.Printf("Uninstalled service %s\n", serviceName)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %v", err)
+	}
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Broadcast Relay",
+		Description: "Forwards UDP broadcast packets to unicast targets",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service %s: %v", serviceName, err)
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register the event log source: %v", err)
+	}
+	fmt.Printf("Installed service %s running %s %s\n", serviceName, exe, strings.Join(args, " "))
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// statsSignal is nil where there is no SIGUSR1.
+var statsSignal os.Signal
+
+// upgradeSignal is nil where there is no SIGUSR2.
+var upgradeSignal os.Signal
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statsSignal makes the relay log its current stats.
+var statsSignal os.Signal = syscall.SIGUSR1
+
+// upgradeSignal makes the relay restart, handing its listen sockets over to
+// the executable run afresh.
+var upgradeSignal os.Signal = syscall.SIGUSR2